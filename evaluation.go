@@ -0,0 +1,333 @@
+package speculative
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Fold is a split of transactions into training and test transactions.
+type Fold struct {
+	Training [][]*Query
+	Test     [][]*Query
+}
+
+// SplitStrategy splits the transactions of a cluster into folds. It must
+// return the same number of folds for every cluster, and keep the order
+// of the transactions within the training and the test transactions.
+type SplitStrategy interface {
+	Split(transactions [][]*Query) []Fold
+	// Validate returns an error if the strategy cannot split transactions.
+	Validate() error
+	ToString() string
+}
+
+// validateFraction returns an error if the training fraction is not in [0, 1].
+func validateFraction(fraction float64) error {
+	if fraction < 0 || fraction > 1 {
+		return fmt.Errorf("training fraction %v is not between 0 and 1", fraction)
+	}
+	return nil
+}
+
+// PrefixSplit trains on the first fraction of the transactions
+// and tests on the rest.
+type PrefixSplit struct {
+	TrainingFraction float64
+}
+
+// Split returns a single fold.
+func (split PrefixSplit) Split(transactions [][]*Query) []Fold {
+	numTraining := int(float64(len(transactions)) * split.TrainingFraction)
+	return []Fold{Fold{transactions[:numTraining], transactions[numTraining:]}}
+}
+
+// Validate returns an error if the training fraction is not in [0, 1].
+func (split PrefixSplit) Validate() error {
+	return validateFraction(split.TrainingFraction)
+}
+
+// ToString returns a string representation of this strategy.
+func (split PrefixSplit) ToString() string {
+	return fmt.Sprintf("prefix(%v)", split.TrainingFraction)
+}
+
+// RandomSplit trains on a fraction of the transactions picked at
+// random using the seed, and tests on the rest.
+type RandomSplit struct {
+	TrainingFraction float64
+	Seed             int64
+}
+
+// Split returns a single fold.
+func (split RandomSplit) Split(transactions [][]*Query) []Fold {
+	numTraining := int(float64(len(transactions)) * split.TrainingFraction)
+	training := make(map[int]bool)
+	for _, i := range rand.New(rand.NewSource(split.Seed)).Perm(len(transactions))[:numTraining] {
+		training[i] = true
+	}
+	fold := Fold{[][]*Query{}, [][]*Query{}}
+	for i, trx := range transactions {
+		if training[i] {
+			fold.Training = append(fold.Training, trx)
+		} else {
+			fold.Test = append(fold.Test, trx)
+		}
+	}
+	return []Fold{fold}
+}
+
+// Validate returns an error if the training fraction is not in [0, 1].
+func (split RandomSplit) Validate() error {
+	return validateFraction(split.TrainingFraction)
+}
+
+// ToString returns a string representation of this strategy.
+func (split RandomSplit) ToString() string {
+	return fmt.Sprintf("random(%v, seed %d)", split.TrainingFraction, split.Seed)
+}
+
+// TimeSplit trains on the fraction of the transactions that started
+// first and tests on the ones that started later. The start of a
+// transaction is the time of its first query, read from the optional
+// "time" field of the trace (see ParseQuery). Transactions without a
+// time count as the earliest, so a trace without times is split like
+// PrefixSplit does.
+type TimeSplit struct {
+	TrainingFraction float64
+}
+
+// Split returns a single fold.
+func (split TimeSplit) Split(transactions [][]*Query) []Fold {
+	sorted := append([][]*Query{}, transactions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i][0].Time.Before(sorted[j][0].Time)
+	})
+	numTraining := int(float64(len(sorted)) * split.TrainingFraction)
+	return []Fold{Fold{sorted[:numTraining], sorted[numTraining:]}}
+}
+
+// Validate returns an error if the training fraction is not in [0, 1].
+func (split TimeSplit) Validate() error {
+	return validateFraction(split.TrainingFraction)
+}
+
+// ToString returns a string representation of this strategy.
+func (split TimeSplit) ToString() string {
+	return fmt.Sprintf("time(%v)", split.TrainingFraction)
+}
+
+// KFoldSplit returns K folds. The i-th transaction is tested
+// in the (i mod K)-th fold, and used for training in the others.
+type KFoldSplit struct {
+	K int
+}
+
+// Split returns K folds.
+func (split KFoldSplit) Split(transactions [][]*Query) []Fold {
+	folds := make([]Fold, split.K)
+	for f := range folds {
+		folds[f] = Fold{[][]*Query{}, [][]*Query{}}
+		for i, trx := range transactions {
+			if i%split.K == f {
+				folds[f].Test = append(folds[f].Test, trx)
+			} else {
+				folds[f].Training = append(folds[f].Training, trx)
+			}
+		}
+	}
+	return folds
+}
+
+// Validate returns an error if there are fewer than two folds.
+func (split KFoldSplit) Validate() error {
+	if split.K < 2 {
+		return fmt.Errorf("k-fold split needs at least 2 folds, got %d", split.K)
+	}
+	return nil
+}
+
+// ToString returns a string representation of this strategy.
+func (split KFoldSplit) ToString() string {
+	return fmt.Sprintf("%d-fold", split.K)
+}
+
+// Metrics counts how the queries following the first one of the
+// tested transactions were predicted.
+type Metrics struct {
+	Transactions  int
+	Queries       int
+	Selects       int
+	Hits          int
+	Wrong         int
+	Unpredictable int
+}
+
+// record records the prediction made for the query.
+func (metrics *Metrics) record(query *Query, prediction *Query) {
+	metrics.Queries++
+	if query.IsSelect {
+		metrics.Selects++
+	}
+	if query.Same(prediction) {
+		metrics.Hits++
+	} else if prediction != nil {
+		metrics.Wrong++
+	} else {
+		metrics.Unpredictable++
+	}
+}
+
+// HitRate returns the fraction of the queries predicted exactly.
+func (metrics *Metrics) HitRate() float64 {
+	if metrics.Queries == 0 {
+		return 0
+	}
+	return float64(metrics.Hits) / float64(metrics.Queries)
+}
+
+// SelectHitRate returns the number of hits over the number of reads.
+func (metrics *Metrics) SelectHitRate() float64 {
+	if metrics.Selects == 0 {
+		return 0
+	}
+	return float64(metrics.Hits) / float64(metrics.Selects)
+}
+
+// ToString returns a string representation of these metrics.
+func (metrics *Metrics) ToString() string {
+	return fmt.Sprintf("%d transactions, %d queries, %d selects, %d hits, %d wrong, %d unpredictable",
+		metrics.Transactions, metrics.Queries, metrics.Selects, metrics.Hits, metrics.Wrong, metrics.Unpredictable)
+}
+
+// EvaluationResult contains the metrics of an evaluation, over all the
+// tested transactions and broken down by cluster, by tree, i.e., by the
+// first query of the transaction, by the template of the actual query,
+// and by the position of the query in its transaction.
+type EvaluationResult struct {
+	Strategy string
+	// Options are the options the models were built with.
+	Options     ModelBuilderOptions
+	Folds       int
+	Global      Metrics
+	PerCluster  []*Metrics
+	PerTree     map[int]*Metrics
+	PerTemplate map[int]*Metrics
+	PerPosition []*Metrics
+	// SkippedTransactions counts the transactions of the clusters
+	// skipped for being too short.
+	SkippedTransactions int
+	// Model is the model of the last fold.
+	Model *PredictionTrees
+}
+
+// Evaluator evaluates the prediction on the transactions of a model
+// builder, training and testing on the folds of every cluster given
+// by a split strategy.
+type Evaluator struct {
+	Builder  *ModelBuilder
+	Strategy SplitStrategy
+	// MinTransactionLength skips the clusters whose transactions are
+	// shorter than this, as they give little to predict.
+	MinTransactionLength int
+	// Workers is the number of workers building the models.
+	Workers int
+	// Prebuilt, if not nil, is used in every fold instead of a model
+	// trained on the training transactions.
+	Prebuilt *PredictionTrees
+}
+
+// NewEvaluator creates an evaluator using all the clusters of the builder.
+func NewEvaluator(builder *ModelBuilder, strategy SplitStrategy) *Evaluator {
+	return &Evaluator{builder, strategy, 0, 1, nil}
+}
+
+// Evaluate trains a model for each fold and predicts every query
+// of the test transactions with it.
+func (evaluator *Evaluator) Evaluate() *EvaluationResult {
+	builder := evaluator.Builder
+	result := &EvaluationResult{Strategy: evaluator.Strategy.ToString(), Options: builder.Options,
+		PerCluster: make([]*Metrics, len(builder.Clusters)), PerTree: make(map[int]*Metrics),
+		PerTemplate: make(map[int]*Metrics), PerPosition: []*Metrics{}}
+	if evaluator.Prebuilt != nil && evaluator.Prebuilt.Options != nil {
+		result.Options = *evaluator.Prebuilt.Options
+	}
+	splits := make([][]Fold, len(builder.Clusters))
+	for c, cluster := range builder.Clusters {
+		result.PerCluster[c] = &Metrics{}
+		if len(cluster[0]) < evaluator.MinTransactionLength {
+			result.SkippedTransactions += len(cluster)
+			continue
+		}
+		splits[c] = evaluator.Strategy.Split(cluster)
+		result.Folds = max(result.Folds, len(splits[c]))
+	}
+	for f := 0; f < result.Folds; f++ {
+		pt := evaluator.Prebuilt
+		if pt == nil {
+			pt = NewPredictionTrees()
+			trainingClusters := [][][]*Query{}
+			training := [][]*Query{}
+			for _, folds := range splits {
+				if f < len(folds) && len(folds[f].Training) > 0 {
+					trainingClusters = append(trainingClusters, folds[f].Training)
+					training = append(training, folds[f].Training...)
+				}
+			}
+			builder.BuildModel(trainingClusters, pt, evaluator.Workers)
+			builder.LearnDecisions(training, pt)
+			pt.Split = evaluator.Strategy.ToString()
+		}
+		predictor := pt.NewPredictor(builder.QuerySet)
+		for c, folds := range splits {
+			if f >= len(folds) {
+				continue
+			}
+			for _, trx := range folds[f].Test {
+				evaluator.evaluateTransaction(predictor, trx, result, result.PerCluster[c])
+			}
+		}
+		result.Model = pt
+	}
+	return result
+}
+
+// evaluateTransaction predicts every query of the transaction but the first.
+func (evaluator *Evaluator) evaluateTransaction(predictor *Predictor, trx []*Query, result *EvaluationResult, cluster *Metrics) {
+	tree := result.PerTree[trx[0].QueryID]
+	if tree == nil {
+		tree = &Metrics{}
+		result.PerTree[trx[0].QueryID] = tree
+	}
+	for _, metrics := range []*Metrics{&result.Global, cluster, tree} {
+		metrics.Transactions++
+	}
+	for position, query := range trx {
+		if position > 0 {
+			prediction := predictor.PredictNextQuery()
+			if result.PerTemplate[query.QueryID] == nil {
+				result.PerTemplate[query.QueryID] = &Metrics{}
+			}
+			for len(result.PerPosition) <= position {
+				result.PerPosition = append(result.PerPosition, &Metrics{})
+			}
+			for _, metrics := range []*Metrics{&result.Global, cluster, tree, result.PerTemplate[query.QueryID], result.PerPosition[position]} {
+				metrics.record(query, prediction)
+			}
+		}
+		predictor.MoveToNext(query)
+	}
+	predictor.EndTransaction()
+}
+
+// Baselines returns the hit rate of each tree with predicted
+// queries, keyed by root query ID, to give a HealthMonitor.
+func (result *EvaluationResult) Baselines() map[int]float64 {
+	baselines := make(map[int]float64, len(result.PerTree))
+	for rootQueryID, metrics := range result.PerTree {
+		if metrics.Queries > 0 {
+			baselines[rootQueryID] = metrics.HitRate()
+		}
+	}
+	return baselines
+}
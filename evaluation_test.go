@@ -0,0 +1,100 @@
+package speculative
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSplitStrategies(t *testing.T) {
+	transactions := [][]*Query{}
+	for i := 0; i < 10; i++ {
+		start := time.Unix(int64(100-i), 0)
+		transactions = append(transactions, []*Query{&Query{QueryID: i, IsSelect: true, Time: start}})
+	}
+	for _, strategy := range []SplitStrategy{PrefixSplit{0.3}, RandomSplit{0.3, 42}, TimeSplit{0.3}} {
+		folds := strategy.Split(transactions)
+		if len(folds) != 1 || len(folds[0].Training) != 3 || len(folds[0].Test) != 7 {
+			t.Fatalf("Expecting %s to split 3/7", strategy.ToString())
+		}
+	}
+	if trx := (PrefixSplit{0.3}).Split(transactions)[0].Training[0]; trx[0].QueryID != 0 {
+		t.Fatalf("Expecting the prefix split to train on the first transactions")
+	}
+	if trx := (TimeSplit{0.3}).Split(transactions)[0].Training[0]; trx[0].QueryID != 9 {
+		t.Fatalf("Expecting the time split to train on the earliest transactions")
+	}
+	first := (RandomSplit{0.3, 42}).Split(transactions)[0]
+	second := (RandomSplit{0.3, 42}).Split(transactions)[0]
+	for i := range first.Training {
+		if first.Training[i][0] != second.Training[i][0] {
+			t.Fatalf("Expecting the random split to depend only on the seed")
+		}
+	}
+	tested := make(map[int]int)
+	for _, fold := range (KFoldSplit{3}).Split(transactions) {
+		if len(fold.Training)+len(fold.Test) != len(transactions) {
+			t.Fatalf("Expecting every fold to use all the transactions")
+		}
+		for _, trx := range fold.Test {
+			tested[trx[0].QueryID]++
+		}
+	}
+	for i := range transactions {
+		if tested[i] != 1 {
+			t.Fatalf("Expecting transaction %d to be tested once, got %d", i, tested[i])
+		}
+	}
+	for _, strategy := range []SplitStrategy{PrefixSplit{1.5}, RandomSplit{-0.1, 42}, TimeSplit{2}, KFoldSplit{0}, KFoldSplit{1}} {
+		if strategy.Validate() == nil {
+			t.Fatalf("Expecting %s to be rejected", strategy.ToString())
+		}
+	}
+	if (PrefixSplit{1}).Validate() != nil || (KFoldSplit{2}).Validate() != nil {
+		t.Fatalf("Expecting the bounds to be accepted")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		return []traceQuery{userQuery(i, i),
+			{fmt.Sprintf("SELECT * FROM stories WHERE user_id = %d", i), fmt.Sprintf("[[%d]]", i+100)},
+			{fmt.Sprintf("SELECT * FROM comments WHERE story_id = %d", i+100), "[]"}}
+	})
+	trace += "\n" + testTrace(4, func(i int) []traceQuery {
+		return []traceQuery{{fmt.Sprintf("SELECT * FROM tags WHERE id = %d", i), "[]"}}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	evaluator := NewEvaluator(modelBuilder, PrefixSplit{0.3})
+	evaluator.MinTransactionLength = 2
+	result := evaluator.Evaluate()
+	if result.Options != modelBuilder.Options || result.Model.Split != "prefix(0.3)" {
+		t.Fatalf("Expecting the options and the split to be reported")
+	}
+	if result.Folds != 1 || result.SkippedTransactions != 4 {
+		t.Fatalf("Expecting 1 fold and the 4 short transactions skipped, got %d and %d", result.Folds, result.SkippedTransactions)
+	}
+	if result.Global.Transactions != 7 || result.Global.Queries != 14 || result.Global.Hits != 14 {
+		t.Fatalf("Expecting the 14 queries of the 7 test transactions to be hit, got %s", result.Global.ToString())
+	}
+	if result.PerCluster[0].Hits != 14 || result.PerCluster[1].Transactions != 0 {
+		t.Fatalf("Unexpected per-cluster metrics %s and %s", result.PerCluster[0].ToString(), result.PerCluster[1].ToString())
+	}
+	if len(result.PerTemplate) != 2 || len(result.PerPosition) != 3 || result.PerPosition[2].Hits != 7 {
+		t.Fatalf("Expecting 2 templates and 2 predicted positions with 7 hits each")
+	}
+	if baselines := result.Baselines(); len(baselines) != 1 || baselines[modelBuilder.Clusters[0][0][0].QueryID] != 1 {
+		t.Fatalf("Expecting a perfect baseline for the only tested tree, got %v", baselines)
+	}
+	if result.PerPosition[0].Queries != 0 {
+		t.Fatalf("Expecting the first query of the transactions not to be predicted")
+	}
+
+	result = NewEvaluator(modelBuilder, KFoldSplit{2}).Evaluate()
+	if result.Folds != 2 || result.Global.Transactions != 14 {
+		t.Fatalf("Expecting every transaction to be tested once over 2 folds, got %s", result.Global.ToString())
+	}
+	if result.PerCluster[1].Unpredictable != 0 || result.PerCluster[0].Hits != 20 {
+		t.Fatalf("Unexpected per-cluster metrics %s and %s", result.PerCluster[0].ToString(), result.PerCluster[1].ToString())
+	}
+}
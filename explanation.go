@@ -0,0 +1,220 @@
+package speculative
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ArgumentExplanation tells where an argument of a predicted query comes from.
+type ArgumentExplanation struct {
+	// Operation is the operation predicting the argument,
+	// and Description says the same in words.
+	Operation   string      `json:"operation"`
+	Description string      `json:"description"`
+	Value       interface{} `json:"value"`
+}
+
+// Alternative is another node that was considered for the prediction.
+type Alternative struct {
+	QueryID     int      `json:"queryID"`
+	Probability float64  `json:"probability"`
+	HitCount    int      `json:"hitCount"`
+	IsRandom    bool     `json:"isRandom,omitempty"`
+	Operations  []string `json:"operations"`
+}
+
+// Explanation tells how a predicted query was made: the node of the
+// prediction tree it comes from, with its statistics, the provenance
+// of every argument, and the other nodes that were considered. Unsafe
+// is true if the query is a write, not to be executed speculatively.
+type Explanation struct {
+	QueryID     int     `json:"queryID"`
+	SQL         string  `json:"sql"`
+	Probability float64 `json:"probability"`
+	// HitCount is how many training transactions the node matched, out
+	// of the Trials that issued its query after the same prefix.
+	HitCount          int                    `json:"hitCount"`
+	Trials            int                    `json:"trials"`
+	SpeculationHits   int                    `json:"speculationHits"`
+	SpeculationMisses int                    `json:"speculationMisses"`
+	IsLoop            bool                   `json:"isLoop,omitempty"`
+	IsGroupMember     bool                   `json:"isGroupMember,omitempty"`
+	Unsafe            bool                   `json:"unsafe,omitempty"`
+	Decision          string                 `json:"decision,omitempty"`
+	Arguments         []*ArgumentExplanation `json:"arguments"`
+	Alternatives      []*Alternative         `json:"alternatives"`
+}
+
+// ToString returns a string representation of this explanation.
+func (explanation *Explanation) ToString() string {
+	unsafe := ""
+	if explanation.Unsafe {
+		unsafe = ", unsafe write"
+	}
+	lines := []string{fmt.Sprintf("%s (query %d, probability %.2f%s)", explanation.SQL, explanation.QueryID, explanation.Probability, unsafe)}
+	kind := ""
+	if explanation.IsLoop {
+		kind = " loop"
+	} else if explanation.IsGroupMember {
+		kind = " group member"
+	}
+	lines = append(lines, fmt.Sprintf("  node%s hit %d/%d times in training, %d/%d speculations hit", kind,
+		explanation.HitCount, explanation.Trials, explanation.SpeculationHits, explanation.SpeculationHits+explanation.SpeculationMisses))
+	if explanation.Decision != "" {
+		lines = append(lines, "  decision: "+explanation.Decision)
+	}
+	for i, argument := range explanation.Arguments {
+		lines = append(lines, fmt.Sprintf("  argument %d = %v: %s [%s]", i, argument.Value, argument.Description, argument.Operation))
+	}
+	for _, alternative := range explanation.Alternatives {
+		random := ""
+		if alternative.IsRandom {
+			random = ", random"
+		}
+		lines = append(lines, fmt.Sprintf("  alternative: query %d (probability %.2f, hit %d times%s) [%s]", alternative.QueryID,
+			alternative.Probability, alternative.HitCount, random, strings.Join(alternative.Operations, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ordinal returns the English ordinal of a positive number, e.g., 2nd.
+func ordinal(num int) string {
+	suffix := "th"
+	if num%100 < 11 || num%100 > 13 {
+		switch num % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+	return fmt.Sprintf("%d%s", num, suffix)
+}
+
+// nthQuery names the queryIndex-th query of a transaction.
+func nthQuery(queryIndex int) string {
+	return fmt.Sprintf("the %s query", ordinal(queryIndex+1))
+}
+
+// describe returns in words where the value of an operation
+// or operand comes from.
+func describe(term interface{}) string {
+	switch op := term.(type) {
+	case UnaryOperation:
+		return describe(op.Operand)
+	case BinaryOperation:
+		return fmt.Sprintf("(%s) %s (%s)", describe(op.LeftOperand), op.Operator.Name(), describe(op.RightOperand))
+	case DistributionOperation:
+		return fmt.Sprintf("the most frequent value, seen %.0f%% of the time", 100*op.Sketch.Frequency())
+	case RandomOperation:
+		return "unknown"
+	case ConstOperand:
+		return fmt.Sprintf("the constant %v", op.Value)
+	case QueryResultOperand:
+		return fmt.Sprintf("column %d of row %d of %s's result", op.ColumnIndex, op.RowIndex, nthQuery(op.QueryIndex))
+	case LastRowOperand:
+		return fmt.Sprintf("column %d of the last row of %s's result", op.ColumnIndex, nthQuery(op.QueryIndex))
+	case KeyedLookupOperand:
+		return fmt.Sprintf("column %d of the row of %s's result whose column %d is %s",
+			op.ValueColumn, nthQuery(op.QueryIndex), op.KeyColumn, describe(op.Key))
+	case IterationOperand:
+		return fmt.Sprintf("column %d of the current row of %s's result", op.ColumnIndex, nthQuery(op.QueryIndex))
+	case QueryArgumentOperand:
+		return fmt.Sprintf("argument %d of %s", op.ArgIndex, nthQuery(op.QueryIndex))
+	case AggregationOperand:
+		return fmt.Sprintf("the %s of column %d of %s's result", op.Aggregation.Name(), op.ColumnIndex, nthQuery(op.QueryIndex))
+	case FormatOperand:
+		if op.Second == nil {
+			return fmt.Sprintf("'%s' formatted with %s", op.Format, describe(op.First))
+		}
+		return fmt.Sprintf("'%s' formatted with %s and %s", op.Format, describe(op.First), describe(op.Second))
+	case AffineOperand:
+		return fmt.Sprintf("%v times %s plus %v", op.Scale, describe(op.Operand), op.Offset)
+	case TimestampOperand:
+		base := "the start of the transaction"
+		if op.Operand != nil {
+			base = describe(op.Operand)
+		}
+		if op.Unit > 0 {
+			base = fmt.Sprintf("%s truncated to %v", base, op.Unit)
+		}
+		return fmt.Sprintf("%s plus %v", base, op.Offset)
+	case ArgumentListOperand:
+		return fmt.Sprintf("the list in argument %d of %s", op.ArgIndex, nthQuery(op.QueryIndex))
+	case ColumnListOperand:
+		return fmt.Sprintf("column %d of all the rows of %s's result", op.ColumnIndex, nthQuery(op.QueryIndex))
+	case Operand:
+		return op.ToString()
+	case Operation:
+		return op.ToString()
+	}
+	return fmt.Sprintf("%v", term)
+}
+
+// operationStrings returns the string representations of the operations.
+func operationStrings(operations []Operation) []string {
+	strs := make([]string, len(operations))
+	for i, operation := range operations {
+		strs[i] = operation.ToString()
+	}
+	return strs
+}
+
+// Explain returns the explanation of a candidate returned by PredictNext
+// or PredictTopK since the current query.
+func (pt *Predictor) Explain(candidate *Candidate) *Explanation {
+	node := candidate.node
+	prediction := node.Payload.(*Prediction)
+	parent := node.Parent
+	explanation := &Explanation{QueryID: candidate.Query.QueryID, SQL: fillTemplate(candidate.Query.QueryID, pt.manager, candidate.Query.Arguments),
+		Probability: candidate.Probability, Unsafe: candidate.Unsafe, Arguments: []*ArgumentExplanation{}, Alternatives: []*Alternative{}}
+	if node == pt.currentNode && (pt.inLoop() || pt.inGroup()) {
+		// The candidate continues the current step, so there was no alternative.
+		parent = nil
+	}
+	if prediction.IsGroup() {
+		prediction = prediction.member(candidate.Query.QueryID)
+		explanation.IsGroupMember = true
+	}
+	explanation.Trials = prediction.Trials
+	explanation.HitCount = prediction.HitCount
+	explanation.SpeculationHits = prediction.SpeculationHits
+	explanation.SpeculationMisses = prediction.SpeculationMisses
+	explanation.IsLoop = prediction.IsLoop
+	for i, operation := range prediction.ParamOps {
+		var value interface{}
+		if i < len(candidate.Query.Arguments) {
+			value = candidate.Query.Arguments[i]
+		}
+		explanation.Arguments = append(explanation.Arguments, &ArgumentExplanation{operation.ToString(), describe(operation), value})
+	}
+	if parent == nil {
+		return explanation
+	}
+	if decision := parent.Payload.(*Prediction).Decision; decision != nil {
+		explanation.Decision = decision.ToString()
+	}
+	probabilities := nextQueryProbabilities(parent, pt.currentTrx)
+	for _, sibling := range parent.Children {
+		if sibling == node {
+			continue
+		}
+		alternative := sibling.Payload.(*Prediction)
+		probability := probabilities[alternative.QueryID] * alternative.Confidence()
+		explanation.Alternatives = append(explanation.Alternatives, &Alternative{alternative.QueryID, probability,
+			alternative.HitCount, alternative.IsRandom, operationStrings(alternative.ParamOps)})
+	}
+	return explanation
+}
+
+// PredictNextExplained returns the same query as PredictNextQuery,
+// together with its explanation, or nil for both.
+func (pt *Predictor) PredictNextExplained() (*Query, *Explanation) {
+	candidate := pt.predictNextCandidate()
+	if candidate == nil {
+		return nil, nil
+	}
+	return candidate.Query, pt.Explain(candidate)
+}
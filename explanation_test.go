@@ -0,0 +1,63 @@
+package speculative
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestOrdinal(t *testing.T) {
+	for num, expected := range map[int]string{1: "1st", 2: "2nd", 3: "3rd", 4: "4th", 11: "11th", 12: "12th", 22: "22nd", 101: "101st"} {
+		if actual := ordinal(num); actual != expected {
+			t.Fatalf("Expecting %s, got %s", expected, actual)
+		}
+	}
+}
+
+func TestPredictNextExplained(t *testing.T) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		if i < 7 {
+			return []traceQuery{userQuery(i, i+100), storiesQuery(i + 100)}
+		}
+		return []traceQuery{userQuery(i, i+100), {fmt.Sprintf("SELECT * FROM comments WHERE user_id = %d", i+100), "[]"}}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	for _, cluster := range modelBuilder.Clusters {
+		modelBuilder.UpdateModel(cluster, pt)
+	}
+	users := NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM users WHERE id = 42","results":[[142]]}`)
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	predictor.MoveToNext(users)
+	query, explanation := predictor.PredictNextExplained()
+	if query == nil || explanation == nil || explanation.QueryID != query.QueryID {
+		t.Fatalf("Expecting a prediction with its explanation")
+	}
+	if explanation.HitCount != 7 || explanation.Trials != 7 {
+		t.Fatalf("Expecting the node to be hit 7/7 times, got %d/%d", explanation.HitCount, explanation.Trials)
+	}
+	if len(explanation.Arguments) != 1 || !valueEqual(explanation.Arguments[0].Value, query.Arguments[0]) ||
+		explanation.Arguments[0].Description != "column 0 of row 0 of the 1st query's result" {
+		t.Fatalf("Unexpected arguments %+v", explanation.Arguments[0])
+	}
+	if len(explanation.Alternatives) != 1 || explanation.Alternatives[0].HitCount != 3 {
+		t.Fatalf("Expecting the comments node as the alternative, got %+v", explanation.Alternatives)
+	}
+	if !strings.Contains(explanation.ToString(), "argument 0 = 142: column 0 of row 0 of the 1st query's result") {
+		t.Fatalf("Unexpected text %s", explanation.ToString())
+	}
+	encoded, err := json.Marshal(explanation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Explanation
+	if err := json.Unmarshal(encoded, &decoded); err != nil || decoded.Arguments[0].Description != explanation.Arguments[0].Description {
+		t.Fatalf("Expecting the explanation to survive JSON, got %s", encoded)
+	}
+
+	predictor.MoveToNext(NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"COMMIT","results":{}}`))
+	if query, explanation := predictor.PredictNextExplained(); query != nil || explanation != nil {
+		t.Fatalf("Expecting nothing to explain outside of a transaction")
+	}
+}
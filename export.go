@@ -0,0 +1,246 @@
+package speculative
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ExportOptions tells which nodes of the prediction trees to export.
+// A zero value exports every node. Roots are always exported.
+type ExportOptions struct {
+	// MaxDepth is the depth of the deepest nodes exported,
+	// roots being at depth 0. Zero means no limit.
+	MaxDepth int
+	// MinHits is the hit count a node must have to be exported.
+	MinHits int
+	// Cluster, if not nil, limits the nodes to the ones matched
+	// by its transactions, e.g., one of ModelBuilder.Clusters.
+	Cluster [][]*Query
+}
+
+// TreeExporter exports prediction trees in DOT or JSON, labeling the
+// nodes with the templates of the query manager.
+type TreeExporter struct {
+	manager QueryManager
+	builder *ModelBuilder
+	options ExportOptions
+}
+
+// NewTreeExporter creates an exporter for the trees whose queries are
+// in the manager, e.g., a loaded model. The builder folds the loops and
+// groups of the transactions of options.Cluster like the trees were
+// built, and can be nil if there is no cluster.
+func NewTreeExporter(manager QueryManager, builder *ModelBuilder, options ExportOptions) *TreeExporter {
+	return &TreeExporter{manager, builder, options}
+}
+
+// exportedNode is how a node is exported to JSON.
+type exportedNode struct {
+	QueryID    int             `json:"queryID"`
+	Template   string          `json:"template"`
+	Operations []string        `json:"operations"`
+	HitCount   int             `json:"hitCount"`
+	IsRandom   bool            `json:"isRandom,omitempty"`
+	IsLoop     bool            `json:"isLoop,omitempty"`
+	Members    []*exportedNode `json:"members,omitempty"`
+	Decision   string          `json:"decision,omitempty"`
+	Children   []*exportedNode `json:"children,omitempty"`
+}
+
+// matchedNodes returns the nodes of the trees matched by the
+// transactions of the cluster, or nil if there is no cluster.
+func (exporter *TreeExporter) matchedNodes(pt *PredictionTrees) (map[*Node]bool, error) {
+	if exporter.options.Cluster == nil {
+		return nil, nil
+	}
+	if exporter.builder == nil {
+		return nil, fmt.Errorf("exporting a cluster needs the builder of the model")
+	}
+	matched := make(map[*Node]bool)
+	for _, trx := range exporter.builder.foldTransactions(exporter.options.Cluster) {
+		root, ok := pt.trees[trx[0].QueryID]
+		if !ok {
+			continue
+		}
+		matched[root] = true
+		level := []*Node{root}
+		for i := 1; i < len(trx) && len(level) > 0; i++ {
+			nextLevel := []*Node{}
+			for _, node := range level {
+				for _, child := range node.Children {
+					prediction := child.Payload.(*Prediction)
+					if prediction.QueryID == trx[i].QueryID && prediction.FollowsStep(trx, i, exporter.builder.Options.FloatTolerance) {
+						matched[child] = true
+						nextLevel = append(nextLevel, child)
+					}
+				}
+			}
+			level = nextLevel
+		}
+	}
+	return matched, nil
+}
+
+// exportedChildren returns the children of the node at the given depth to export.
+func (exporter *TreeExporter) exportedChildren(node *Node, depth int, matched map[*Node]bool) []*Node {
+	children := []*Node{}
+	if exporter.options.MaxDepth > 0 && depth >= exporter.options.MaxDepth {
+		return children
+	}
+	for _, child := range node.Children {
+		if child.Payload.(*Prediction).HitCount >= exporter.options.MinHits && (matched == nil || matched[child]) {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// exportedRoots returns the roots of the trees to export.
+func (exporter *TreeExporter) exportedRoots(pt *PredictionTrees, matched map[*Node]bool) []*Node {
+	roots := []*Node{}
+	for _, root := range pt.roots() {
+		if matched == nil || matched[root] {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+func (exporter *TreeExporter) exportNode(node *Node, depth int, matched map[*Node]bool) *exportedNode {
+	exported := exporter.exportPrediction(node.Payload.(*Prediction))
+	for _, child := range exporter.exportedChildren(node, depth, matched) {
+		exported.Children = append(exported.Children, exporter.exportNode(child, depth+1, matched))
+	}
+	return exported
+}
+
+func (exporter *TreeExporter) exportPrediction(prediction *Prediction) *exportedNode {
+	exported := &exportedNode{prediction.QueryID, exporter.manager.GetTemplate(prediction.QueryID),
+		operationStrings(prediction.ParamOps), prediction.HitCount, prediction.IsRandom, prediction.IsLoop, nil, "", nil}
+	for _, member := range prediction.Members {
+		exported.Members = append(exported.Members, exporter.exportPrediction(member))
+	}
+	if prediction.Decision != nil {
+		exported.Decision = prediction.Decision.ToString()
+	}
+	return exported
+}
+
+// WriteJSON writes all the trees as a JSON array, sorted by root query ID.
+func (exporter *TreeExporter) WriteJSON(writer io.Writer, pt *PredictionTrees) error {
+	matched, err := exporter.matchedNodes(pt)
+	if err != nil {
+		return err
+	}
+	trees := []*exportedNode{}
+	for _, root := range exporter.exportedRoots(pt, matched) {
+		trees = append(trees, exporter.exportNode(root, 0, matched))
+	}
+	return json.NewEncoder(writer).Encode(trees)
+}
+
+// WriteTreeJSON writes the tree with the given root as a JSON object.
+func (exporter *TreeExporter) WriteTreeJSON(writer io.Writer, pt *PredictionTrees, rootQueryID int) error {
+	root, ok := pt.trees[rootQueryID]
+	if !ok {
+		return fmt.Errorf("no tree with root query %d", rootQueryID)
+	}
+	matched, err := exporter.matchedNodes(pt)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(writer).Encode(exporter.exportNode(root, 0, matched))
+}
+
+// dotEscape escapes a string to be put in a quoted DOT label.
+func dotEscape(str string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(str)
+}
+
+// dotLabel returns the lines of the label of a prediction in DOT.
+func (exporter *TreeExporter) dotLabel(prediction *Prediction) []string {
+	flags := ""
+	if prediction.IsRandom {
+		flags += " random"
+	}
+	if prediction.IsLoop {
+		flags += " loop"
+	}
+	lines := []string{exporter.manager.GetTemplate(prediction.QueryID),
+		fmt.Sprintf("query %d, %d hits%s", prediction.QueryID, prediction.HitCount, flags)}
+	for i, operation := range prediction.ParamOps {
+		lines = append(lines, fmt.Sprintf("arg %d: %s", i, operation.ToString()))
+	}
+	for _, member := range prediction.Members {
+		for _, line := range exporter.dotLabel(member) {
+			lines = append(lines, "  "+line)
+		}
+	}
+	if prediction.Decision != nil {
+		lines = append(lines, "decision: "+prediction.Decision.ToString())
+	}
+	return lines
+}
+
+// writeDOTNodes writes the statements of the node and its exported
+// descendants, numbering the nodes from next, and returns the next number.
+func (exporter *TreeExporter) writeDOTNodes(writer io.Writer, node *Node, depth int, matched map[*Node]bool, next int) (int, error) {
+	id := next
+	next++
+	label := ""
+	for _, line := range exporter.dotLabel(node.Payload.(*Prediction)) {
+		label += dotEscape(line) + `\l`
+	}
+	if _, err := fmt.Fprintf(writer, "  n%d [label=\"%s\"];\n", id, label); err != nil {
+		return next, err
+	}
+	for _, child := range exporter.exportedChildren(node, depth, matched) {
+		if _, err := fmt.Fprintf(writer, "  n%d -> n%d;\n", id, next); err != nil {
+			return next, err
+		}
+		var err error
+		if next, err = exporter.writeDOTNodes(writer, child, depth+1, matched, next); err != nil {
+			return next, err
+		}
+	}
+	return next, nil
+}
+
+func (exporter *TreeExporter) writeDOT(writer io.Writer, roots []*Node, matched map[*Node]bool) error {
+	if _, err := io.WriteString(writer, "digraph predictions {\n  node [shape=box, fontname=monospace];\n"); err != nil {
+		return err
+	}
+	next := 0
+	for _, root := range roots {
+		var err error
+		if next, err = exporter.writeDOTNodes(writer, root, 0, matched, next); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(writer, "}\n")
+	return err
+}
+
+// WriteDOT writes all the trees as a DOT graph.
+func (exporter *TreeExporter) WriteDOT(writer io.Writer, pt *PredictionTrees) error {
+	matched, err := exporter.matchedNodes(pt)
+	if err != nil {
+		return err
+	}
+	return exporter.writeDOT(writer, exporter.exportedRoots(pt, matched), matched)
+}
+
+// WriteTreeDOT writes the tree with the given root as a DOT graph.
+func (exporter *TreeExporter) WriteTreeDOT(writer io.Writer, pt *PredictionTrees, rootQueryID int) error {
+	root, ok := pt.trees[rootQueryID]
+	if !ok {
+		return fmt.Errorf("no tree with root query %d", rootQueryID)
+	}
+	matched, err := exporter.matchedNodes(pt)
+	if err != nil {
+		return err
+	}
+	return exporter.writeDOT(writer, []*Node{root}, matched)
+}
@@ -0,0 +1,86 @@
+package speculative
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func exportTestBuilder() (*ModelBuilder, *PredictionTrees) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		users := traceQuery{fmt.Sprintf(`SELECT * FROM users WHERE name = 'u%d' AND kind = "user"`, i), fmt.Sprintf("[[%d]]", i+100)}
+		if i < 7 {
+			return []traceQuery{users, storiesQuery(i + 100)}
+		}
+		return []traceQuery{users, {fmt.Sprintf("SELECT * FROM comments WHERE user_id = %d", i+100), "[]"}}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	for _, cluster := range modelBuilder.Clusters {
+		modelBuilder.UpdateModel(cluster, pt)
+	}
+	return modelBuilder, pt
+}
+
+func exportedQueryIDs(t *testing.T, exporter *TreeExporter, pt *PredictionTrees) []int {
+	var buffer bytes.Buffer
+	if err := exporter.WriteJSON(&buffer, pt); err != nil {
+		t.Fatal(err)
+	}
+	var trees []*exportedNode
+	if err := json.Unmarshal(buffer.Bytes(), &trees); err != nil {
+		t.Fatal(err)
+	}
+	queryIDs := []int{}
+	for _, tree := range trees {
+		queryIDs = append(queryIDs, tree.QueryID)
+		for _, child := range tree.Children {
+			queryIDs = append(queryIDs, child.QueryID)
+		}
+	}
+	return queryIDs
+}
+
+func TestExportFilters(t *testing.T) {
+	modelBuilder, pt := exportTestBuilder()
+	users := modelBuilder.Clusters[0][0][0].QueryID
+	if queryIDs := exportedQueryIDs(t, NewTreeExporter(modelBuilder.QuerySet, modelBuilder, ExportOptions{}), pt); len(queryIDs) != 3 {
+		t.Fatalf("Expecting the root and its 2 children, got %v", queryIDs)
+	}
+	if queryIDs := exportedQueryIDs(t, NewTreeExporter(modelBuilder.QuerySet, modelBuilder, ExportOptions{MaxDepth: 1, MinHits: 4}), pt); len(queryIDs) != 2 || queryIDs[0] != users {
+		t.Fatalf("Expecting the root and its most hit child, got %v", queryIDs)
+	}
+	for _, cluster := range modelBuilder.Clusters {
+		queryIDs := exportedQueryIDs(t, NewTreeExporter(modelBuilder.QuerySet, modelBuilder, ExportOptions{Cluster: cluster}), pt)
+		if len(queryIDs) != 2 || queryIDs[1] != cluster[0][1].QueryID {
+			t.Fatalf("Expecting only the nodes of the cluster, got %v", queryIDs)
+		}
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	modelBuilder, pt := exportTestBuilder()
+	var buffer bytes.Buffer
+	if err := NewTreeExporter(modelBuilder.QuerySet, modelBuilder, ExportOptions{}).WriteDOT(&buffer, pt); err != nil {
+		t.Fatal(err)
+	}
+	dot := buffer.String()
+	if !strings.HasPrefix(dot, "digraph") || strings.Count(dot, "->") != 2 || !strings.Contains(dot, `kind = \"user\"`) {
+		t.Fatalf("Unexpected DOT %s", dot)
+	}
+	users := modelBuilder.Clusters[0][0][0].QueryID
+	buffer.Reset()
+	if err := NewTreeExporter(modelBuilder.QuerySet, modelBuilder, ExportOptions{}).WriteTreeDOT(&buffer, pt, users+100); err == nil {
+		t.Fatalf("Expecting an error for a missing tree")
+	}
+	buffer.Reset()
+	if err := NewTreeExporter(modelBuilder.QuerySet, nil, ExportOptions{}).WriteDOT(&buffer, pt); err != nil || buffer.String() != dot {
+		t.Fatalf("Expecting the same DOT without the builder, got %v", err)
+	}
+	cluster := ExportOptions{Cluster: modelBuilder.Clusters[0]}
+	if err := NewTreeExporter(modelBuilder.QuerySet, nil, cluster).WriteDOT(&buffer, pt); err == nil {
+		t.Fatalf("Expecting an error for a cluster without the builder")
+	}
+}
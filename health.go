@@ -0,0 +1,258 @@
+package speculative
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// HealthOptions tells how much history the health monitor keeps,
+// and when it flags a tree as drifted.
+type HealthOptions struct {
+	// Window is the number of the latest outcomes kept per tree,
+	// and NodeWindow the number kept per node.
+	Window     int
+	NodeWindow int
+	// MinSamples is the number of outcomes a tree needs to be flagged.
+	MinSamples int
+	// MinDrop is how far below its baseline the hit rate
+	// of a tree must fall to be flagged.
+	MinDrop float64
+	// MinZScore is how significant the drop must be, in standard
+	// deviations of the hit rate of as many outcomes at the baseline.
+	MinZScore float64
+}
+
+// DefaultHealthOptions returns the default options.
+func DefaultHealthOptions() HealthOptions {
+	return HealthOptions{1000, 100, 100, 0.1, 3}
+}
+
+// rollingWindow keeps the latest outcomes, hits or misses.
+type rollingWindow struct {
+	outcomes []bool
+	next     int
+	hits     int
+}
+
+func newRollingWindow(size int) *rollingWindow {
+	return &rollingWindow{make([]bool, 0, size), 0, 0}
+}
+
+// add adds an outcome, evicting the oldest one if the window is full.
+func (window *rollingWindow) add(hit bool) {
+	if cap(window.outcomes) == 0 {
+		return
+	}
+	if len(window.outcomes) < cap(window.outcomes) {
+		window.outcomes = append(window.outcomes, hit)
+	} else {
+		if window.outcomes[window.next] {
+			window.hits--
+		}
+		window.outcomes[window.next] = hit
+		window.next = (window.next + 1) % len(window.outcomes)
+	}
+	if hit {
+		window.hits++
+	}
+}
+
+func (window *rollingWindow) health() Health {
+	if window == nil {
+		return Health{}
+	}
+	return Health{window.hits, len(window.outcomes)}
+}
+
+// Health counts the hits among the latest predictions.
+type Health struct {
+	Hits  int
+	Total int
+}
+
+// HitRate returns the fraction of the predictions that were hits.
+func (health Health) HitRate() float64 {
+	if health.Total == 0 {
+		return 0
+	}
+	return float64(health.Hits) / float64(health.Total)
+}
+
+// TreeHealth tells how a tree, i.e., a transaction type,
+// is predicted lately compared to its baseline.
+type TreeHealth struct {
+	RootQueryID int
+	Rolling     Health
+	// Baseline is the hit rate at training time, or -1 if unknown.
+	Baseline float64
+	ZScore   float64
+	Drifted  bool
+	Disabled bool
+}
+
+// HealthMonitor keeps the outcomes of the predictions made by the
+// predictors it is set on, per tree and per node, and detects the trees
+// whose hit rate dropped against their baseline. Speculation can be
+// disabled per tree. It is safe to share between predictors.
+type HealthMonitor struct {
+	mutex     sync.Mutex
+	options   HealthOptions
+	baselines map[int]float64
+	trees     map[int]*rollingWindow
+	nodes     map[*Node]*nodeWindow
+	// version is the latest version of a shared model whose nodes were
+	// recorded. The nodes of the earlier versions are dropped.
+	version  uint64
+	disabled map[int]bool
+}
+
+// nodeWindow keeps the latest outcomes of a node,
+// and the root query ID of the tree of the node.
+type nodeWindow struct {
+	rootQueryID int
+	window      *rollingWindow
+}
+
+// NewHealthMonitor creates a health monitor. baselines maps the root
+// query ID of each tree to its hit rate at training time, e.g., from
+// EvaluationResult.Baselines. Trees without a baseline are never flagged.
+func NewHealthMonitor(baselines map[int]float64, options HealthOptions) *HealthMonitor {
+	return &HealthMonitor{sync.Mutex{}, options, baselines, make(map[int]*rollingWindow),
+		make(map[*Node]*nodeWindow), 0, make(map[int]bool)}
+}
+
+// record records the outcome of a prediction made in a transaction
+// of the tree with the given root, at the given node if not nil. version
+// is the version of the shared model the node belongs to, or 0 if the
+// predictor is not shared. A shared model publishes copies of its nodes,
+// so the nodes of the earlier versions are dropped once a later one is
+// recorded, and the outcomes at them are no longer recorded.
+func (monitor *HealthMonitor) record(rootQueryID int, node *Node, version uint64, hit bool) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	if monitor.trees[rootQueryID] == nil {
+		monitor.trees[rootQueryID] = newRollingWindow(monitor.options.Window)
+	}
+	monitor.trees[rootQueryID].add(hit)
+	if node == nil || version < monitor.version {
+		return
+	}
+	if version > monitor.version {
+		monitor.version = version
+		monitor.nodes = make(map[*Node]*nodeWindow)
+	}
+	if monitor.nodes[node] == nil {
+		monitor.nodes[node] = &nodeWindow{rootQueryID, newRollingWindow(monitor.options.NodeWindow)}
+	}
+	monitor.nodes[node].window.add(hit)
+}
+
+// NodeHealth returns the health of the predictions made at the node.
+func (monitor *HealthMonitor) NodeHealth(node *Node) Health {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	if window := monitor.nodes[node]; window != nil {
+		return window.window.health()
+	}
+	return Health{}
+}
+
+// TreeHealth returns the health of the tree with the given root.
+func (monitor *HealthMonitor) TreeHealth(rootQueryID int) TreeHealth {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	return monitor.treeHealth(rootQueryID)
+}
+
+func (monitor *HealthMonitor) treeHealth(rootQueryID int) TreeHealth {
+	health := TreeHealth{RootQueryID: rootQueryID, Rolling: monitor.trees[rootQueryID].health(), Baseline: -1,
+		Disabled: monitor.disabled[rootQueryID]}
+	baseline, ok := monitor.baselines[rootQueryID]
+	if !ok {
+		return health
+	}
+	health.Baseline = baseline
+	drop := baseline - health.Rolling.HitRate()
+	if health.Rolling.Total == 0 || drop <= 0 {
+		return health
+	}
+	if deviation := math.Sqrt(baseline * (1 - baseline) / float64(health.Rolling.Total)); deviation > 0 {
+		health.ZScore = drop / deviation
+	} else {
+		health.ZScore = math.Inf(1)
+	}
+	health.Drifted = health.Rolling.Total >= monitor.options.MinSamples && drop >= monitor.options.MinDrop &&
+		health.ZScore >= monitor.options.MinZScore
+	return health
+}
+
+// Trees returns the health of every tree predicted so far, sorted by root query ID.
+func (monitor *HealthMonitor) Trees() []TreeHealth {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	rootQueryIDs := make([]int, 0, len(monitor.trees))
+	for rootQueryID := range monitor.trees {
+		rootQueryIDs = append(rootQueryIDs, rootQueryID)
+	}
+	sort.Ints(rootQueryIDs)
+	trees := make([]TreeHealth, len(rootQueryIDs))
+	for i, rootQueryID := range rootQueryIDs {
+		trees[i] = monitor.treeHealth(rootQueryID)
+	}
+	return trees
+}
+
+// DriftedTrees returns the health of the trees that drifted.
+func (monitor *HealthMonitor) DriftedTrees() []TreeHealth {
+	drifted := []TreeHealth{}
+	for _, health := range monitor.Trees() {
+		if health.Drifted {
+			drifted = append(drifted, health)
+		}
+	}
+	return drifted
+}
+
+// Disable disables the speculation in the transactions of the tree
+// with the given root. Predictors predict nothing for them.
+func (monitor *HealthMonitor) Disable(rootQueryID int) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	monitor.disabled[rootQueryID] = true
+}
+
+// Enable enables the speculation for the tree with the given root again,
+// and forgets its outcomes and the ones of its nodes, which are about
+// the model before.
+func (monitor *HealthMonitor) Enable(rootQueryID int) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	delete(monitor.disabled, rootQueryID)
+	delete(monitor.trees, rootQueryID)
+	for node, window := range monitor.nodes {
+		if window.rootQueryID == rootQueryID {
+			delete(monitor.nodes, node)
+		}
+	}
+}
+
+// IsDisabled returns true if the speculation is disabled for the tree.
+func (monitor *HealthMonitor) IsDisabled(rootQueryID int) bool {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	return monitor.disabled[rootQueryID]
+}
+
+// SetHealthMonitor makes the predictor report to the monitor whether
+// each query predicted by PredictNextQuery turned out to be issued, and
+// predict nothing in the transactions of the trees it has disabled.
+func (pt *Predictor) SetHealthMonitor(monitor *HealthMonitor) {
+	pt.monitor = monitor
+}
+
+// speculationDisabled returns true if the monitor disabled
+// the speculation for the tree of the current transaction.
+func (pt *Predictor) speculationDisabled() bool {
+	return pt.monitor != nil && len(pt.currentTrx) > 0 && pt.monitor.IsDisabled(pt.currentTrx[0].QueryID)
+}
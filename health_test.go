@@ -0,0 +1,100 @@
+package speculative
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestRollingWindow(t *testing.T) {
+	window := newRollingWindow(3)
+	for _, hit := range []bool{true, true, false, false} {
+		window.add(hit)
+	}
+	if health := window.health(); health.Hits != 1 || health.Total != 3 {
+		t.Fatalf("Expecting 1 hit out of the last 3 outcomes, got %d/%d", health.Hits, health.Total)
+	}
+}
+
+func TestDriftDetection(t *testing.T) {
+	trace := testTrace(20, func(i int) []traceQuery {
+		// The stories of the last 10 transactions no longer belong to the user.
+		userID := i
+		if i >= 10 {
+			userID = i + 1
+		}
+		return []traceQuery{userQuery(i, i),
+			{fmt.Sprintf("SELECT * FROM stories WHERE user_id = %d", userID), fmt.Sprintf("[[%d]]", i+100)},
+			{fmt.Sprintf("SELECT * FROM comments WHERE story_id = %d", i+100), "[]"}}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Transactions[:10], pt)
+	rootQueryID := modelBuilder.Transactions[0][0].QueryID
+	monitor := NewHealthMonitor(map[int]float64{rootQueryID: 1}, HealthOptions{20, 10, 10, 0.1, 3})
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	predictor.SetHealthMonitor(monitor)
+	for _, trx := range modelBuilder.Transactions[10:15] {
+		for position, query := range trx {
+			if position > 0 {
+				predictor.PredictNextQuery()
+			}
+			predictor.MoveToNext(query)
+		}
+		predictor.EndTransaction()
+	}
+	health := monitor.TreeHealth(rootQueryID)
+	// Once the stories are missed, the transactions leave the tree and the comments cannot be predicted.
+	if health.Rolling.Hits != 0 || health.Rolling.Total != 10 || !math.IsInf(health.ZScore, 1) {
+		t.Fatalf("Expecting every query to be missed, got %d/%d", health.Rolling.Hits, health.Rolling.Total)
+	}
+	drifted := monitor.DriftedTrees()
+	if len(drifted) != 1 || drifted[0].RootQueryID != rootQueryID || drifted[0].Baseline != 1 {
+		t.Fatalf("Expecting the tree to drift")
+	}
+	if nodeHealth := monitor.NodeHealth(pt.trees[rootQueryID]); nodeHealth.Hits != 0 || nodeHealth.Total != 5 {
+		t.Fatalf("Expecting the stories predicted at the root to be missed, got %d/%d", nodeHealth.Hits, nodeHealth.Total)
+	}
+
+	monitor.Disable(rootQueryID)
+	predictor.MoveToNext(modelBuilder.Transactions[15][0])
+	if query := predictor.PredictNextQuery(); query != nil || len(predictor.PredictTopK(3)) > 0 || len(predictor.PredictAhead(2)) > 0 {
+		t.Fatalf("Expecting nothing to be predicted for a disabled tree")
+	}
+	predictor.MoveToNext(modelBuilder.Transactions[15][1])
+	predictor.EndTransaction()
+	if health := monitor.TreeHealth(rootQueryID); !health.Disabled || health.Rolling.Total != 10 {
+		t.Fatalf("Expecting no outcome to be recorded while disabled")
+	}
+	monitor.Enable(rootQueryID)
+	if len(monitor.DriftedTrees()) != 0 || monitor.NodeHealth(pt.trees[rootQueryID]).Total != 0 {
+		t.Fatalf("Expecting the outcomes to be forgotten once enabled")
+	}
+}
+
+func TestNodeHealthAcrossVersions(t *testing.T) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		return []traceQuery{userQuery(i, i), storiesQuery(i)}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Transactions[:8], pt)
+	model := NewSharedModel(pt)
+	monitor := NewHealthMonitor(nil, DefaultHealthOptions())
+	predictor := model.NewPredictor(modelBuilder.QuerySet)
+	predictor.SetHealthMonitor(monitor)
+	for _, trx := range modelBuilder.Transactions[8:] {
+		for position, query := range trx {
+			if position > 0 {
+				predictor.PredictNextQuery()
+			}
+			predictor.MoveToNext(query)
+		}
+		predictor.EndTransaction()
+		model.Update(nil)
+	}
+	// The root predicted at in the first version is dropped once the second one is predicted at.
+	if len(monitor.nodes) != 1 {
+		t.Fatalf("Expecting only the root of the version predicted last to be kept, got %d nodes", len(monitor.nodes))
+	}
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"sort"
-	"strconv"
+	"strings"
 
 	"bufio"
 
 	"os"
+	"runtime"
+	"time"
 
 	sqp "github.com/sensssz/speculative"
 	sp "github.com/sensssz/spinner"
@@ -27,128 +30,180 @@ func queriesToString(queries []*sqp.Query) string {
 	return res
 }
 
-type Pair struct {
-	ClusterID int
-	Frequency int
-	Matches   int
-	Total     int
+// sameTemplates returns true if the two query sets give
+// the same IDs to the same templates.
+func sameTemplates(querySet1 *sqp.QuerySet, querySet2 *sqp.QuerySet) bool {
+	if len(querySet1.IDToTemplate) != len(querySet2.IDToTemplate) {
+		return false
+	}
+	for queryID, template := range querySet1.IDToTemplate {
+		if querySet2.IDToTemplate[queryID] != template {
+			return false
+		}
+	}
+	return true
+}
+
+func newSplitStrategy(name string, fraction float64, seed int64, k int) (sqp.SplitStrategy, error) {
+	var strategy sqp.SplitStrategy
+	switch name {
+	case "prefix":
+		strategy = sqp.PrefixSplit{TrainingFraction: fraction}
+	case "random":
+		strategy = sqp.RandomSplit{TrainingFraction: fraction, Seed: seed}
+	case "time":
+		strategy = sqp.TimeSplit{TrainingFraction: fraction}
+	case "kfold":
+		strategy = sqp.KFoldSplit{K: k}
+	default:
+		return nil, fmt.Errorf("unknown split strategy %q", name)
+	}
+	return strategy, strategy.Validate()
+}
+
+// hasTimes returns true if any of the queries has a time.
+func hasTimes(queries []*sqp.Query) bool {
+	for _, query := range queries {
+		if !query.Time.IsZero() {
+			return true
+		}
+	}
+	return false
 }
-type PairList []Pair
 
-func (p PairList) Len() int           { return len(p) }
-func (p PairList) Less(i, j int) bool { return p[i].Frequency < p[j].Frequency }
-func (p PairList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func exportModel(path string, exporter *sqp.TreeExporter, pt *sqp.PredictionTrees) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	if strings.HasSuffix(path, ".json") {
+		err = exporter.WriteJSON(writer, pt)
+	} else {
+		err = exporter.WriteDOT(writer, pt)
+	}
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
 
 func main() {
-	postfix := ".lobsters"
-	modelBuilder := sqp.NewModelBuilder("/home/jiamin/sql_log/sql" + postfix)
-	var total int64
-	var totalSelect int64
-	var match int64
-	var numTrx int64
-	var wrongPrediction int64
-	var unpredictale int64
-	total = 0
-	totalSelect = 0
-	match = 0
-	wrongPrediction = 0
-	unpredictale = 0
-	pt := sqp.NewPredictionTrees()
-	spinner := sp.NewSpinnerWithProgress(19, "Creating model for cluster %d", -1)
+	tracePath := flag.String("trace", "", "path of the SQL trace")
+	postfix := flag.String("postfix", "", "postfix of the model and report files")
+	splitName := flag.String("split", "prefix", "split strategy: prefix, random, time or kfold")
+	fraction := flag.Float64("fraction", 0.3, "fraction of each cluster used for training")
+	seed := flag.Int64("seed", 1, "seed of the random split")
+	k := flag.Int("k", 5, "number of folds of the k-fold split")
+	minLength := flag.Int("min-length", 10, "skip the clusters whose transactions are shorter than this")
+	numClustersToWrite := flag.Int("write-clusters", 0, "number of the largest clusters to write out")
+	exportPath := flag.String("export", "", "export the model to this file, in JSON if it ends with .json, in DOT otherwise")
+	var exportOptions sqp.ExportOptions
+	flag.IntVar(&exportOptions.MaxDepth, "export-depth", 0, "depth of the deepest nodes exported")
+	flag.IntVar(&exportOptions.MinHits, "export-min-hits", 0, "hit count of the nodes exported")
+	exportCluster := flag.Int("export-cluster", -1, "only export the nodes of this cluster")
+	options := sqp.DefaultModelBuilderOptions()
+	flag.IntVar(&options.LookBack, "look-back", options.LookBack, "number of the last queries searched for operands")
+	flag.IntVar(&options.DecisionLookBack, "decision-look-back", options.DecisionLookBack, "number of the last queries whose results decide the next query")
+	flag.IntVar(&options.SampleSize, "sample", options.SampleSize, "number of transactions predictions are enumerated from")
+	flag.IntVar(&options.MaxLevelNodes, "max-level-nodes", options.MaxLevelNodes, "cap on the nodes of a tree level while training")
+	flag.Float64Var(&options.FloatTolerance, "tolerance", options.FloatTolerance, "tolerance of affine operands")
+	flag.BoolVar(&options.ClusterSingle, "cluster-single", options.ClusterSingle, "view consecutive single query transactions as one")
+	flag.Float64Var(&options.Pruning.MinHitRatio, "min-hit-ratio", 0, "prune the nodes hit less than this ratio")
+	flag.IntVar(&options.Pruning.MaxChildren, "max-children", 0, "cap on the children of a node")
+	flag.IntVar(&options.Pruning.MaxNodes, "max-nodes", 0, "cap on the nodes of the model")
+	flag.Parse()
+	if *tracePath == "" {
+		fmt.Fprintln(os.Stderr, "missing -trace")
+		os.Exit(2)
+	}
+	strategy, err := newSplitStrategy(*splitName, *fraction, *seed, *k)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	modelBuilder := sqp.NewModelBuilder(*tracePath, options)
+	if *splitName == "time" && !hasTimes(modelBuilder.Queries) {
+		fmt.Fprintln(os.Stderr, "-split time needs the queries of the trace to have a \"time\"")
+		os.Exit(2)
+	}
+	if *exportCluster < -1 || *exportCluster >= len(modelBuilder.Clusters) {
+		fmt.Fprintf(os.Stderr, "-export-cluster %d is out of range, there are %d clusters\n", *exportCluster, len(modelBuilder.Clusters))
+		os.Exit(2)
+	}
+	evaluator := sqp.NewEvaluator(modelBuilder, strategy)
+	evaluator.MinTransactionLength = *minLength
+	evaluator.Workers = runtime.NumCPU()
+	modelPath := "model" + *postfix
+	// A prebuilt model only fits the single fold it was trained on,
+	// so the split must be the same down to the fraction and the seed.
+	if pt, querySet, err := sqp.LoadModel(modelPath); err == nil && len(modelBuilder.Clusters) > 0 &&
+		len(strategy.Split(modelBuilder.Clusters[0])) == 1 && pt.Split == strategy.ToString() &&
+		sameTemplates(querySet, modelBuilder.QuerySet) && pt.Options != nil && *pt.Options == options {
+		evaluator.Prebuilt = pt
+	}
+	spinner := sp.NewSpinnerWithProgress(19, "Evaluating "+strategy.ToString()+" on %d workers...", -1)
 	spinner.Start()
-	for i, cluster := range modelBuilder.Clusters {
-		spinner.UpdateProgress(i)
-		if len(cluster[0]) < 10 {
-			continue
-		}
-		thirtyPercent := int(float64(len(cluster)) * 0.3)
-		if thirtyPercent > 1 {
-			modelBuilder.UpdateModel(cluster[:thirtyPercent], pt)
+	spinner.UpdateProgress(evaluator.Workers)
+	start := time.Now()
+	result := evaluator.Evaluate()
+	spinner.Stop()
+	fmt.Printf("Evaluated in %v\n", time.Since(start))
+	if evaluator.Prebuilt == nil {
+		fmt.Println(modelBuilder.PruneReport.ToString())
+		if err := sqp.SaveModel(modelPath, result.Model, modelBuilder.QuerySet); err != nil {
+			fmt.Println(err)
 		}
 	}
-	spinner.Stop()
-	predictor := pt.NewPredictor(modelBuilder.QuerySet)
-	spinner = sp.NewSpinnerWithProgress(19, "Performaning preduction for cluster %d...", -1)
-	spinner.Start()
-	clustersFile, _ := os.Create("clusters" + postfix)
-	defer clustersFile.Close()
-	clustersWriter := bufio.NewWriter(clustersFile)
-	clusterInfoFile, _ := os.Create("clusterInfo" + postfix)
-	defer clusterInfoFile.Close()
-	fileWriter := bufio.NewWriter(clusterInfoFile)
-	pl := make(PairList, 0, len(modelBuilder.Clusters))
-	for i, cluster := range modelBuilder.Clusters {
-		spinner.UpdateProgress(i)
-		if len(cluster[0]) < 10 {
-			continue
+
+	if *exportPath != "" {
+		if *exportCluster >= 0 {
+			exportOptions.Cluster = modelBuilder.Clusters[*exportCluster]
 		}
-		thirtyPercent := int(float64(len(cluster)) * 0.3)
-		if thirtyPercent <= 1 {
-			continue
+		exporter := sqp.NewTreeExporter(modelBuilder.QuerySet, modelBuilder, exportOptions)
+		if err := exportModel(*exportPath, exporter, result.Model); err != nil {
+			fmt.Println(err)
 		}
-		matchOfTrx := 0
-		totalSelectOfTrx := 0
-		for j, trx := range cluster[thirtyPercent+1:] {
-			if trx[0].IsSelect {
-				totalSelect++
-				if j == 0 {
-					totalSelectOfTrx++
-				}
-			}
-			numTrx++
-			total++
-			predictor.MoveToNext(trx[0])
-			for _, query := range trx[1:] {
-				total++
-				if query.IsSelect {
-					totalSelect++
-					if j == 0 {
-						totalSelectOfTrx++
-					}
-				}
-				// actualSQL := query.GetSQL(modelBuilder.QuerySet)
-				prediction := predictor.PredictNextQuery()
-				if query.Same(prediction) {
-					match++
-					if j == 0 {
-						matchOfTrx++
-					}
-				} else if prediction != nil {
-					wrongPrediction++
-					// predictedSQL := prediction.GetSQL(modelBuilder.QuerySet)
-					// fileWriter.WriteString(fmt.Sprintf("Expecting:\n\t%s\ngot:\n\t%s\n\n", actualSQL, predictedSQL))
-				} else {
-					unpredictale++
-				}
-				predictor.MoveToNext(query)
-			}
-			predictor.EndTransaction()
+	}
+
+	clusterIDs := []int{}
+	for i, metrics := range result.PerCluster {
+		if metrics.Transactions > 0 {
+			clusterIDs = append(clusterIDs, i)
 		}
-		pl = append(pl, Pair{i, len(cluster) - thirtyPercent, matchOfTrx, totalSelectOfTrx})
 	}
-	sort.Sort(sort.Reverse(pl))
+	sort.SliceStable(clusterIDs, func(i, j int) bool {
+		return result.PerCluster[clusterIDs[i]].Transactions > result.PerCluster[clusterIDs[j]].Transactions
+	})
+	clusterInfoFile, _ := os.Create("clusterInfo" + *postfix)
+	defer clusterInfoFile.Close()
+	fileWriter := bufio.NewWriter(clusterInfoFile)
 	predictableClusters := 0
 	totalPredictableTrx := 0
-	for _, pair := range pl {
-		percent := float64(100*pair.Frequency) / float64(numTrx)
-		fileWriter.WriteString(fmt.Sprintf("Cluster %d: %d  %.2f%%  %d/%d\n", pair.ClusterID, pair.Frequency, percent, pair.Matches, pair.Total))
-		if float64(pair.Matches)/float64(pair.Total) >= 0.8 {
+	for _, clusterID := range clusterIDs {
+		metrics := result.PerCluster[clusterID]
+		percent := float64(100*metrics.Transactions) / float64(result.Global.Transactions)
+		fileWriter.WriteString(fmt.Sprintf("Cluster %d: %d  %.2f%%  %d/%d\n", clusterID, metrics.Transactions, percent, metrics.Hits, metrics.Selects))
+		if metrics.SelectHitRate() >= 0.8 {
 			predictableClusters++
-			totalPredictableTrx += len(modelBuilder.Clusters[pair.ClusterID])
+			totalPredictableTrx += len(modelBuilder.Clusters[clusterID])
 		}
-		for _, query := range modelBuilder.Clusters[pair.ClusterID][0] {
+		for _, query := range modelBuilder.Clusters[clusterID][0] {
 			fileWriter.WriteString(query.GetSQL(modelBuilder.QuerySet) + "\n")
 		}
 		fileWriter.WriteString("\n")
 	}
 
-	if len(os.Args) == 2 {
-		numClustersToWrite, _ := strconv.Atoi(os.Args[1])
-		for i, pair := range pl {
-			if i >= numClustersToWrite {
+	if *numClustersToWrite > 0 {
+		clustersFile, _ := os.Create("clusters" + *postfix)
+		defer clustersFile.Close()
+		clustersWriter := bufio.NewWriter(clustersFile)
+		for i, clusterID := range clusterIDs {
+			if i >= *numClustersToWrite {
 				break
 			}
-			for _, trx := range modelBuilder.Clusters[pair.ClusterID] {
+			for _, trx := range modelBuilder.Clusters[clusterID] {
 				clustersWriter.WriteString(`{"sql":"BEGIN","results":{}}` + "\n")
 				for _, query := range trx {
 					sql := query.GetSQL(modelBuilder.QuerySet)
@@ -163,26 +218,25 @@ func main() {
 		}
 		clustersWriter.Flush()
 	}
-	spinner.Stop()
-	fileWriter.WriteString(fmt.Sprintf("Hit count: %v\n", match))
-	fileWriter.WriteString(fmt.Sprintf("Unpredictable: %v\n", unpredictale))
-	fileWriter.WriteString(fmt.Sprintf("Wrong prediction: %v\n", wrongPrediction))
-	fileWriter.WriteString(fmt.Sprintf("Total select: %v\n", totalSelect))
-	fileWriter.WriteString(fmt.Sprintf("Total queries: %v\n", total))
-	fileWriter.WriteString(fmt.Sprintf("Num trx: %d\n", numTrx))
-	fileWriter.WriteString(fmt.Sprintf("Average trx size: %d\n", total/numTrx))
-	fileWriter.WriteString(fmt.Sprintf("Total number of predictable transactions: %d\n", totalPredictableTrx))
-	fileWriter.WriteString(fmt.Sprintf("Total number of transaction types: %d\n", len(modelBuilder.Clusters)))
-	fileWriter.WriteString(fmt.Sprintf("Number of transaction types with more than 80%% predictability: %d\n", predictableClusters))
+
+	summary := fmt.Sprintf("Split: %s, %d folds\n", result.Strategy, result.Folds)
+	summary += fmt.Sprintf("Options: %s\n", result.Options.ToString())
+	summary += fmt.Sprintf("Hit count: %v\n", result.Global.Hits)
+	summary += fmt.Sprintf("Unpredictable: %v\n", result.Global.Unpredictable)
+	summary += fmt.Sprintf("Wrong prediction: %v\n", result.Global.Wrong)
+	summary += fmt.Sprintf("Total select: %v\n", result.Global.Selects)
+	summary += fmt.Sprintf("Total predicted queries: %v\n", result.Global.Queries)
+	summary += fmt.Sprintf("Num trx: %d\n", result.Global.Transactions)
+	summary += fmt.Sprintf("Skipped trx: %d\n", result.SkippedTransactions)
+	summary += fmt.Sprintf("Total number of predictable transactions: %d\n", totalPredictableTrx)
+	summary += fmt.Sprintf("Total number of transaction types: %d\n", len(modelBuilder.Clusters))
+	summary += fmt.Sprintf("Number of transaction types with more than 80%% predictability: %d\n", predictableClusters)
+	for position, metrics := range result.PerPosition {
+		if metrics.Queries > 0 {
+			summary += fmt.Sprintf("Position %d: %.2f%% of %d\n", position, 100*metrics.HitRate(), metrics.Queries)
+		}
+	}
+	fileWriter.WriteString(summary)
 	fileWriter.Flush()
-	fmt.Printf("Hit count: %v\n", match)
-	fmt.Printf("Unpredictable: %v\n", unpredictale)
-	fmt.Printf("Wrong prediction: %v\n", wrongPrediction)
-	fmt.Printf("Total select: %v\n", totalSelect)
-	fmt.Printf("Total queries: %v\n", total)
-	fmt.Printf("Num trx: %d\n", numTrx)
-	fmt.Printf("Average trx size: %d\n", total/numTrx)
-	fmt.Printf("Total number of predictable transactions: %d\n", totalPredictableTrx)
-	fmt.Printf("Total number of transaction types: %d\n", len(modelBuilder.Clusters))
-	fmt.Printf("Number of transaction types with more than 80%% predictability: %d\n", predictableClusters)
+	fmt.Print(summary)
 }
@@ -0,0 +1,319 @@
+package speculative
+
+import (
+	"fmt"
+	"sort"
+)
+
+// idMapping maps the query IDs of a model to the ones of another,
+// and records the IDs it has no mapping for.
+type idMapping struct {
+	ids     map[int]int
+	missing map[int]bool
+}
+
+// remapID returns the ID the query is mapped to, or the same ID if ids
+// is nil. An ID without a mapping is recorded as missing.
+func remapID(ids *idMapping, queryID int) int {
+	if ids == nil {
+		return queryID
+	}
+	mapped, ok := ids.ids[queryID]
+	if !ok {
+		ids.missing[queryID] = true
+	}
+	return mapped
+}
+
+// remapOperand returns a copy of the operand referring to the
+// queries by the IDs they are mapped to.
+func remapOperand(operand Operand, ids *idMapping) Operand {
+	switch op := operand.(type) {
+	case QueryResultOperand:
+		op.QueryID = remapID(ids, op.QueryID)
+		return op
+	case LastRowOperand:
+		op.QueryID = remapID(ids, op.QueryID)
+		return op
+	case KeyedLookupOperand:
+		op.QueryID = remapID(ids, op.QueryID)
+		op.Key = remapOperand(op.Key, ids)
+		return op
+	case IterationOperand:
+		op.QueryID = remapID(ids, op.QueryID)
+		return op
+	case QueryArgumentOperand:
+		op.QueryID = remapID(ids, op.QueryID)
+		return op
+	case AggregationOperand:
+		op.QueryID = remapID(ids, op.QueryID)
+		return op
+	case ArgumentListOperand:
+		op.QueryID = remapID(ids, op.QueryID)
+		return op
+	case ColumnListOperand:
+		op.QueryID = remapID(ids, op.QueryID)
+		return op
+	case FormatOperand:
+		op.First = remapOperand(op.First, ids)
+		if op.Second != nil {
+			op.Second = remapOperand(op.Second, ids)
+		}
+		return op
+	case AffineOperand:
+		op.Operand = remapOperand(op.Operand, ids)
+		return op
+	case TimestampOperand:
+		if op.Operand != nil {
+			op.Operand = remapOperand(op.Operand, ids)
+		}
+		return op
+	}
+	return operand
+}
+
+// remapOperation returns a copy of the operation referring to the
+// queries by the IDs they are mapped to.
+func remapOperation(operation Operation, ids *idMapping) Operation {
+	switch op := operation.(type) {
+	case UnaryOperation:
+		return UnaryOperation{remapOperand(op.Operand, ids)}
+	case BinaryOperation:
+		return BinaryOperation{op.Operator, remapOperand(op.LeftOperand, ids), remapOperand(op.RightOperand, ids)}
+	case DistributionOperation:
+		return DistributionOperation{op.Sketch.Copy()}
+	}
+	return operation
+}
+
+// remapCounts returns a copy of counts keyed by query IDs,
+// keyed by the IDs they are mapped to.
+func remapCounts(counts map[int]int, ids *idMapping) map[int]int {
+	if counts == nil {
+		return nil
+	}
+	remapped := make(map[int]int, len(counts))
+	for queryID, count := range counts {
+		remapped[remapID(ids, queryID)] += count
+	}
+	return remapped
+}
+
+func remapDecision(decision *Decision, ids *idMapping) *Decision {
+	if decision == nil {
+		return nil
+	}
+	predicate := decision.Predicate
+	if valuePredicate, ok := predicate.(ValuePredicate); ok {
+		predicate = ValuePredicate{remapOperand(valuePredicate.Operand, ids), valuePredicate.Value}
+	}
+	remapped := &Decision{predicate, [2]map[int]int{}, [2]*Decision{}}
+	for outcome := range decision.Outcomes {
+		remapped.Outcomes[outcome] = remapCounts(decision.Outcomes[outcome], ids)
+		remapped.Branches[outcome] = remapDecision(decision.Branches[outcome], ids)
+	}
+	return remapped
+}
+
+// remapPrediction returns a copy of the prediction referring
+// to the queries by the IDs they are mapped to. The members of a group
+// are sorted again by query ID, and the group takes the first one's.
+func remapPrediction(prediction *Prediction, ids *idMapping) *Prediction {
+	remapped := &Prediction{QueryID: remapID(ids, prediction.QueryID), ParamOps: make([]Operation, len(prediction.ParamOps)),
+		HitCount: prediction.HitCount, Trials: prediction.Trials, IsRandom: prediction.IsRandom, IsLoop: prediction.IsLoop,
+		Transitions: remapCounts(prediction.Transitions, ids), SpeculationHits: prediction.SpeculationHits,
+		SpeculationMisses: prediction.SpeculationMisses, Decision: remapDecision(prediction.Decision, ids)}
+	if prediction.Sketches != nil {
+		remapped.Sketches = make([]*ValueSketch, len(prediction.Sketches))
+		for i, sketch := range prediction.Sketches {
+			if sketch != nil {
+				remapped.Sketches[i] = sketch.Copy()
+			}
+		}
+	}
+	for i, paramOp := range prediction.ParamOps {
+		remapped.ParamOps[i] = remapOperation(paramOp, ids)
+	}
+	for _, member := range prediction.Members {
+		remapped.Members = append(remapped.Members, remapPrediction(member, ids))
+	}
+	if remapped.IsGroup() {
+		sort.Slice(remapped.Members, func(i, j int) bool {
+			return remapped.Members[i].QueryID < remapped.Members[j].QueryID
+		})
+		remapped.QueryID = remapped.Members[0].QueryID
+	}
+	return remapped
+}
+
+// renameOutcome moves the counts of a query in the outcomes
+// of the decision and its branches to another query.
+func (decision *Decision) renameOutcome(from int, to int) {
+	if decision == nil {
+		return
+	}
+	for outcome, branch := range decision.Branches {
+		if count, ok := decision.Outcomes[outcome][from]; ok {
+			delete(decision.Outcomes[outcome], from)
+			decision.Outcomes[outcome][to] += count
+		}
+		branch.renameOutcome(from, to)
+	}
+}
+
+func remapNode(node *Node, parent *Node, ids *idMapping) *Node {
+	remapped := NewNode(remapPrediction(node.Payload.(*Prediction), ids), parent)
+	prediction := remapped.Payload.(*Prediction)
+	for _, child := range node.Children {
+		remappedChild := remapNode(child, remapped, ids)
+		remapped.Children = append(remapped.Children, remappedChild)
+		// The transitions to a group are counted under its first member,
+		// which may no longer be the first one.
+		from := remapID(ids, child.Payload.(*Prediction).QueryID)
+		if to := remappedChild.Payload.(*Prediction).QueryID; from != to {
+			if count, ok := prediction.Transitions[from]; ok {
+				delete(prediction.Transitions, from)
+				prediction.Transitions[to] += count
+			}
+			prediction.Decision.renameOutcome(from, to)
+		}
+	}
+	return remapped
+}
+
+// addCounts adds the counts of other to counts, which is created if nil.
+func addCounts(counts map[int]int, other map[int]int) map[int]int {
+	if counts == nil && other != nil {
+		counts = make(map[int]int, len(other))
+	}
+	for queryID, count := range other {
+		counts[queryID] += count
+	}
+	return counts
+}
+
+// sameBranching returns whether the two decisions branch on the same predicates.
+func (decision *Decision) sameBranching(other *Decision) bool {
+	if decision.Predicate.ToString() != other.Predicate.ToString() {
+		return false
+	}
+	for outcome, branch := range decision.Branches {
+		if (branch == nil) != (other.Branches[outcome] == nil) || (branch != nil && !branch.sameBranching(other.Branches[outcome])) {
+			return false
+		}
+	}
+	return true
+}
+
+// addOutcomes adds the outcomes of a decision with the same branching to this one.
+func (decision *Decision) addOutcomes(other *Decision) {
+	for outcome, branch := range decision.Branches {
+		decision.Outcomes[outcome] = addCounts(decision.Outcomes[outcome], other.Outcomes[outcome])
+		if branch != nil {
+			branch.addOutcomes(other.Branches[outcome])
+		}
+	}
+}
+
+// mergeStatistics adds the statistics of an equal prediction to this one.
+// A decision is kept as is if the other one branches differently.
+func (prediction *Prediction) mergeStatistics(other *Prediction) {
+	prediction.HitCount += other.HitCount
+	prediction.Trials += other.Trials
+	prediction.SpeculationHits += other.SpeculationHits
+	prediction.SpeculationMisses += other.SpeculationMisses
+	prediction.Transitions = addCounts(prediction.Transitions, other.Transitions)
+	for i, sketch := range other.Sketches {
+		if sketch == nil {
+			continue
+		}
+		if prediction.Sketches == nil {
+			prediction.Sketches = make([]*ValueSketch, len(other.Sketches))
+		}
+		if prediction.Sketches[i] == nil {
+			prediction.Sketches[i] = sketch.Copy()
+		} else {
+			prediction.Sketches[i].Merge(sketch)
+		}
+	}
+	if prediction.Sketches != nil {
+		// The merged values may make a distribution dominant, or no longer.
+		prediction.refreshDistributions()
+	}
+	for i, member := range prediction.Members {
+		member.mergeStatistics(other.Members[i])
+	}
+	if prediction.IsGroup() {
+		prediction.refreshGroup()
+	}
+	if prediction.Decision == nil {
+		prediction.Decision = other.Decision
+	} else if other.Decision != nil && prediction.Decision.sameBranching(other.Decision) {
+		prediction.Decision.addOutcomes(other.Decision)
+	}
+}
+
+// mergeNode merges the subtree of other into the one of node, whose
+// predictions are equal. Children with equal predictions are merged,
+// and the others are moved under node, next to the conflicting ones.
+func mergeNode(node *Node, other *Node) {
+	node.Payload.(*Prediction).mergeStatistics(other.Payload.(*Prediction))
+	for _, otherChild := range other.Children {
+		var equal *Node
+		for _, child := range node.Children {
+			if child.Payload.(*Prediction).Equal(otherChild.Payload.(*Prediction)) {
+				equal = child
+				break
+			}
+		}
+		if equal != nil {
+			mergeNode(equal, otherChild)
+		} else {
+			otherChild.Parent = node
+			node.Children = append(node.Children, otherChild)
+		}
+	}
+}
+
+// Merge merges another model into this one. The query IDs of the trees
+// refer to querySet, and the ones of the other trees to otherQuerySet.
+// The templates querySet does not have yet are added to it. Nodes with
+// equal predictions are merged by summing their statistics, while the
+// others are kept side by side. The other trees are left untouched.
+// It returns an error, leaving the trees untouched, if the other trees
+// refer to queries otherQuerySet has no template for.
+func (pt *PredictionTrees) Merge(querySet *QuerySet, other *PredictionTrees, otherQuerySet *QuerySet) error {
+	otherIDs := make([]int, 0, len(otherQuerySet.IDToTemplate))
+	for queryID := range otherQuerySet.IDToTemplate {
+		otherIDs = append(otherIDs, queryID)
+	}
+	sort.Ints(otherIDs)
+	ids := &idMapping{make(map[int]int, len(otherIDs)), make(map[int]bool)}
+	for _, queryID := range otherIDs {
+		ids.ids[queryID] = querySet.GetQueryID(otherQuerySet.GetTemplate(queryID))
+	}
+	roots := []*Node{}
+	for _, root := range other.roots() {
+		roots = append(roots, remapNode(root, nil, ids))
+	}
+	if len(ids.missing) > 0 {
+		missing := make([]int, 0, len(ids.missing))
+		for queryID := range ids.missing {
+			missing = append(missing, queryID)
+		}
+		sort.Ints(missing)
+		return fmt.Errorf("no template for queries %v of the other model", missing)
+	}
+	for _, remapped := range roots {
+		queryID := remapped.Payload.(*Prediction).QueryID
+		if tree, ok := pt.trees[queryID]; ok {
+			mergeNode(tree, remapped)
+		} else {
+			pt.trees[queryID] = remapped
+		}
+	}
+	if pt.Options == nil {
+		pt.Options = other.Options
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package speculative
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestOperationEqual(t *testing.T) {
+	result := QueryResultOperand{1, 0, 0, 0}
+	if !(UnaryOperation{result}).Equal(UnaryOperation{QueryResultOperand{1, 0, 0, 0}}) {
+		t.Fatalf("Expecting equal unary operations")
+	}
+	if (UnaryOperation{result}).Equal(UnaryOperation{QueryResultOperand{1, 0, 0, 1}}) || (UnaryOperation{result}).Equal(RandomOperation{}) {
+		t.Fatalf("Expecting different operations")
+	}
+	if !(BinaryOperation{Adder{}, result, ConstOperand{1.0}}).Equal(BinaryOperation{Adder{}, result, ConstOperand{1.0}}) ||
+		(BinaryOperation{Adder{}, result, ConstOperand{1.0}}).Equal(BinaryOperation{Subtractor{}, result, ConstOperand{1.0}}) {
+		t.Fatalf("Expecting binary operations to compare their operators and operands")
+	}
+	if !(DistributionOperation{NewValueSketch(1)}).Equal(DistributionOperation{NewValueSketch(2)}) {
+		t.Fatalf("Expecting distributions to be equal regardless of their sketches")
+	}
+	set1 := NewUnorderedSet([]interface{}{1.0, 2.0})
+	set2 := NewUnorderedSet([]interface{}{2.0, 1.0})
+	if !(ConstOperand{set1}).Equal(ConstOperand{set2}) {
+		t.Fatalf("Expecting constant sets to be compared by their elements")
+	}
+}
+
+func TestMergeSelf(t *testing.T) {
+	modelBuilder := NewModelBuilder("test/bug.log", DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	for _, cluster := range modelBuilder.Clusters {
+		modelBuilder.UpdateModel(cluster, pt)
+	}
+	hits := make(map[int]int)
+	for queryID, tree := range pt.trees {
+		hits[queryID] = tree.Payload.(*Prediction).HitCount
+	}
+	size := pt.Size()
+	templates := len(modelBuilder.QuerySet.IDToTemplate)
+	if err := pt.Merge(modelBuilder.QuerySet, pt, modelBuilder.QuerySet); err != nil {
+		t.Fatal(err)
+	}
+	if pt.Size() != size || len(modelBuilder.QuerySet.IDToTemplate) != templates {
+		t.Fatalf("Expecting merging a model with itself to keep its %d nodes, got %d", size, pt.Size())
+	}
+	for queryID, tree := range pt.trees {
+		if tree.Payload.(*Prediction).HitCount != 2*hits[queryID] {
+			t.Fatalf("Expecting the hits of tree %d to double", queryID)
+		}
+	}
+}
+
+func TestMergeRemapsQueryIDs(t *testing.T) {
+	modelBuilder := NewModelBuilder("test/bug.log", DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	for _, cluster := range modelBuilder.Clusters {
+		modelBuilder.UpdateModel(cluster, pt)
+	}
+	modelBuilder.LearnDecisions(modelBuilder.Transactions, pt)
+	querySet := NewQuerySet()
+	querySet.GetQueryID("SELECT 1")
+	merged := NewPredictionTrees()
+	if err := merged.Merge(querySet, pt, modelBuilder.QuerySet); err != nil {
+		t.Fatal(err)
+	}
+	if merged.Size() != pt.Size() {
+		t.Fatalf("Expecting %d nodes, got %d", pt.Size(), merged.Size())
+	}
+	for _, trx := range modelBuilder.Transactions {
+		expected := pt.NewPredictor(modelBuilder.QuerySet)
+		actual := merged.NewPredictor(querySet)
+		for _, query := range trx {
+			if expectedSQL, actualSQL := expected.PredictNextSQL(), actual.PredictNextSQL(); expectedSQL != actualSQL {
+				t.Fatalf("Expecting %s, got %s", expectedSQL, actualSQL)
+			}
+			remapped := *query
+			remapped.QueryID = querySet.GetQueryID(modelBuilder.QuerySet.GetTemplate(query.QueryID))
+			expected.MoveToNext(query)
+			actual.MoveToNext(&remapped)
+		}
+	}
+}
+
+func TestMergeConflictingOperations(t *testing.T) {
+	traces := []string{}
+	for _, fixed := range []bool{false, true} {
+		traces = append(traces, testTrace(5, func(i int) []traceQuery {
+			if fixed {
+				return []traceQuery{userQuery(i, i+100), storiesQuery(5)}
+			}
+			return []traceQuery{userQuery(i, i+100), storiesQuery(i + 100)}
+		}))
+	}
+	// The second trace registers the templates in the opposite order.
+	traces[1] = `{"sql":"SELECT * FROM stories WHERE user_id = 1","results":[]}` + "\n" + traces[1]
+	builders := []*ModelBuilder{}
+	models := []*PredictionTrees{}
+	for _, trace := range traces {
+		modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+		pt := NewPredictionTrees()
+		for _, cluster := range modelBuilder.Clusters {
+			modelBuilder.UpdateModel(cluster, pt)
+		}
+		builders = append(builders, modelBuilder)
+		models = append(models, pt)
+	}
+	if err := models[0].Merge(builders[0].QuerySet, models[1], builders[1].QuerySet); err != nil {
+		t.Fatal(err)
+	}
+	users := builders[0].QuerySet.GetQueryID("SELECT * FROM users WHERE id = ?d")
+	stories := builders[0].QuerySet.GetQueryID("SELECT * FROM stories WHERE user_id = ?d")
+	root := models[0].trees[users]
+	if root.Payload.(*Prediction).Transitions[stories] != 10 {
+		t.Fatalf("Expecting the transitions to be summed, got %v", root.Payload.(*Prediction).Transitions)
+	}
+	operations := []string{}
+	for _, child := range root.Children {
+		if child.Payload.(*Prediction).QueryID != stories || child.Parent != root {
+			t.Fatalf("Expecting only stories under users")
+		}
+		operations = append(operations, child.Payload.(*Prediction).ParamOps[0].ToString())
+	}
+	if len(operations) != 2 || operations[0] != "Query0[0,0]" || operations[1] != "5" {
+		t.Fatalf("Expecting both operations side by side, got %v", operations)
+	}
+}
+
+func TestMergeReordersGroups(t *testing.T) {
+	reads := []string{"SELECT * FROM names", "SELECT * FROM stars", "SELECT * FROM tables"}
+	orders := [][]int{{0, 1, 2}, {2, 1, 0}, {1, 0, 2}}
+	traces := []string{"", ""}
+	for k := range traces {
+		if k == 1 {
+			// The second trace registers the reads in the opposite order.
+			for i := len(reads) - 1; i >= 0; i-- {
+				traces[k] += fmt.Sprintf(`{"sql":"%s","results":{}}`, reads[i]) + "\n"
+			}
+		}
+		traces[k] += testTrace(len(orders), func(j int) []traceQuery {
+			queries := []traceQuery{{"SELECT * FROM users", "{}"}}
+			for _, i := range orders[j] {
+				queries = append(queries, traceQuery{reads[i], "{}"})
+			}
+			return queries
+		})
+	}
+	builders := []*ModelBuilder{}
+	models := []*PredictionTrees{}
+	for _, trace := range traces {
+		modelBuilder := NewModelBuilderFromContent(strings.TrimSpace(trace), DefaultModelBuilderOptions())
+		pt := NewPredictionTrees()
+		for _, cluster := range modelBuilder.Clusters {
+			modelBuilder.UpdateModel(cluster, pt)
+		}
+		builders = append(builders, modelBuilder)
+		models = append(models, pt)
+	}
+	if err := models[0].Merge(builders[0].QuerySet, models[1], builders[1].QuerySet); err != nil {
+		t.Fatal(err)
+	}
+	root := models[0].trees[builders[0].QuerySet.GetQueryID("SELECT * FROM users")]
+	if len(root.Children) != 1 {
+		t.Fatalf("Expecting the equal groups to be merged, got %d children", len(root.Children))
+	}
+	group := root.Children[0].Payload.(*Prediction)
+	if len(group.Members) != 3 || group.HitCount != 6 || root.Payload.(*Prediction).Transitions[group.QueryID] != 6 {
+		t.Fatalf("Expecting a group of 3 reads hit 6 times, got %d members hit %d times", len(group.Members), group.HitCount)
+	}
+	for i, member := range group.Members {
+		if member.QueryID != builders[0].QuerySet.GetQueryID(reads[i]) {
+			t.Fatalf("Expecting the members to be sorted by query ID")
+		}
+	}
+	if group.QueryID != group.Members[0].QueryID {
+		t.Fatalf("Expecting the group to take the query ID of its first member")
+	}
+}
+
+func TestMergeMissingTemplate(t *testing.T) {
+	modelBuilder := NewModelBuilder("test/bug.log", DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	for _, cluster := range modelBuilder.Clusters {
+		modelBuilder.UpdateModel(cluster, pt)
+	}
+	merged := NewPredictionTrees()
+	if err := merged.Merge(NewQuerySet(), pt, NewQuerySet()); err == nil || merged.Size() != 0 {
+		t.Fatalf("Expecting an error and the trees untouched without the templates of the other model")
+	}
+}
+
+func TestMergeRefreshesDistributions(t *testing.T) {
+	predictions := []*Prediction{NewRandomPrediction(1, 1), NewRandomPrediction(1, 1)}
+	for _, prediction := range predictions {
+		for i := 0; i < 3; i++ {
+			prediction.Observe([]*Query{&Query{QueryID: 1, Arguments: []interface{}{7.0}}}, 0)
+		}
+		if !prediction.IsRandom {
+			t.Fatalf("Expecting too few values for a distribution")
+		}
+	}
+	predictions[0].mergeStatistics(predictions[1])
+	if _, ok := predictions[0].ParamOps[0].(DistributionOperation); !ok || predictions[0].IsRandom {
+		t.Fatalf("Expecting the merged values to make a distribution, got %s", predictions[0].ParamOps[0].ToString())
+	}
+	empty := NewRandomPrediction(1, 1)
+	empty.mergeStatistics(predictions[1])
+	if empty.Sketches[0] == predictions[1].Sketches[0] || empty.Sketches[0].Total() != 3 {
+		t.Fatalf("Expecting the sketch to be copied")
+	}
+}
@@ -0,0 +1,513 @@
+package speculative
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// ModelVersion is the version of the format in which models are saved.
+// Files saved in another version cannot be loaded. Version 2 added
+// the trials of the predictions, and version 3 the decision look-back
+// and the gaps of the fuzzy clustering to the options.
+const ModelVersion = 3
+
+// savedModel is how the prediction trees and the
+// query set they refer to are saved.
+type savedModel struct {
+	Version   int                  `json:"version"`
+	Templates map[int]string       `json:"templates"`
+	Options   *ModelBuilderOptions `json:"options,omitempty"`
+	Split     string               `json:"split,omitempty"`
+	Trees     []*savedNode         `json:"trees"`
+}
+
+type savedNode struct {
+	Prediction *savedPrediction `json:"prediction"`
+	Children   []*savedNode     `json:"children,omitempty"`
+}
+
+type savedPrediction struct {
+	QueryID           int                `json:"queryID"`
+	ParamOps          []*savedTerm       `json:"paramOps"`
+	HitCount          int                `json:"hitCount"`
+	Trials            int                `json:"trials"`
+	IsRandom          bool               `json:"isRandom,omitempty"`
+	IsLoop            bool               `json:"isLoop,omitempty"`
+	Sketches          []*savedSketch     `json:"sketches,omitempty"`
+	Transitions       map[int]int        `json:"transitions,omitempty"`
+	SpeculationHits   int                `json:"speculationHits,omitempty"`
+	SpeculationMisses int                `json:"speculationMisses,omitempty"`
+	Members           []*savedPrediction `json:"members,omitempty"`
+	Decision          *savedDecision     `json:"decision,omitempty"`
+}
+
+type savedSketch struct {
+	Capacity int               `json:"capacity"`
+	Total    int               `json:"total"`
+	Counts   []savedValueCount `json:"counts"`
+}
+
+type savedValueCount struct {
+	Value interface{} `json:"value"`
+	Count int         `json:"count"`
+}
+
+type savedDecision struct {
+	Predicate *savedTerm        `json:"predicate"`
+	Outcomes  [2]map[int]int    `json:"outcomes"`
+	Branches  [2]*savedDecision `json:"branches"`
+}
+
+// savedTerm is a saved operation, operand or predicate. Type is the name
+// of its type, and only the fields it has are set. Name holds the
+// aggregator, the binary operator, the format or the timestamp layout,
+// and Operands hold the nested operands in the order they are declared.
+type savedTerm struct {
+	Type        string        `json:"type"`
+	QueryID     int           `json:"queryID,omitempty"`
+	QueryIndex  int           `json:"queryIndex,omitempty"`
+	RowIndex    int           `json:"rowIndex,omitempty"`
+	ColumnIndex int           `json:"columnIndex,omitempty"`
+	ArgIndex    int           `json:"argIndex,omitempty"`
+	KeyColumn   int           `json:"keyColumn,omitempty"`
+	Threshold   int           `json:"threshold,omitempty"`
+	Name        string        `json:"name,omitempty"`
+	Value       interface{}   `json:"value"`
+	Scale       float64       `json:"scale,omitempty"`
+	Offset      float64       `json:"offset,omitempty"`
+	Unit        time.Duration `json:"unit,omitempty"`
+	Shift       time.Duration `json:"shift,omitempty"`
+	Operands    []*savedTerm  `json:"operands,omitempty"`
+	Sketch      *savedSketch  `json:"sketch,omitempty"`
+}
+
+// SaveModel saves the prediction trees, together with the
+// query set their query IDs refer to, to the file at path.
+func SaveModel(path string, pt *PredictionTrees, querySet *QuerySet) error {
+	model := savedModel{ModelVersion, querySet.IDToTemplate, pt.Options, pt.Split, []*savedNode{}}
+	rootIDs := make([]int, 0, len(pt.trees))
+	for queryID := range pt.trees {
+		rootIDs = append(rootIDs, queryID)
+	}
+	sort.Ints(rootIDs)
+	for _, queryID := range rootIDs {
+		tree, err := saveNode(pt.trees[queryID])
+		if err != nil {
+			return err
+		}
+		model.Trees = append(model.Trees, tree)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(model)
+}
+
+// LoadModel loads the prediction trees and the query
+// set saved to the file at path by SaveModel.
+func LoadModel(path string) (*PredictionTrees, *QuerySet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	var model savedModel
+	if err := json.NewDecoder(file).Decode(&model); err != nil {
+		return nil, nil, err
+	}
+	if model.Version != ModelVersion {
+		return nil, nil, fmt.Errorf("unsupported model version %d, expecting %d", model.Version, ModelVersion)
+	}
+	querySet := NewQuerySet()
+	for queryID, template := range model.Templates {
+		querySet.IDToTemplate[queryID] = template
+		querySet.TemplateToID[template] = queryID
+	}
+	pt := NewPredictionTrees()
+	pt.Options = model.Options
+	pt.Split = model.Split
+	for _, saved := range model.Trees {
+		tree, err := loadNode(saved, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		pt.trees[tree.Payload.(*Prediction).QueryID] = tree
+	}
+	return pt, querySet, nil
+}
+
+func saveNode(node *Node) (*savedNode, error) {
+	prediction, err := savePrediction(node.Payload.(*Prediction))
+	if err != nil {
+		return nil, err
+	}
+	saved := &savedNode{prediction, nil}
+	for _, child := range node.Children {
+		savedChild, err := saveNode(child)
+		if err != nil {
+			return nil, err
+		}
+		saved.Children = append(saved.Children, savedChild)
+	}
+	return saved, nil
+}
+
+func loadNode(saved *savedNode, parent *Node) (*Node, error) {
+	prediction, err := loadPrediction(saved.Prediction)
+	if err != nil {
+		return nil, err
+	}
+	node := NewNode(prediction, parent)
+	for _, savedChild := range saved.Children {
+		child, err := loadNode(savedChild, node)
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, child)
+	}
+	return node, nil
+}
+
+func savePrediction(prediction *Prediction) (*savedPrediction, error) {
+	saved := &savedPrediction{
+		QueryID:           prediction.QueryID,
+		ParamOps:          make([]*savedTerm, len(prediction.ParamOps)),
+		HitCount:          prediction.HitCount,
+		Trials:            prediction.Trials,
+		IsRandom:          prediction.IsRandom,
+		IsLoop:            prediction.IsLoop,
+		Transitions:       prediction.Transitions,
+		SpeculationHits:   prediction.SpeculationHits,
+		SpeculationMisses: prediction.SpeculationMisses,
+	}
+	for i, paramOp := range prediction.ParamOps {
+		term, err := saveTerm(paramOp)
+		if err != nil {
+			return nil, err
+		}
+		saved.ParamOps[i] = term
+	}
+	if prediction.Sketches != nil {
+		saved.Sketches = make([]*savedSketch, len(prediction.Sketches))
+		for i, sketch := range prediction.Sketches {
+			saved.Sketches[i] = saveSketch(sketch)
+		}
+	}
+	if prediction.Members != nil {
+		saved.Members = make([]*savedPrediction, len(prediction.Members))
+		for i, member := range prediction.Members {
+			savedMember, err := savePrediction(member)
+			if err != nil {
+				return nil, err
+			}
+			saved.Members[i] = savedMember
+		}
+	}
+	decision, err := saveDecision(prediction.Decision)
+	if err != nil {
+		return nil, err
+	}
+	saved.Decision = decision
+	return saved, nil
+}
+
+func loadPrediction(saved *savedPrediction) (*Prediction, error) {
+	prediction := &Prediction{
+		QueryID:           saved.QueryID,
+		ParamOps:          make([]Operation, len(saved.ParamOps)),
+		HitCount:          saved.HitCount,
+		Trials:            saved.Trials,
+		IsRandom:          saved.IsRandom,
+		IsLoop:            saved.IsLoop,
+		Transitions:       saved.Transitions,
+		SpeculationHits:   saved.SpeculationHits,
+		SpeculationMisses: saved.SpeculationMisses,
+	}
+	if prediction.Transitions == nil {
+		prediction.Transitions = make(map[int]int)
+	}
+	if saved.Sketches != nil {
+		prediction.Sketches = make([]*ValueSketch, len(saved.Sketches))
+		for i, sketch := range saved.Sketches {
+			prediction.Sketches[i] = loadSketch(sketch)
+		}
+	}
+	for i, savedOp := range saved.ParamOps {
+		term, err := loadTerm(savedOp)
+		if err != nil {
+			return nil, err
+		}
+		paramOp, ok := term.(Operation)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an operation", savedOp.Type)
+		}
+		prediction.ParamOps[i] = paramOp
+	}
+	if saved.Members != nil {
+		prediction.Members = make([]*Prediction, len(saved.Members))
+		for i, savedMember := range saved.Members {
+			member, err := loadPrediction(savedMember)
+			if err != nil {
+				return nil, err
+			}
+			prediction.Members[i] = member
+		}
+	}
+	decision, err := loadDecision(saved.Decision)
+	if err != nil {
+		return nil, err
+	}
+	prediction.Decision = decision
+	return prediction, nil
+}
+
+func saveSketch(sketch *ValueSketch) *savedSketch {
+	if sketch == nil {
+		return nil
+	}
+	saved := &savedSketch{sketch.capacity, sketch.total, []savedValueCount{}}
+	for _, valueCount := range sketch.Top(len(sketch.counts)) {
+		saved.Counts = append(saved.Counts, savedValueCount{saveValue(valueCount.Value), valueCount.Count})
+	}
+	return saved
+}
+
+func loadSketch(saved *savedSketch) *ValueSketch {
+	if saved == nil {
+		return nil
+	}
+	sketch := NewValueSketch(saved.Capacity)
+	sketch.total = saved.Total
+	for _, valueCount := range saved.Counts {
+		value := loadValue(valueCount.Value)
+		sketch.counts[sketchKey(value)] = &ValueCount{value, valueCount.Count}
+	}
+	return sketch
+}
+
+func saveDecision(decision *Decision) (*savedDecision, error) {
+	if decision == nil {
+		return nil, nil
+	}
+	predicate, err := saveTerm(decision.Predicate)
+	if err != nil {
+		return nil, err
+	}
+	saved := &savedDecision{predicate, decision.Outcomes, [2]*savedDecision{}}
+	for outcome, branch := range decision.Branches {
+		if saved.Branches[outcome], err = saveDecision(branch); err != nil {
+			return nil, err
+		}
+	}
+	return saved, nil
+}
+
+func loadDecision(saved *savedDecision) (*Decision, error) {
+	if saved == nil {
+		return nil, nil
+	}
+	term, err := loadTerm(saved.Predicate)
+	if err != nil {
+		return nil, err
+	}
+	predicate, ok := term.(Predicate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a predicate", saved.Predicate.Type)
+	}
+	decision := &Decision{predicate, saved.Outcomes, [2]*Decision{}}
+	for outcome, branch := range saved.Branches {
+		if decision.Branches[outcome], err = loadDecision(branch); err != nil {
+			return nil, err
+		}
+	}
+	return decision, nil
+}
+
+// saveValue returns a value that is saved as it is in JSON.
+// Sets are saved as objects with a "set" field.
+func saveValue(value interface{}) interface{} {
+	if set, ok := value.(*UnorderedSet); ok {
+		return map[string]interface{}{"set": set.Elements()}
+	}
+	return value
+}
+
+func loadValue(value interface{}) interface{} {
+	if object, ok := value.(map[string]interface{}); ok {
+		if elements, ok := object["set"].([]interface{}); ok {
+			return NewUnorderedSet(elements)
+		}
+	}
+	return value
+}
+
+func saveTerm(term interface{}) (*savedTerm, error) {
+	if term == nil {
+		return nil, nil
+	}
+	saved := &savedTerm{}
+	var operands []interface{}
+	switch t := term.(type) {
+	case RandomOperation:
+		saved.Type = "RandomOperation"
+	case DistributionOperation:
+		saved.Type = "DistributionOperation"
+		saved.Sketch = saveSketch(t.Sketch)
+	case UnaryOperation:
+		saved.Type = "UnaryOperation"
+		operands = []interface{}{t.Operand}
+	case BinaryOperation:
+		saved.Type = "BinaryOperation"
+		saved.Name = t.Operator.Name()
+		if _, ok := BinaryOperatorByName(saved.Name); !ok {
+			return nil, fmt.Errorf("binary operator %s is not registered", saved.Name)
+		}
+		operands = []interface{}{t.LeftOperand, t.RightOperand}
+	case ConstOperand:
+		saved.Type = "ConstOperand"
+		saved.Value = saveValue(t.Value)
+	case QueryResultOperand:
+		saved.Type = "QueryResultOperand"
+		saved.QueryID, saved.QueryIndex, saved.RowIndex, saved.ColumnIndex = t.QueryID, t.QueryIndex, t.RowIndex, t.ColumnIndex
+	case LastRowOperand:
+		saved.Type = "LastRowOperand"
+		saved.QueryID, saved.QueryIndex, saved.ColumnIndex = t.QueryID, t.QueryIndex, t.ColumnIndex
+	case KeyedLookupOperand:
+		saved.Type = "KeyedLookupOperand"
+		saved.QueryID, saved.QueryIndex, saved.KeyColumn, saved.ColumnIndex = t.QueryID, t.QueryIndex, t.KeyColumn, t.ValueColumn
+		operands = []interface{}{t.Key}
+	case IterationOperand:
+		saved.Type = "IterationOperand"
+		saved.QueryID, saved.QueryIndex, saved.ColumnIndex = t.QueryID, t.QueryIndex, t.ColumnIndex
+	case QueryArgumentOperand:
+		saved.Type = "QueryArgumentOperand"
+		saved.QueryID, saved.QueryIndex, saved.ArgIndex = t.QueryID, t.QueryIndex, t.ArgIndex
+	case AggregationOperand:
+		saved.Type = "AggregationOperand"
+		saved.QueryID, saved.QueryIndex, saved.ColumnIndex = t.QueryID, t.QueryIndex, t.ColumnIndex
+		saved.Name = t.Aggregation.Name()
+	case FormatOperand:
+		saved.Type = "FormatOperand"
+		saved.Name = t.Format
+		operands = []interface{}{t.First, t.Second}
+	case AffineOperand:
+		saved.Type = "AffineOperand"
+		saved.Scale, saved.Offset = t.Scale, t.Offset
+		operands = []interface{}{t.Operand}
+	case TimestampOperand:
+		saved.Type = "TimestampOperand"
+		saved.Name, saved.Unit, saved.Shift = t.Layout, t.Unit, t.Offset
+		operands = []interface{}{t.Operand}
+	case ArgumentListOperand:
+		saved.Type = "ArgumentListOperand"
+		saved.QueryID, saved.QueryIndex, saved.ArgIndex = t.QueryID, t.QueryIndex, t.ArgIndex
+	case ColumnListOperand:
+		saved.Type = "ColumnListOperand"
+		saved.QueryID, saved.QueryIndex, saved.ColumnIndex = t.QueryID, t.QueryIndex, t.ColumnIndex
+	case EmptyResultPredicate:
+		saved.Type = "EmptyResultPredicate"
+		saved.QueryIndex = t.QueryIndex
+	case RowCountPredicate:
+		saved.Type = "RowCountPredicate"
+		saved.QueryIndex, saved.Threshold = t.QueryIndex, t.Threshold
+	case ValuePredicate:
+		saved.Type = "ValuePredicate"
+		saved.Value = saveValue(t.Value)
+		operands = []interface{}{t.Operand}
+	default:
+		return nil, fmt.Errorf("cannot save %T", term)
+	}
+	for _, operand := range operands {
+		savedOperand, err := saveTerm(operand)
+		if err != nil {
+			return nil, err
+		}
+		saved.Operands = append(saved.Operands, savedOperand)
+	}
+	return saved, nil
+}
+
+func loadTerm(saved *savedTerm) (interface{}, error) {
+	if saved == nil {
+		return nil, nil
+	}
+	operands := make([]Operand, len(saved.Operands))
+	for i, savedOperand := range saved.Operands {
+		term, err := loadTerm(savedOperand)
+		if err != nil {
+			return nil, err
+		}
+		if term == nil {
+			continue
+		}
+		operand, ok := term.(Operand)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an operand", savedOperand.Type)
+		}
+		operands[i] = operand
+	}
+	// operand returns the i-th nested operand, or nil if there is none.
+	operand := func(i int) Operand {
+		if i < len(operands) {
+			return operands[i]
+		}
+		return nil
+	}
+	switch saved.Type {
+	case "RandomOperation":
+		return RandomOperation{}, nil
+	case "DistributionOperation":
+		if saved.Sketch == nil {
+			return nil, fmt.Errorf("%s has no sketch", saved.Type)
+		}
+		return DistributionOperation{loadSketch(saved.Sketch)}, nil
+	case "UnaryOperation":
+		return UnaryOperation{operand(0)}, nil
+	case "BinaryOperation":
+		operator, ok := BinaryOperatorByName(saved.Name)
+		if !ok {
+			return nil, fmt.Errorf("binary operator %s is not registered", saved.Name)
+		}
+		return BinaryOperation{operator, operand(0), operand(1)}, nil
+	case "ConstOperand":
+		return ConstOperand{loadValue(saved.Value)}, nil
+	case "QueryResultOperand":
+		return QueryResultOperand{saved.QueryID, saved.QueryIndex, saved.RowIndex, saved.ColumnIndex}, nil
+	case "LastRowOperand":
+		return LastRowOperand{saved.QueryID, saved.QueryIndex, saved.ColumnIndex}, nil
+	case "KeyedLookupOperand":
+		return KeyedLookupOperand{saved.QueryID, saved.QueryIndex, saved.KeyColumn, saved.ColumnIndex, operand(0)}, nil
+	case "IterationOperand":
+		return IterationOperand{saved.QueryID, saved.QueryIndex, saved.ColumnIndex}, nil
+	case "QueryArgumentOperand":
+		return QueryArgumentOperand{saved.QueryID, saved.QueryIndex, saved.ArgIndex}, nil
+	case "AggregationOperand":
+		aggregator, ok := AggregatorByName(saved.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown aggregator %s", saved.Name)
+		}
+		return AggregationOperand{saved.QueryID, saved.QueryIndex, aggregator, saved.ColumnIndex}, nil
+	case "FormatOperand":
+		return NewFormatOperand(saved.Name, operand(0), operand(1)), nil
+	case "AffineOperand":
+		return AffineOperand{operand(0), saved.Scale, saved.Offset}, nil
+	case "TimestampOperand":
+		return TimestampOperand{operand(0), saved.Unit, saved.Shift, saved.Name}, nil
+	case "ArgumentListOperand":
+		return ArgumentListOperand{saved.QueryID, saved.QueryIndex, saved.ArgIndex}, nil
+	case "ColumnListOperand":
+		return ColumnListOperand{saved.QueryID, saved.QueryIndex, saved.ColumnIndex}, nil
+	case "EmptyResultPredicate":
+		return EmptyResultPredicate{saved.QueryIndex}, nil
+	case "RowCountPredicate":
+		return RowCountPredicate{saved.QueryIndex, saved.Threshold}, nil
+	case "ValuePredicate":
+		return ValuePredicate{operand(0), loadValue(saved.Value)}, nil
+	}
+	return nil, fmt.Errorf("cannot load %s", saved.Type)
+}
@@ -0,0 +1,66 @@
+package speculative
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveAndLoadModel(t *testing.T) {
+	modelBuilder := NewModelBuilder("test/bug.log", DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	for _, cluster := range modelBuilder.Clusters {
+		modelBuilder.UpdateModel(cluster, pt)
+	}
+	modelBuilder.LearnDecisions(modelBuilder.Transactions, pt)
+	pt.Split = "prefix(0.3)"
+	dir := t.TempDir()
+	path := filepath.Join(dir, "model")
+	if err := SaveModel(path, pt, modelBuilder.QuerySet); err != nil {
+		t.Fatal(err)
+	}
+	loaded, querySet, err := LoadModel(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Options == nil || *loaded.Options != modelBuilder.Options || loaded.Split != pt.Split {
+		t.Fatalf("Expecting the options and the split to be saved, got %+v and %q", loaded.Options, loaded.Split)
+	}
+	if len(querySet.IDToTemplate) != len(modelBuilder.QuerySet.IDToTemplate) {
+		t.Fatalf("Expecting %d templates, got %d", len(modelBuilder.QuerySet.IDToTemplate), len(querySet.IDToTemplate))
+	}
+	resaved := filepath.Join(dir, "resaved")
+	if err := SaveModel(resaved, loaded, querySet); err != nil {
+		t.Fatal(err)
+	}
+	original, _ := os.ReadFile(path)
+	copied, _ := os.ReadFile(resaved)
+	if !bytes.Equal(original, copied) {
+		t.Fatalf("Expecting the loaded model to be saved the same way")
+	}
+
+	for _, trx := range modelBuilder.Transactions[:min(20, len(modelBuilder.Transactions))] {
+		expected := pt.NewPredictor(modelBuilder.QuerySet)
+		actual := loaded.NewPredictor(querySet)
+		for _, query := range trx {
+			expectedQuery := expected.PredictNextQuery()
+			actualQuery := actual.PredictNextQuery()
+			if (expectedQuery == nil) != (actualQuery == nil) || (expectedQuery != nil && !expectedQuery.Same(actualQuery)) {
+				t.Fatalf("Expecting %+v, got %+v", expectedQuery, actualQuery)
+			}
+			expected.MoveToNext(query)
+			actual.MoveToNext(query)
+		}
+	}
+}
+
+func TestLoadModelVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model")
+	os.WriteFile(path, []byte(fmt.Sprintf(`{"version":%d,"templates":{},"trees":[]}`, ModelVersion+1)), 0644)
+	if _, _, err := LoadModel(path); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("Expecting a version error, got %v", err)
+	}
+}
@@ -4,10 +4,20 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// defaultFloatTolerance is how far apart two numbers can be and still be equal.
+const defaultFloatTolerance = 0.00001
+
 func floatEqual(num1 float64, num2 float64) bool {
-	return math.Abs(num1-num2) < 0.00001
+	return floatNear(num1, num2, defaultFloatTolerance)
+}
+
+func floatNear(num1 float64, num2 float64, tolerance float64) bool {
+	return math.Abs(num1-num2) < tolerance
 }
 
 func interfaceEqual(i1 interface{}, i2 interface{}) bool {
@@ -50,6 +60,53 @@ func valueEqual(val1 interface{}, val2 interface{}) bool {
 	return interfaceEqual(val1, val2)
 }
 
+// valueNear returns true if the two values are equal,
+// numbers being equal if they are less than tolerance apart.
+func valueNear(val1 interface{}, val2 interface{}, tolerance float64) bool {
+	num1, ok1 := val1.(float64)
+	num2, ok2 := val2.(float64)
+	if ok1 && ok2 {
+		return floatNear(num1, num2, tolerance)
+	}
+	return interfaceEqual(val1, val2)
+}
+
+// formatValue returns the text form of a value as it would
+// appear inside a SQL string, e.g., 313 instead of 313.0.
+func formatValue(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return value.(string)
+	case float64:
+		return strconv.FormatFloat(value.(float64), 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// timestampLayouts are the layouts in which timestamps and
+// dates are written in queries and results.
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05.000Z",
+	"2006-01-02T15:04:05Z",
+	"2006-01-02",
+}
+
+// parseTimestamp returns the time represented by the value and its
+// layout, if the value is a timestamp or date literal.
+func parseTimestamp(value interface{}) (time.Time, string, bool) {
+	str, ok := value.(string)
+	if !ok {
+		return time.Time{}, "", false
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, str); err == nil {
+			return t, layout, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
 func queriesToString(queries []*Query) string {
 	res := "["
 	for i, query := range queries {
@@ -91,7 +148,7 @@ func (op ConstOperand) Equal(operand Operand) bool {
 	if !ok {
 		return false
 	}
-	return op == operandActual
+	return interfaceEqual(op.Value, operandActual.Value)
 }
 
 // QueryResultOperand results an operand whose value comes
@@ -133,6 +190,140 @@ func (op QueryResultOperand) Equal(operand Operand) bool {
 	return op == operandActual
 }
 
+// LastRowOperand represents an operand whose value comes from
+// the last row of the result of a query.
+type LastRowOperand struct {
+	QueryID     int
+	QueryIndex  int
+	ColumnIndex int
+}
+
+// GetValue returns the value represented by this operand.
+func (op LastRowOperand) GetValue(trx []*Query) interface{} {
+	if len(trx) <= op.QueryIndex {
+		fmt.Printf("%+v, %+v\n", op, queriesToString(trx))
+	}
+	if op.QueryID != trx[op.QueryIndex].QueryID {
+		fmt.Printf("%+v, %+v\n", op, queriesToString(trx))
+		panic("Incorrect query")
+	}
+	queryResult := trx[op.QueryIndex].ResultSet
+	if len(queryResult) == 0 {
+		return nil
+	}
+	lastRow := queryResult[len(queryResult)-1]
+	if len(lastRow) <= op.ColumnIndex {
+		return nil
+	}
+	return lastRow[op.ColumnIndex]
+}
+
+// ToString returns a string representation of this operand.
+func (op LastRowOperand) ToString() string {
+	return fmt.Sprintf("Query%d[last,%d]", op.QueryIndex, op.ColumnIndex)
+}
+
+// Equal returns whether the two operands are equal.
+func (op LastRowOperand) Equal(operand Operand) bool {
+	operandActual, ok := operand.(LastRowOperand)
+	if !ok {
+		return false
+	}
+	return op == operandActual
+}
+
+// KeyedLookupOperand represents an operand whose value comes from
+// the ValueColumn-th column of the row, in a query's result, whose
+// KeyColumn-th column equals the value of Key.
+type KeyedLookupOperand struct {
+	QueryID     int
+	QueryIndex  int
+	KeyColumn   int
+	ValueColumn int
+	Key         Operand
+}
+
+// GetValue returns the value represented by this operand.
+func (op KeyedLookupOperand) GetValue(trx []*Query) interface{} {
+	if len(trx) <= op.QueryIndex {
+		fmt.Printf("%+v, %+v\n", op, queriesToString(trx))
+	}
+	if op.QueryID != trx[op.QueryIndex].QueryID {
+		fmt.Printf("%+v, %+v\n", op, queriesToString(trx))
+		panic("Incorrect query")
+	}
+	key := op.Key.GetValue(trx)
+	for _, row := range trx[op.QueryIndex].ResultSet {
+		if len(row) <= op.KeyColumn || len(row) <= op.ValueColumn {
+			continue
+		}
+		if valueEqual(row[op.KeyColumn], key) {
+			return row[op.ValueColumn]
+		}
+	}
+	return nil
+}
+
+// ToString returns a string representation of this operand.
+func (op KeyedLookupOperand) ToString() string {
+	return fmt.Sprintf("Query%d[%d=%s,%d]", op.QueryIndex, op.KeyColumn, op.Key.ToString(), op.ValueColumn)
+}
+
+// Equal returns whether the two operands are equal.
+func (op KeyedLookupOperand) Equal(operand Operand) bool {
+	operandActual, ok := operand.(KeyedLookupOperand)
+	if !ok {
+		return false
+	}
+	return op.QueryID == operandActual.QueryID &&
+		op.QueryIndex == operandActual.QueryIndex &&
+		op.KeyColumn == operandActual.KeyColumn &&
+		op.ValueColumn == operandActual.ValueColumn &&
+		op.Key.Equal(operandActual.Key)
+}
+
+// IterationOperand represents an operand whose value comes from
+// the row of a query's result that drives the current iteration of
+// a loop. It must be evaluated against a transaction whose last step
+// is the loop in progress, so that the number of iterations already
+// issued tells which row to use.
+type IterationOperand struct {
+	QueryID     int
+	QueryIndex  int
+	ColumnIndex int
+}
+
+// GetValue returns the value represented by this operand.
+func (op IterationOperand) GetValue(trx []*Query) interface{} {
+	if len(trx) <= op.QueryIndex {
+		fmt.Printf("%+v, %+v\n", op, queriesToString(trx))
+	}
+	if op.QueryID != trx[op.QueryIndex].QueryID {
+		fmt.Printf("%+v, %+v\n", op, queriesToString(trx))
+		panic("Incorrect query")
+	}
+	iteration := len(trx[len(trx)-1].Iterations)
+	queryResult := trx[op.QueryIndex].ResultSet
+	if len(queryResult) <= iteration || len(queryResult[iteration]) <= op.ColumnIndex {
+		return nil
+	}
+	return queryResult[iteration][op.ColumnIndex]
+}
+
+// ToString returns a string representation of this operand.
+func (op IterationOperand) ToString() string {
+	return fmt.Sprintf("Query%d[i,%d]", op.QueryIndex, op.ColumnIndex)
+}
+
+// Equal returns whether the two operands are equal.
+func (op IterationOperand) Equal(operand Operand) bool {
+	operandActual, ok := operand.(IterationOperand)
+	if !ok {
+		return false
+	}
+	return op == operandActual
+}
+
 // QueryArgumentOperand represents an operand whose value comes
 // from the argument list of a query.
 type QueryArgumentOperand struct {
@@ -168,12 +359,63 @@ func (op QueryArgumentOperand) Equal(operand Operand) bool {
 	return op == operandActual
 }
 
-// Aggregator represents aggregation functions on float slice
-type Aggregator func([]float64) float64
+// Aggregator represents an aggregation function on a float column.
+// It is a named value rather than a bare func so that operands using
+// it stay comparable.
+type Aggregator int
+
+// All supported aggregators.
+const (
+	SumAggregator Aggregator = iota
+	AvgAggregator
+	CountAggregator
+	MinAggregator
+	MaxAggregator
+	DistinctCountAggregator
+)
+
+var aggregatorNames = map[Aggregator]string{
+	SumAggregator:           "sum",
+	AvgAggregator:           "avg",
+	CountAggregator:         "count",
+	MinAggregator:           "min",
+	MaxAggregator:           "max",
+	DistinctCountAggregator: "distinct_count",
+}
+
+var aggregatorFuncs = map[Aggregator]func([]float64) float64{
+	SumAggregator:           Sum,
+	AvgAggregator:           Avg,
+	CountAggregator:         Len,
+	MinAggregator:           Min,
+	MaxAggregator:           Max,
+	DistinctCountAggregator: DistinctCount,
+}
+
+// Aggregate applies the aggregator to the numbers.
+func (aggregator Aggregator) Aggregate(nums []float64) float64 {
+	return aggregatorFuncs[aggregator](nums)
+}
+
+// Name of the aggregator
+func (aggregator Aggregator) Name() string {
+	return aggregatorNames[aggregator]
+}
+
+// AggregatorByName returns the aggregator with the given name.
+func AggregatorByName(name string) (Aggregator, bool) {
+	for aggregator, aggregatorName := range aggregatorNames {
+		if aggregatorName == name {
+			return aggregator, true
+		}
+	}
+	return 0, false
+}
 
 // AggregationOperand represents an operand whose value is the
 // result of an aggregation on an float column of a query's result.
 type AggregationOperand struct {
+	QueryID     int
 	QueryIndex  int
 	Aggregation Aggregator
 	ColumnIndex int
@@ -181,23 +423,32 @@ type AggregationOperand struct {
 
 // GetValue returns the value represented by this operand.
 func (op AggregationOperand) GetValue(trx []*Query) interface{} {
+	if len(trx) <= op.QueryIndex {
+		fmt.Printf("%+v, %+v\n", op, queriesToString(trx))
+	}
+	if op.QueryID != trx[op.QueryIndex].QueryID {
+		fmt.Printf("%+v, %+v\n", op, queriesToString(trx))
+		panic("Incorrect query")
+	}
 	queryResult := trx[op.QueryIndex].ResultSet
 	column := make([]float64, 0, len(queryResult))
 	for _, row := range queryResult {
-		val := row[op.ColumnIndex]
-		if val != nil {
-			column = append(column, val.(float64))
+		if op.ColumnIndex >= len(row) {
+			continue
+		}
+		if val, ok := row[op.ColumnIndex].(float64); ok {
+			column = append(column, val)
 		}
 	}
 	if len(column) > 0 {
-		return op.Aggregation(column)
+		return op.Aggregation.Aggregate(column)
 	}
 	return 0.0
 }
 
 // ToString returns a string representation of this operand.
 func (op AggregationOperand) ToString() string {
-	return fmt.Sprintf("Query%d.aggregate(%d)", op.QueryIndex, op.ColumnIndex)
+	return fmt.Sprintf("Query%d.%s(%d)", op.QueryIndex, op.Aggregation.Name(), op.ColumnIndex)
 }
 
 // Equal returns whether the two operands are equal.
@@ -206,8 +457,282 @@ func (op AggregationOperand) Equal(operand Operand) bool {
 	if !ok {
 		return false
 	}
-	return op.QueryIndex == operandActual.QueryIndex &&
-		op.ColumnIndex == operandActual.ColumnIndex
+	return op == operandActual
+}
+
+// FormatOperand represents a string operand built from a format,
+// whose one or two holes are filled with other operands, e.g.,
+// 'user:%s:unread_messages', 'INV-%05d' or a LIKE 'prefix%%'.
+// A %s hole takes the text of its operand, and a %d hole, with an
+// optional zero padded width, takes its value as an integer.
+// Second is nil for a format with a single hole.
+type FormatOperand struct {
+	Format string
+	First  Operand
+	Second Operand
+	// verbs holds the last letter of each hole of Format, parsed once
+	// by NewFormatOperand rather than on every evaluation.
+	verbs string
+}
+
+// NewFormatOperand creates a FormatOperand filling the holes of format
+// with first and second, which is nil for a format with a single hole.
+func NewFormatOperand(format string, first Operand, second Operand) FormatOperand {
+	verbs := ""
+	for _, verb := range parseFormat(format).verbs {
+		verbs += verb[len(verb)-1:]
+	}
+	return FormatOperand{format, first, second, verbs}
+}
+
+// GetValue returns the value represented by this operand.
+func (op FormatOperand) GetValue(trx []*Query) interface{} {
+	values := []interface{}{op.First.GetValue(trx)}
+	if op.Second != nil {
+		values = append(values, op.Second.GetValue(trx))
+	}
+	if len(op.verbs) != len(values) {
+		return nil
+	}
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		if value == nil {
+			return nil
+		}
+		if op.verbs[i] != 'd' {
+			args[i] = formatValue(value)
+			continue
+		}
+		num, ok := value.(float64)
+		if !ok || num != math.Trunc(num) {
+			return nil
+		}
+		args[i] = int64(num)
+	}
+	return fmt.Sprintf(op.Format, args...)
+}
+
+// ToString returns a string representation of this operand.
+func (op FormatOperand) ToString() string {
+	if op.Second == nil {
+		return fmt.Sprintf("format('%s', %s)", op.Format, op.First.ToString())
+	}
+	return fmt.Sprintf("format('%s', %s, %s)", op.Format, op.First.ToString(), op.Second.ToString())
+}
+
+// Equal returns whether the two operands are equal.
+func (op FormatOperand) Equal(operand Operand) bool {
+	operandActual, ok := operand.(FormatOperand)
+	if !ok {
+		return false
+	}
+	if (op.Second == nil) != (operandActual.Second == nil) {
+		return false
+	}
+	return op.Format == operandActual.Format &&
+		op.First.Equal(operandActual.First) &&
+		(op.Second == nil || op.Second.Equal(operandActual.Second))
+}
+
+// formatParts is a format split into its literal parts and the holes
+// between them. There is always one more part than holes.
+type formatParts struct {
+	parts []string
+	verbs []string
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parseFormat splits format at its %s and %0Nd holes, skipping over
+// the escaped percent signs.
+func parseFormat(format string) formatParts {
+	parsed := formatParts{}
+	start := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		if i+1 < len(format) && format[i+1] == '%' {
+			i++
+			continue
+		}
+		end := i + 1
+		if end < len(format) && format[end] == '0' {
+			digits := end + 1
+			for digits < len(format) && isDigit(format[digits]) {
+				digits++
+			}
+			if digits > end+1 {
+				end = digits
+			}
+		}
+		if end < len(format) && (format[end] == 's' || format[end] == 'd') {
+			parsed.parts = append(parsed.parts, format[start:i])
+			parsed.verbs = append(parsed.verbs, format[i:end+1])
+			start = end + 1
+			i = end
+		}
+	}
+	parsed.parts = append(parsed.parts, format[start:])
+	return parsed
+}
+
+// String joins the parts and holes back into a format.
+func (parsed formatParts) String() string {
+	format := parsed.parts[0]
+	for i, verb := range parsed.verbs {
+		format += verb + parsed.parts[i+1]
+	}
+	return format
+}
+
+// withHole returns a copy of parsed with the part at index split at
+// [start, end) by verb.
+func (parsed formatParts) withHole(index int, start int, end int, verb string) formatParts {
+	part := parsed.parts[index]
+	parts := make([]string, 0, len(parsed.parts)+1)
+	parts = append(parts, parsed.parts[:index]...)
+	parts = append(parts, part[:start], part[end:])
+	parts = append(parts, parsed.parts[index+1:]...)
+	verbs := make([]string, 0, len(parsed.verbs)+1)
+	verbs = append(verbs, parsed.verbs[:index]...)
+	verbs = append(verbs, verb)
+	verbs = append(verbs, parsed.verbs[index:]...)
+	return formatParts{parts, verbs}
+}
+
+// withText replaces the first occurrence of text in the literal parts
+// with a %s hole. It returns false if text is not found.
+func (parsed formatParts) withText(text string) (formatParts, bool) {
+	for i, part := range parsed.parts {
+		if index := strings.Index(part, text); index >= 0 {
+			return parsed.withHole(i, index, index+len(text), "%s"), true
+		}
+	}
+	return parsed, false
+}
+
+// withPadded replaces the first run of digits in the literal parts
+// that is num padded with leading zeros with a %0Nd hole of the same
+// width. It returns false if there is no such run. A zero would match
+// any run of zeros, so it is never padded.
+func (parsed formatParts) withPadded(num float64) (formatParts, bool) {
+	if num <= 0 || num != math.Trunc(num) || num > math.MaxInt64 {
+		return parsed, false
+	}
+	digits := strconv.FormatInt(int64(num), 10)
+	for i, part := range parsed.parts {
+		for start := 0; start < len(part); {
+			if !isDigit(part[start]) {
+				start++
+				continue
+			}
+			end := start
+			for end < len(part) && isDigit(part[end]) {
+				end++
+			}
+			run := part[start:end]
+			if len(run) > len(digits) && strings.TrimLeft(run, "0") == digits {
+				return parsed.withHole(i, start, end, fmt.Sprintf("%%0%dd", len(run))), true
+			}
+			start = end
+		}
+	}
+	return parsed, false
+}
+
+// AffineOperand represents a number calculated as Scale * x + Offset,
+// where x is the value of another operand and Scale and Offset are
+// constants learned from the training transactions.
+type AffineOperand struct {
+	Operand Operand
+	Scale   float64
+	Offset  float64
+}
+
+// GetValue returns the value represented by this operand.
+func (op AffineOperand) GetValue(trx []*Query) interface{} {
+	value, ok := op.Operand.GetValue(trx).(float64)
+	if !ok {
+		return nil
+	}
+	return op.Scale*value + op.Offset
+}
+
+// ToString returns a string representation of this operand.
+func (op AffineOperand) ToString() string {
+	return fmt.Sprintf("%v*%s+%v", op.Scale, op.Operand.ToString(), op.Offset)
+}
+
+// Equal returns whether the two operands are equal.
+func (op AffineOperand) Equal(operand Operand) bool {
+	operandActual, ok := operand.(AffineOperand)
+	if !ok {
+		return false
+	}
+	return op.Operand.Equal(operandActual.Operand) &&
+		floatEqual(op.Scale, operandActual.Scale) &&
+		floatEqual(op.Offset, operandActual.Offset)
+}
+
+// TimestampOperand represents a timestamp calculated by truncating a
+// base timestamp to Unit, if Unit is not zero, and adding Offset. The
+// base is the value of Operand, or the time the transaction started if
+// Operand is nil. The value is written in Layout.
+type TimestampOperand struct {
+	Operand Operand
+	Unit    time.Duration
+	Offset  time.Duration
+	Layout  string
+}
+
+// GetValue returns the value represented by this operand.
+func (op TimestampOperand) GetValue(trx []*Query) interface{} {
+	var base time.Time
+	if op.Operand == nil {
+		if len(trx) == 0 || trx[0].Time.IsZero() {
+			return nil
+		}
+		base = trx[0].Time.UTC()
+	} else {
+		var ok bool
+		if base, _, ok = parseTimestamp(op.Operand.GetValue(trx)); !ok {
+			return nil
+		}
+	}
+	if op.Unit > 0 {
+		base = base.Truncate(op.Unit)
+	}
+	return base.Add(op.Offset).Format(op.Layout)
+}
+
+// ToString returns a string representation of this operand.
+func (op TimestampOperand) ToString() string {
+	base := "start"
+	if op.Operand != nil {
+		base = op.Operand.ToString()
+	}
+	if op.Unit > 0 {
+		base = fmt.Sprintf("trunc(%s, %v)", base, op.Unit)
+	}
+	return fmt.Sprintf("%s+%v", base, op.Offset)
+}
+
+// Equal returns whether the two operands are equal.
+func (op TimestampOperand) Equal(operand Operand) bool {
+	operandActual, ok := operand.(TimestampOperand)
+	if !ok {
+		return false
+	}
+	if (op.Operand == nil) != (operandActual.Operand == nil) {
+		return false
+	}
+	return op.Unit == operandActual.Unit &&
+		op.Offset == operandActual.Offset &&
+		op.Layout == operandActual.Layout &&
+		(op.Operand == nil || op.Operand.Equal(operandActual.Operand))
 }
 
 // ArgumentListOperand represents an operand whose value is a list
@@ -290,11 +815,67 @@ func (op ColumnListOperand) Equal(operand Operand) bool {
 	return op == operandActual
 }
 
+// Predicate is a condition on the results of the earlier
+// queries of a transaction.
+type Predicate interface {
+	Evaluate(trx []*Query) bool
+	ToString() string
+}
+
+// EmptyResultPredicate is true if a query returned no rows.
+type EmptyResultPredicate struct {
+	QueryIndex int
+}
+
+// Evaluate returns whether the query returned no rows.
+func (pred EmptyResultPredicate) Evaluate(trx []*Query) bool {
+	return len(trx[pred.QueryIndex].ResultSet) == 0
+}
+
+// ToString returns a string representation of this predicate.
+func (pred EmptyResultPredicate) ToString() string {
+	return fmt.Sprintf("empty(Query%d)", pred.QueryIndex)
+}
+
+// RowCountPredicate is true if a query returned more rows than the threshold.
+type RowCountPredicate struct {
+	QueryIndex int
+	Threshold  int
+}
+
+// Evaluate returns whether the query returned more rows than the threshold.
+func (pred RowCountPredicate) Evaluate(trx []*Query) bool {
+	return len(trx[pred.QueryIndex].ResultSet) > pred.Threshold
+}
+
+// ToString returns a string representation of this predicate.
+func (pred RowCountPredicate) ToString() string {
+	return fmt.Sprintf("count(Query%d) > %d", pred.QueryIndex, pred.Threshold)
+}
+
+// ValuePredicate is true if the value of an operand, e.g., a column
+// of the result of a query, equals the given value.
+type ValuePredicate struct {
+	Operand Operand
+	Value   interface{}
+}
+
+// Evaluate returns whether the value of the operand equals the given value.
+func (pred ValuePredicate) Evaluate(trx []*Query) bool {
+	return valueEqual(pred.Operand.GetValue(trx), pred.Value)
+}
+
+// ToString returns a string representation of this predicate.
+func (pred ValuePredicate) ToString() string {
+	return fmt.Sprintf("%s = %v", pred.Operand.ToString(), pred.Value)
+}
+
 // Operation represents an operation involving zero, one or more operands.
 type Operation interface {
 	GetValue(trx []*Query) interface{}
-	MatchesValue(trx []*Query, value interface{}) bool
+	MatchesValue(trx []*Query, value interface{}, tolerance float64) bool
 	ToString() string
+	Equal(operation Operation) bool
 }
 
 // RandomOperation represents an operation, whose value matches anything.
@@ -307,7 +888,7 @@ func (op RandomOperation) GetValue(trx []*Query) interface{} {
 }
 
 // MatchesValue is true for RandomOperation and any given value.
-func (op RandomOperation) MatchesValue(trx []*Query, value interface{}) bool {
+func (op RandomOperation) MatchesValue(trx []*Query, value interface{}, tolerance float64) bool {
 	return true
 }
 
@@ -316,6 +897,45 @@ func (op RandomOperation) ToString() string {
 	return ""
 }
 
+// Equal returns whether the two operations are equal.
+func (op RandomOperation) Equal(operation Operation) bool {
+	_, ok := operation.(RandomOperation)
+	return ok
+}
+
+// DistributionOperation represents an operation whose value cannot be
+// calculated from the transaction, but is likely to be the most
+// frequent value seen in training.
+type DistributionOperation struct {
+	Sketch *ValueSketch
+}
+
+// GetValue returns the most frequent value.
+func (op DistributionOperation) GetValue(trx []*Query) interface{} {
+	top := op.Sketch.Top(1)
+	if len(top) == 0 {
+		return nil
+	}
+	return top[0].Value
+}
+
+// MatchesValue returns whether the value is the most frequent one.
+func (op DistributionOperation) MatchesValue(trx []*Query, value interface{}, tolerance float64) bool {
+	return valueNear(op.GetValue(trx), value, tolerance)
+}
+
+// ToString returns a string representation of this operation.
+func (op DistributionOperation) ToString() string {
+	return fmt.Sprintf("top(%v, %.0f%%)", op.GetValue(nil), 100*op.Sketch.Frequency())
+}
+
+// Equal returns whether the two operations are equal. Distributions
+// are all equal, as the values in their sketches are statistics.
+func (op DistributionOperation) Equal(operation Operation) bool {
+	_, ok := operation.(DistributionOperation)
+	return ok
+}
+
 // UnaryOperation represents an unary operation.
 type UnaryOperation struct {
 	Operand Operand
@@ -327,9 +947,9 @@ func (op UnaryOperation) GetValue(trx []*Query) interface{} {
 }
 
 // MatchesValue returns whether the value of this operation matches
-// the given value.
-func (op UnaryOperation) MatchesValue(trx []*Query, value interface{}) bool {
-	return valueEqual(op.Operand.GetValue(trx), value)
+// the given value, numbers within tolerance.
+func (op UnaryOperation) MatchesValue(trx []*Query, value interface{}, tolerance float64) bool {
+	return valueNear(op.Operand.GetValue(trx), value, tolerance)
 }
 
 // ToString returns a string representation of this operation.
@@ -337,6 +957,12 @@ func (op UnaryOperation) ToString() string {
 	return op.Operand.ToString()
 }
 
+// Equal returns whether the two operations are equal.
+func (op UnaryOperation) Equal(operation Operation) bool {
+	operationActual, ok := operation.(UnaryOperation)
+	return ok && op.Operand.Equal(operationActual.Operand)
+}
+
 // BinaryOperator represents a binary operator.
 type BinaryOperator interface {
 	Operate(leftOperand interface{}, rightOperand interface{}) float64
@@ -344,6 +970,27 @@ type BinaryOperator interface {
 	Name() string
 }
 
+// binaryOperators maps the name of every known binary operator to it.
+var binaryOperators = make(map[string]BinaryOperator)
+
+func init() {
+	for _, operator := range []BinaryOperator{Adder{}, Subtractor{}, Multiplier{}, Divider{}, Moduloer{}} {
+		RegisterBinaryOperator(operator)
+	}
+}
+
+// RegisterBinaryOperator makes the operator known by its name,
+// so that the operations using it can be saved and loaded.
+func RegisterBinaryOperator(operator BinaryOperator) {
+	binaryOperators[operator.Name()] = operator
+}
+
+// BinaryOperatorByName returns the registered binary operator with the given name.
+func BinaryOperatorByName(name string) (BinaryOperator, bool) {
+	operator, ok := binaryOperators[name]
+	return operator, ok
+}
+
 // BinaryOperation represents an unary operation.
 type BinaryOperation struct {
 	Operator     BinaryOperator
@@ -357,13 +1004,9 @@ func (op BinaryOperation) GetValue(trx []*Query) interface{} {
 }
 
 // MatchesValue returns whether the value of this operation matches
-// the given value.
-func (op BinaryOperation) MatchesValue(trx []*Query, value interface{}) bool {
-	val := op.Operator.Operate(op.LeftOperand.GetValue(trx), op.RightOperand.GetValue(trx))
-	if reflect.TypeOf(val) == reflect.TypeOf(value) {
-		return val == value
-	}
-	return false
+// the given value, numbers within tolerance.
+func (op BinaryOperation) MatchesValue(trx []*Query, value interface{}, tolerance float64) bool {
+	return valueNear(op.GetValue(trx), value, tolerance)
 }
 
 // ToString returns a string representation of this operation.
@@ -371,6 +1014,13 @@ func (op BinaryOperation) ToString() string {
 	return op.LeftOperand.ToString() + " " + op.Operator.Name() + " " + op.RightOperand.ToString()
 }
 
+// Equal returns whether the two operations are equal.
+func (op BinaryOperation) Equal(operation Operation) bool {
+	operationActual, ok := operation.(BinaryOperation)
+	return ok && op.Operator.Name() == operationActual.Operator.Name() &&
+		op.LeftOperand.Equal(operationActual.LeftOperand) && op.RightOperand.Equal(operationActual.RightOperand)
+}
+
 // Adder is able to add two numbers.
 type Adder struct{}
 
@@ -484,6 +1134,15 @@ func Len(nums []float64) float64 {
 	return float64(len(nums))
 }
 
+// DistinctCount returns the number of distinct numbers
+func DistinctCount(nums []float64) float64 {
+	distinct := make(map[float64]bool)
+	for _, num := range nums {
+		distinct[num] = true
+	}
+	return float64(len(distinct))
+}
+
 // Max returns the max of the numbers
 func Max(nums []float64) float64 {
 	max := nums[0]
@@ -510,4 +1169,46 @@ func Min(nums []float64) float64 {
 var BinaryOperators = []BinaryOperator{Adder{}, Subtractor{}, Multiplier{}, Divider{}, Moduloer{}}
 
 // Aggregators contains all supported Aggregator
-var Aggregators = []Aggregator{Sum, Avg, Len, Max, Min}
+var Aggregators = []Aggregator{SumAggregator, AvgAggregator, CountAggregator, MinAggregator, MaxAggregator, DistinctCountAggregator}
+
+// resultDependencies returns the indexes of the queries whose results
+// are needed to calculate the value of the operation, operand or predicate.
+func resultDependencies(operation interface{}) []int {
+	switch op := operation.(type) {
+	case EmptyResultPredicate:
+		return []int{op.QueryIndex}
+	case RowCountPredicate:
+		return []int{op.QueryIndex}
+	case ValuePredicate:
+		return resultDependencies(op.Operand)
+	case UnaryOperation:
+		return resultDependencies(op.Operand)
+	case BinaryOperation:
+		return append(resultDependencies(op.LeftOperand), resultDependencies(op.RightOperand)...)
+	case QueryResultOperand:
+		return []int{op.QueryIndex}
+	case LastRowOperand:
+		return []int{op.QueryIndex}
+	case IterationOperand:
+		return []int{op.QueryIndex}
+	case AggregationOperand:
+		return []int{op.QueryIndex}
+	case ColumnListOperand:
+		return []int{op.QueryIndex}
+	case KeyedLookupOperand:
+		return append(resultDependencies(op.Key), op.QueryIndex)
+	case FormatOperand:
+		if op.Second == nil {
+			return resultDependencies(op.First)
+		}
+		return append(resultDependencies(op.First), resultDependencies(op.Second)...)
+	case AffineOperand:
+		return resultDependencies(op.Operand)
+	case TimestampOperand:
+		if op.Operand == nil {
+			return []int{}
+		}
+		return resultDependencies(op.Operand)
+	}
+	return []int{}
+}
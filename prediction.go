@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"log"
 
@@ -38,13 +42,228 @@ func nonNegative(num int) int {
 type Prediction struct {
 	QueryID  int
 	ParamOps []Operation
+	// HitCount counts the Trials in which all the arguments were right.
 	HitCount int
+	// Trials counts the transactions that issued the query of this
+	// prediction right after reaching its parent.
+	Trials   int
 	IsRandom bool
+	// IsLoop is true if the prediction is for a loop step, in which
+	// case ParamOps predict the arguments of every iteration.
+	IsLoop bool
+	// Sketches keeps the values seen for the arguments that cannot be
+	// calculated. It is nil for the other arguments.
+	Sketches []*ValueSketch
+	// Transitions counts, for each query, how many training
+	// transactions issued it right after this one.
+	Transitions map[int]int
+	// SpeculationHits and SpeculationMisses count how many times the
+	// Predictor got the arguments right or wrong using this prediction,
+	// when its query was the next one.
+	SpeculationHits   int
+	SpeculationMisses int
+	// Members is only set if the prediction is for an unordered group
+	// step. It contains the predictions for the reads of the group,
+	// sorted by query ID, while ParamOps is empty.
+	Members []*Prediction
+	// Decision, if not nil, tells which query follows this one
+	// from the results of the earlier queries.
+	Decision *Decision
+}
+
+const (
+	// sketchCapacity is the number of distinct values kept per argument.
+	sketchCapacity = 16
+	// minDistributionSamples is the number of values an argument needs
+	// before its most frequent value is used as a prediction.
+	minDistributionSamples = 5
+	// dominantFrequency is how frequent the most frequent value must be.
+	dominantFrequency = 0.8
+)
+
+const (
+	// maxDecisionDepth is the number of predicates a decision chains.
+	maxDecisionDepth = 3
+	// maxDecisionValues is the number of values tried per column.
+	maxDecisionValues = 8
+	// minDecisionSupport is the number of samples each outcome of a
+	// predicate needs, so that a value only seen once, such as an ID,
+	// is not learned.
+	minDecisionSupport = 2
+	// minDecisionGain is the fraction of the samples a predicate must
+	// guess right on top of always guessing the most frequent query.
+	minDecisionGain = 0.05
+)
+
+// Decision picks the query that follows a node from the data of the
+// transaction. Outcomes[0] and Outcomes[1] count, for each query, how
+// many training transactions issued it next when the predicate was false
+// and true respectively. Branches refine the outcomes with more predicates.
+type Decision struct {
+	Predicate Predicate
+	Outcomes  [2]map[int]int
+	Branches  [2]*Decision
+}
+
+// Transitions returns, for each query, how many training transactions
+// with the same outcomes as trx issued it next. It returns nil if the
+// predicate needs a query trx does not have.
+func (decision *Decision) Transitions(trx []*Query) map[int]int {
+	for _, queryIndex := range resultDependencies(decision.Predicate) {
+		if queryIndex >= len(trx) {
+			return nil
+		}
+	}
+	outcome := 0
+	if decision.Predicate.Evaluate(trx) {
+		outcome = 1
+	}
+	if branch := decision.Branches[outcome]; branch != nil {
+		if transitions := branch.Transitions(trx); transitions != nil {
+			return transitions
+		}
+	}
+	return decision.Outcomes[outcome]
+}
+
+// ToString returns a string representation of this decision.
+func (decision *Decision) ToString() string {
+	branches := make([]string, 2)
+	for outcome := range branches {
+		if decision.Branches[outcome] != nil {
+			branches[outcome] = decision.Branches[outcome].ToString()
+		} else {
+			branches[outcome] = fmt.Sprintf("%v", decision.Outcomes[outcome])
+		}
+	}
+	return fmt.Sprintf("if %s then %s else %s", decision.Predicate.ToString(), branches[1], branches[0])
+}
+
+// decisionSample is the transaction before a node, together
+// with the query it issued after the node.
+type decisionSample struct {
+	trx  []*Query
+	next int
+}
+
+// correctGuesses returns how many of the samples issue the query
+// most of them issue next, as well as the counts of all queries.
+func correctGuesses(samples []decisionSample) (int, map[int]int) {
+	counts := make(map[int]int)
+	best := 0
+	for _, sample := range samples {
+		counts[sample.next]++
+		best = max(best, counts[sample.next])
+	}
+	return best, counts
+}
+
+// candidatePredicates enumerates the predicates over the results of
+// the last lookBack queries before the node the samples went through.
+func candidatePredicates(samples []decisionSample, lookBack int) []Predicate {
+	predicates := []Predicate{}
+	example := samples[0].trx
+	for queryIndex := len(example) - 1; queryIndex >= nonNegative(len(example)-lookBack); queryIndex-- {
+		query := example[queryIndex]
+		if query.IsGroup() {
+			continue
+		}
+		predicates = append(predicates, EmptyResultPredicate{queryIndex})
+		seenCounts := make(map[int]bool)
+		for _, sample := range samples {
+			count := len(sample.trx[queryIndex].ResultSet)
+			if count > 0 && !seenCounts[count] {
+				seenCounts[count] = true
+				predicates = append(predicates, RowCountPredicate{queryIndex, count})
+			}
+		}
+		for column := 0; ; column++ {
+			operand := QueryResultOperand{query.QueryID, queryIndex, 0, column}
+			values := []interface{}{}
+			hasColumn := false
+			for _, sample := range samples {
+				resultSet := sample.trx[queryIndex].ResultSet
+				if len(resultSet) == 0 || column >= len(resultSet[0]) {
+					continue
+				}
+				hasColumn = true
+				value := resultSet[0][column]
+				switch value.(type) {
+				case float64, string:
+				default:
+					continue
+				}
+				seen := false
+				for _, existing := range values {
+					seen = seen || valueEqual(existing, value)
+				}
+				if !seen && len(values) < maxDecisionValues {
+					values = append(values, value)
+				}
+			}
+			if !hasColumn {
+				break
+			}
+			for _, value := range values {
+				predicates = append(predicates, ValuePredicate{operand, value})
+			}
+		}
+	}
+	return predicates
+}
+
+// learnDecision returns the decision that best tells which query the
+// samples issue next, or nil if no predicate does significantly better
+// than always guessing the most frequent one. Only the results of the
+// last lookBack queries are looked at.
+func learnDecision(samples []decisionSample, depth int, lookBack int) *Decision {
+	baseline, counts := correctGuesses(samples)
+	if len(counts) < 2 || depth <= 0 {
+		return nil
+	}
+	var decision *Decision
+	// A predicate must guess right at least one more sample, and at
+	// least minDecisionGain of them, than the baseline.
+	best := baseline + max(1, int(minDecisionGain*float64(len(samples))+0.999)) - 1
+	var bestSplit [2][]decisionSample
+	for _, predicate := range candidatePredicates(samples, lookBack) {
+		var split [2][]decisionSample
+		for _, sample := range samples {
+			outcome := 0
+			if predicate.Evaluate(sample.trx) {
+				outcome = 1
+			}
+			split[outcome] = append(split[outcome], sample)
+		}
+		if len(split[0]) < minDecisionSupport || len(split[1]) < minDecisionSupport {
+			continue
+		}
+		correct := 0
+		var outcomes [2]map[int]int
+		for outcome := range split {
+			var guesses int
+			guesses, outcomes[outcome] = correctGuesses(split[outcome])
+			correct += guesses
+		}
+		if correct > best {
+			best = correct
+			bestSplit = split
+			decision = &Decision{predicate, outcomes, [2]*Decision{}}
+		}
+	}
+	if decision != nil {
+		for outcome := range bestSplit {
+			if len(bestSplit[outcome]) > 0 {
+				decision.Branches[outcome] = learnDecision(bestSplit[outcome], depth-1, lookBack)
+			}
+		}
+	}
+	return decision
 }
 
 // NewPrediction creates a new Prediction object.
 func NewPrediction(queryID int, parameters []Operation) *Prediction {
-	prediction := Prediction{queryID, parameters, 0, false}
+	prediction := Prediction{QueryID: queryID, ParamOps: parameters, Transitions: make(map[int]int)}
 	for _, param := range parameters {
 		switch param.(type) {
 		case RandomOperation:
@@ -61,16 +280,105 @@ func NewRandomPrediction(queryID int, numOps int) *Prediction {
 	for i := 0; i < numOps; i++ {
 		ops[i] = RandomOperation{}
 	}
-	return &Prediction{queryID, ops, 0, true}
+	return &Prediction{QueryID: queryID, ParamOps: ops, IsRandom: true, Transitions: make(map[int]int)}
+}
+
+// NewGroupPrediction creates a prediction for an unordered group step
+// out of the predictions for its members, sorted by query ID.
+func NewGroupPrediction(members []*Prediction) *Prediction {
+	prediction := &Prediction{QueryID: members[0].QueryID, ParamOps: []Operation{}, Transitions: make(map[int]int), Members: members}
+	prediction.refreshGroup()
+	return prediction
+}
+
+// newRandomStepPrediction creates a random prediction for the step,
+// which is a loop or a group if the step is.
+func newRandomStepPrediction(step *Query) *Prediction {
+	if step.IsGroup() {
+		members := make([]*Prediction, len(step.Members))
+		for i, member := range step.Members {
+			members[i] = NewRandomPrediction(member.QueryID, len(member.Arguments))
+		}
+		return NewGroupPrediction(members)
+	}
+	prediction := NewRandomPrediction(step.QueryID, len(step.Arguments))
+	prediction.IsLoop = step.IsLoop()
+	return prediction
+}
+
+// IsGroup returns true if the prediction is for an unordered group step.
+func (prediction *Prediction) IsGroup() bool {
+	return prediction.Members != nil
+}
+
+// Equal returns whether the two predictions predict the same step
+// the same way, regardless of their statistics.
+func (prediction *Prediction) Equal(other *Prediction) bool {
+	if prediction.QueryID != other.QueryID || prediction.IsRandom != other.IsRandom || prediction.IsLoop != other.IsLoop ||
+		len(prediction.ParamOps) != len(other.ParamOps) || len(prediction.Members) != len(other.Members) {
+		return false
+	}
+	for i, paramOp := range prediction.ParamOps {
+		if !paramOp.Equal(other.ParamOps[i]) {
+			return false
+		}
+	}
+	for i, member := range prediction.Members {
+		if !member.Equal(other.Members[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// member returns the prediction for the read of the group
+// with the given query ID, or nil if there is none.
+func (prediction *Prediction) member(queryID int) *Prediction {
+	for _, member := range prediction.Members {
+		if member.QueryID == queryID {
+			return member
+		}
+	}
+	return nil
+}
+
+// refreshGroup marks a group as random if none of its members can be predicted.
+func (prediction *Prediction) refreshGroup() {
+	prediction.IsRandom = true
+	for _, member := range prediction.Members {
+		if !member.IsRandom {
+			prediction.IsRandom = false
+		}
+	}
 }
 
-// Hit increases the HitCount of this prediction.
+// Hit increases the HitCount of this prediction,
+// and of its members if it is a group.
 func (prediction *Prediction) Hit() {
 	prediction.HitCount++
+	for _, member := range prediction.Members {
+		member.Hit()
+	}
+}
+
+// Trial increases the Trials of this prediction,
+// and of its members if it is a group.
+func (prediction *Prediction) Trial() {
+	prediction.Trials++
+	for _, member := range prediction.Members {
+		member.Trial()
+	}
+}
+
+// MatchesQuery true if the current prediction perfectly matches the given
+// query, the numbers being equal if they are less than tolerance apart.
+func (prediction *Prediction) MatchesQuery(trx []*Query, query *Query, tolerance float64) bool {
+	return prediction.matchesQuery(trx, query, tolerance, false)
 }
 
-// MatchesQuery true if the current prediction perfectly matches the given query.
-func (prediction *Prediction) MatchesQuery(trx []*Query, query *Query) bool {
+// matchesQuery is MatchesQuery, with the arguments guessed from
+// distributions matching any value if anyGuess is true.
+func (prediction *Prediction) matchesQuery(trx []*Query, query *Query, tolerance float64, anyGuess bool) bool {
 	if prediction.QueryID != query.QueryID {
 		return false
 	}
@@ -78,21 +386,252 @@ func (prediction *Prediction) MatchesQuery(trx []*Query, query *Query) bool {
 		return true
 	}
 	for i := 0; i < len(query.Arguments); i++ {
-		if !prediction.ParamOps[i].MatchesValue(trx, query.Arguments[i]) {
+		if _, ok := prediction.ParamOps[i].(DistributionOperation); ok && anyGuess {
+			continue
+		}
+		if !prediction.ParamOps[i].MatchesValue(trx, query.Arguments[i], tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+// dependsOnAny returns true if any of the arguments depends on
+// the result of a query at one of the given indexes.
+func (prediction *Prediction) dependsOnAny(queryIndexes map[int]bool) bool {
+	for _, paramOp := range prediction.ParamOps {
+		if dependsOnAny(paramOp, queryIndexes) {
+			return true
+		}
+	}
+	return false
+}
+
+// dependsOnAny returns true if the operation, operand or predicate
+// depends on the result of a query at one of the given indexes.
+func dependsOnAny(operation interface{}, queryIndexes map[int]bool) bool {
+	for _, queryIndex := range resultDependencies(operation) {
+		if queryIndexes[queryIndex] {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTransitions records that count transactions issued
+// the query right after this one.
+func (prediction *Prediction) AddTransitions(queryID int, count int) {
+	prediction.Transitions[queryID] += count
+}
+
+// Confidence returns the probability that the arguments of this
+// prediction are right, given that its query is the next one.
+func (prediction *Prediction) Confidence() float64 {
+	hits := prediction.HitCount + prediction.SpeculationHits
+	total := prediction.Trials + prediction.SpeculationHits + prediction.SpeculationMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(hits) / float64(total)
+}
+
+// Observe records the values of the arguments that cannot be calculated
+// in the index-th step of the transaction, in all of its iterations if it
+// is a loop, and turns those arguments into distribution-based
+// predictions once a value dominates.
+func (prediction *Prediction) Observe(trx []*Query, index int) {
+	if prediction.IsGroup() {
+		view := trx[:index:index]
+		for _, query := range trx[index].Members {
+			if member := prediction.member(query.QueryID); member != nil {
+				member.Observe(append(view, query), index)
+			}
+		}
+		prediction.refreshGroup()
+		return
+	}
+	queries := []*Query{trx[index]}
+	if trx[index].IsLoop() {
+		queries = trx[index].Iterations
+	}
+	if prediction.Sketches == nil {
+		prediction.Sketches = make([]*ValueSketch, len(prediction.ParamOps))
+	}
+	for i, paramOp := range prediction.ParamOps {
+		switch paramOp.(type) {
+		case RandomOperation, DistributionOperation:
+			break
+		default:
+			continue
+		}
+		if prediction.Sketches[i] == nil {
+			prediction.Sketches[i] = NewValueSketch(sketchCapacity)
+		}
+		for _, query := range queries {
+			if i < len(query.Arguments) {
+				prediction.Sketches[i].Observe(query.Arguments[i])
+			}
+		}
+	}
+	prediction.refreshDistributions()
+}
+
+func (prediction *Prediction) refreshDistributions() {
+	prediction.IsRandom = false
+	for i, sketch := range prediction.Sketches {
+		if sketch == nil {
+			continue
+		}
+		if sketch.Total() >= minDistributionSamples && sketch.Frequency() >= dominantFrequency {
+			// The operation keeps the values seen so far, so that the
+			// ones observed later do not change a published prediction.
+			prediction.ParamOps[i] = DistributionOperation{sketch.Copy()}
+		} else {
+			prediction.ParamOps[i] = RandomOperation{}
+			prediction.IsRandom = true
+		}
+	}
+}
+
+// TopCandidates returns at most n of the most frequent values seen
+// for the argIndex-th argument, if it cannot be calculated.
+func (prediction *Prediction) TopCandidates(argIndex int, n int) []ValueCount {
+	if prediction.Sketches == nil || prediction.Sketches[argIndex] == nil {
+		return []ValueCount{}
+	}
+	return prediction.Sketches[argIndex].Top(n)
+}
+
+// MatchesStep returns true if the current prediction perfectly matches
+// the index-th step of the transaction, including every iteration of
+// the step if it is a loop, and every member issued so far if it is a group.
+// Numbers are equal if they are less than tolerance apart.
+func (prediction *Prediction) MatchesStep(trx []*Query, index int, tolerance float64) bool {
+	return prediction.matchesStep(trx, index, tolerance, false)
+}
+
+// FollowsStep returns true if the transaction goes on through the
+// prediction at the index-th step: it is MatchesStep, with the arguments
+// guessed from distributions matching any value, as the transaction
+// is the same whether the guess was right or not.
+func (prediction *Prediction) FollowsStep(trx []*Query, index int, tolerance float64) bool {
+	return prediction.matchesStep(trx, index, tolerance, true)
+}
+
+func (prediction *Prediction) matchesStep(trx []*Query, index int, tolerance float64, anyGuess bool) bool {
+	step := trx[index]
+	if prediction.IsLoop != step.IsLoop() || prediction.IsGroup() != step.IsGroup() {
+		return false
+	}
+	if prediction.IsGroup() {
+		// Members are calculated from the transaction before the group.
+		view := trx[:index:index]
+		for _, query := range step.Members {
+			member := prediction.member(query.QueryID)
+			if member == nil || !member.matchesQuery(view, query, tolerance, anyGuess) {
+				return false
+			}
+		}
+		return true
+	}
+	if !prediction.IsLoop {
+		return prediction.matchesQuery(trx, step, tolerance, anyGuess)
+	}
+	for i, iteration := range step.Iterations {
+		if !prediction.matchesQuery(iterationView(trx, index, i), iteration, tolerance, anyGuess) {
 			return false
 		}
 	}
 	return true
 }
 
+// hasIterationsLeft returns false if the rows driving the loop
+// have run out, given a transaction whose last step is the loop.
+func (prediction *Prediction) hasIterationsLeft(trx []*Query) bool {
+	for _, paramOp := range prediction.ParamOps {
+		if unary, ok := paramOp.(UnaryOperation); ok {
+			if _, ok := unary.Operand.(IterationOperand); ok && unary.GetValue(trx) == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// predictQuery returns the query with all arguments calculated
+// from the given transaction.
+func (prediction *Prediction) predictQuery(trx []*Query) *Query {
+	arguments := make([]interface{}, len(prediction.ParamOps))
+	for i, paramOp := range prediction.ParamOps {
+		arguments[i] = paramOp.GetValue(trx)
+	}
+	return &Query{QueryID: prediction.QueryID, ResultSet: [][]interface{}{}, Arguments: arguments, IsSelect: true}
+}
+
+// newEmptyLoopStep creates the step of a loop without iterations.
+func newEmptyLoopStep(queryID int, issuedAt time.Time) *Query {
+	return &Query{QueryID: queryID, ResultSet: [][]interface{}{}, Arguments: []interface{}{}, IsSelect: true, Iterations: []*Query{}, Time: issuedAt}
+}
+
+// newLoopStep creates a loop step out of its iterations.
+func newLoopStep(iterations []*Query) *Query {
+	first := iterations[0]
+	return &Query{QueryID: first.QueryID, ResultSet: first.ResultSet, Arguments: first.Arguments, IsSelect: first.IsSelect,
+		Iterations: append([]*Query{}, iterations...), Time: first.Time}
+}
+
+// newGroupStep creates a group step out of the reads issued so far,
+// in any order.
+func newGroupStep(members []*Query) *Query {
+	sorted := append([]*Query{}, members...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].QueryID < sorted[j].QueryID
+	})
+	issuedAt := members[0].Time
+	for _, member := range members {
+		if !member.Time.IsZero() && (issuedAt.IsZero() || member.Time.Before(issuedAt)) {
+			issuedAt = member.Time
+		}
+	}
+	return &Query{QueryID: sorted[0].QueryID, ResultSet: [][]interface{}{}, Arguments: []interface{}{}, IsSelect: true, Time: issuedAt, Members: sorted}
+}
+
+// iterationView returns the transaction as seen right before the
+// iteration-th iteration of the loop at loopIndex is issued.
+func iterationView(trx []*Query, loopIndex int, iteration int) []*Query {
+	loop := trx[loopIndex]
+	view := make([]*Query, loopIndex+1)
+	copy(view, trx[:loopIndex])
+	view[loopIndex] = &Query{QueryID: loop.QueryID, ResultSet: loop.ResultSet, Arguments: loop.Arguments, IsSelect: loop.IsSelect,
+		Iterations: loop.Iterations[:iteration], Time: loop.Time}
+	return view
+}
+
 // PredictionTrees contains all the trees for prediction
 type PredictionTrees struct {
 	trees map[int]*Node
+	// Options are the options the trees were last updated with,
+	// or nil if they have not been.
+	Options *ModelBuilderOptions
+	// Split is the split strategy an Evaluator trained the trees
+	// with, or empty if they were not trained by one.
+	Split string
 }
 
 // NewPredictionTrees creates a new prediciton tree.
 func NewPredictionTrees() *PredictionTrees {
-	return &PredictionTrees{make(map[int]*Node)}
+	return &PredictionTrees{make(map[int]*Node), nil, ""}
+}
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (clock systemClock) Now() time.Time {
+	return time.Now()
 }
 
 // Predictor does prediction using the prediction trees.
@@ -103,6 +642,41 @@ type Predictor struct {
 	currentTrx  []*Query
 	queryParser *QueryParser
 	manager     QueryManager
+	clock       Clock
+	// lastCandidates are the candidates returned by the last
+	// prediction, whose outcomes are recorded by MoveToNext.
+	lastCandidates []*Candidate
+	// rawTrx contains all the queries of the current transaction,
+	// even after the transaction has left the tree.
+	rawTrx []*Query
+	// learner is only set in online mode.
+	learner     *ModelBuilder
+	minExamples int
+	// examples keeps the transactions that went through each node
+	// created online, until there are enough to search for operands.
+	examples map[*Node][][]*Query
+	// touched, if not nil, collects the nodes whose predictions
+	// learning changed.
+	touched map[*Node]bool
+	// monitor, if set, gets the outcome of the prediction made by
+	// PredictNextQuery at predictedAt, if predicted, for the next query.
+	monitor        *HealthMonitor
+	predicted      bool
+	predictedAt    *Node
+	lastPrediction *Query
+	// shared, if set, is the model the trees are the version of. The
+	// speculation outcomes are kept in outcomes until they are reported.
+	shared   *SharedModel
+	version  uint64
+	outcomes map[*Prediction]speculationOutcome
+	// predictWrites makes PredictNextQuery return writes as well.
+	predictWrites bool
+}
+
+// SetClock sets the clock used to stamp the queries without a Time,
+// which defaults to the system clock.
+func (pt *Predictor) SetClock(clock Clock) {
+	pt.clock = clock
 }
 
 // PrintCurrentTree prints out the tree in a pretty format.
@@ -123,84 +697,594 @@ func (pt *Predictor) PredictNextSQL() string {
 	return fillTemplate(query.QueryID, pt.manager, query.Arguments)
 }
 
-// PredictNextQuery returns the most possible next query.
-func (pt *Predictor) PredictNextQuery() *Query {
-	if pt.currentNode == nil ||
-		len(pt.currentNode.Children) == 0 {
-		pt.currentNode = nil
+// inLoop returns true if the current node is a loop and the
+// current transaction is in the middle of it.
+func (pt *Predictor) inLoop() bool {
+	if pt.currentNode == nil || len(pt.currentTrx) == 0 {
+		return false
+	}
+	return pt.currentNode.Payload.(*Prediction).IsLoop &&
+		pt.currentTrx[len(pt.currentTrx)-1].IsLoop()
+}
+
+// inGroup returns true if the current node is a group and the current
+// transaction has issued some but not all of its reads.
+func (pt *Predictor) inGroup() bool {
+	if pt.currentNode == nil || len(pt.currentTrx) == 0 {
+		return false
+	}
+	prediction := pt.currentNode.Payload.(*Prediction)
+	step := pt.currentTrx[len(pt.currentTrx)-1]
+	return prediction.IsGroup() && step.IsGroup() && len(step.Members) < len(prediction.Members)
+}
+
+// predictNextIteration returns the next iteration of the loop in
+// progress, or nil if there is none.
+func (pt *Predictor) predictNextIteration() *Query {
+	if !pt.inLoop() {
 		return nil
 	}
-	queryFrequencies := make(map[int]int)
-	mostFrequentQuery := -1
-	for _, child := range pt.currentNode.Children {
-		queryID := child.Payload.(*Prediction).QueryID
-		queryFrequencies[queryID]++
-		if queryFrequencies[queryID] > queryFrequencies[mostFrequentQuery] {
-			mostFrequentQuery = queryID
+	prediction := pt.currentNode.Payload.(*Prediction)
+	if prediction.IsRandom || !prediction.hasIterationsLeft(pt.currentTrx) {
+		return nil
+	}
+	return prediction.predictQuery(pt.currentTrx)
+}
+
+// nextStepView returns the transaction against which the arguments
+// of the prediction for the next step should be calculated.
+func (pt *Predictor) nextStepView(prediction *Prediction) []*Query {
+	return stepView(pt.currentTrx, prediction)
+}
+
+// stepView returns the transaction against which the arguments of the
+// prediction for the step following trx should be calculated.
+func stepView(trx []*Query, prediction *Prediction) []*Query {
+	if !prediction.IsLoop {
+		return trx
+	}
+	return append(trx[:len(trx):len(trx)], newEmptyLoopStep(prediction.QueryID, time.Time{}))
+}
+
+// Candidate is a possible next query together with the
+// probability that it is exactly the next query issued.
+type Candidate struct {
+	Query       *Query
+	Probability float64
+	// Unsafe is true if the query is not a read, so it must not be
+	// executed speculatively. Its Query is not IsSelect either.
+	Unsafe bool
+	node   *Node
+}
+
+// nextQueryProbabilities returns, for each query that may follow
+// the node, the probability that it is the next one, given the
+// results in trx if the node has a decision and trx is not nil.
+func nextQueryProbabilities(node *Node, trx []*Query) map[int]float64 {
+	probabilities := make(map[int]float64)
+	prediction := node.Payload.(*Prediction)
+	transitions := prediction.Transitions
+	if prediction.Decision != nil && trx != nil {
+		if decided := prediction.Decision.Transitions(trx); len(decided) > 0 {
+			transitions = decided
 		}
 	}
-	if !strings.HasPrefix(pt.manager.GetTemplate(mostFrequentQuery), "SELECT") {
-		return nil
+	if len(transitions) == 0 {
+		// No transition has been recorded, so fall back to counting the children.
+		transitions = make(map[int]int)
+		for _, child := range node.Children {
+			transitions[child.Payload.(*Prediction).QueryID]++
+		}
+	}
+	total := 0
+	for _, count := range transitions {
+		total += count
+	}
+	for queryID, count := range transitions {
+		probabilities[queryID] = float64(count) / float64(total)
+	}
+	return probabilities
+}
+
+// mostLikelyQuery returns the query most likely to follow the node,
+// given the results in trx.
+func mostLikelyQuery(node *Node, trx []*Query) int {
+	probabilities := nextQueryProbabilities(node, trx)
+	mostLikely := -1
+	for queryID, probability := range probabilities {
+		if mostLikely == -1 || probability > probabilities[mostLikely] ||
+			(probability == probabilities[mostLikely] && queryID < mostLikely) {
+			mostLikely = queryID
+		}
+	}
+	return mostLikely
+}
+
+// groupCandidates returns a candidate for each read of the group at the
+// node that is not among the issued ones and can be predicted from trx, the
+// transaction before the group. The reads left are equally likely to come
+// next, given that the group is next with the given probability, and that
+// it followed its parent trials times in training.
+func groupCandidates(node *Node, trx []*Query, issued []*Query, probability float64) []*Candidate {
+	prediction := node.Payload.(*Prediction)
+	remaining := []*Prediction{}
+	for _, member := range prediction.Members {
+		found := false
+		for _, query := range issued {
+			if query.QueryID == member.QueryID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			remaining = append(remaining, member)
+		}
+	}
+	candidates := []*Candidate{}
+	for _, member := range remaining {
+		if member.IsRandom {
+			continue
+		}
+		probability := probability * member.Confidence() / float64(len(remaining))
+		candidates = append(candidates, &Candidate{member.predictQuery(trx), probability, false, node})
 	}
-	var maxHitChild *Node
-	maxHitChild = nil
+	sortCandidates(candidates)
+	return candidates
+}
+
+// predictGroupMembers returns the reads of the group in progress
+// that have not been issued yet.
+func (pt *Predictor) predictGroupMembers() []*Candidate {
+	group := pt.currentTrx[len(pt.currentTrx)-1]
+	return groupCandidates(pt.currentNode, pt.currentTrx[:len(pt.currentTrx)-1], group.Members, 1)
+}
+
+// bestCandidates returns, for each query that may follow the node and
+// whose arguments can be calculated from trx, the most likely candidate.
+// The candidates are sorted, most likely first.
+func bestCandidates(node *Node, trx []*Query) []*Candidate {
+	candidates := []*Candidate{}
+	if node == nil || len(node.Children) == 0 {
+		return candidates
+	}
+	probabilities := nextQueryProbabilities(node, trx)
+	best := make(map[int]*Candidate)
+	for _, child := range node.Children {
+		prediction := child.Payload.(*Prediction)
+		if prediction.IsRandom {
+			continue
+		}
+		if prediction.IsGroup() {
+			for _, candidate := range groupCandidates(child, trx, nil, probabilities[prediction.QueryID]) {
+				if chosen, ok := best[candidate.Query.QueryID]; !ok || chosen.Probability < candidate.Probability {
+					best[candidate.Query.QueryID] = candidate
+				}
+			}
+			continue
+		}
+		probability := probabilities[prediction.QueryID] * prediction.Confidence()
+		if candidate, ok := best[prediction.QueryID]; !ok || candidate.Probability < probability {
+			best[prediction.QueryID] = &Candidate{nil, probability, false, child}
+		}
+	}
+	for _, candidate := range best {
+		if candidate.Query == nil {
+			prediction := candidate.node.Payload.(*Prediction)
+			candidate.Query = prediction.predictQuery(stepView(trx, prediction))
+		}
+		candidates = append(candidates, candidate)
+	}
+	sortCandidates(candidates)
+	return candidates
+}
+
+// PredictNext returns all the possible next queries whose arguments
+// can be calculated, most likely first. Writes are left out unless
+// write prediction is enabled.
+func (pt *Predictor) PredictNext() []*Candidate {
+	pt.lastCandidates = pt.flagWrites(pt.predictNext())
+	return pt.lastCandidates
+}
+
+func (pt *Predictor) predictNext() []*Candidate {
+	if pt.speculationDisabled() {
+		pt.lastCandidates = []*Candidate{}
+		return pt.lastCandidates
+	}
+	if query := pt.predictNextIteration(); query != nil {
+		prediction := pt.currentNode.Payload.(*Prediction)
+		pt.lastCandidates = []*Candidate{&Candidate{query, prediction.Confidence(), false, pt.currentNode}}
+		return pt.lastCandidates
+	}
+	if pt.inGroup() {
+		pt.lastCandidates = pt.predictGroupMembers()
+		return pt.lastCandidates
+	}
+	pt.lastCandidates = bestCandidates(pt.currentNode, pt.currentTrx)
+	return pt.lastCandidates
+}
+
+// PredictAhead returns at most n queries predicted to follow the current
+// one, one after another along the most likely path. It stops at the first
+// query that is a loop or part of an unordered group, whose arguments depend
+// on the result of a query that has only been predicted, or that a decision
+// picks from such a result. results[i], if given and not nil, is the
+// result of the i-th predicted query, e.g., obtained by executing it
+// speculatively, which lets the chain go further. The probability of each
+// query is that of the whole chain up to it. It also stops at the first
+// write unless write prediction is enabled.
+func (pt *Predictor) PredictAhead(n int, results ...[][]interface{}) []*Candidate {
+	chain := []*Candidate{}
+	if pt.inLoop() || pt.inGroup() || pt.speculationDisabled() {
+		return chain
+	}
+	node := pt.currentNode
+	trx := pt.currentTrx[:len(pt.currentTrx):len(pt.currentTrx)]
+	// unknown contains the indexes of the steps whose results are unknown.
+	unknown := make(map[int]bool)
+	probability := 1.0
+	for len(chain) < n {
+		if decision := node.Payload.(*Prediction).Decision; decision != nil && dependsOnAny(decision.Predicate, unknown) {
+			// The branch depends on a result that is unknown.
+			break
+		}
+		candidates := bestCandidates(node, trx)
+		if len(candidates) == 0 || candidates[0].Query.QueryID != mostLikelyQuery(node, trx) {
+			// The most likely query cannot be predicted.
+			break
+		}
+		candidate := candidates[0]
+		prediction := candidate.node.Payload.(*Prediction)
+		if prediction.IsLoop || prediction.IsGroup() || prediction.dependsOnAny(unknown) ||
+			(!pt.predictWrites && !pt.isRead(prediction.QueryID)) {
+			break
+		}
+		probability *= candidate.Probability
+		chain = append(chain, &Candidate{candidate.Query, probability, false, candidate.node})
+		step := &Query{QueryID: candidate.Query.QueryID, ResultSet: [][]interface{}{}, Arguments: candidate.Query.Arguments, IsSelect: candidate.Query.IsSelect}
+		if len(results) >= len(chain) && results[len(chain)-1] != nil {
+			step.ResultSet = results[len(chain)-1]
+		} else {
+			unknown[len(trx)] = true
+		}
+		trx = append(trx, step)
+		node = candidate.node
+	}
+	return pt.flagWrites(chain)
+}
+
+// expandCandidates returns the queries the prediction of the child may
+// give, at most k of them, each with the given probability scaled by the
+// frequencies of the values guessed for the arguments that cannot be
+// calculated. The confidence of a distribution already is the frequency
+// of its most frequent value, so its other values are scaled relative to
+// it, while the values of a random argument are scaled by their frequency.
+func (pt *Predictor) expandCandidates(child *Node, probability float64, k int) []*Candidate {
+	prediction := child.Payload.(*Prediction)
+	trx := pt.nextStepView(prediction)
+	candidates := []*Candidate{&Candidate{&Query{QueryID: prediction.QueryID, ResultSet: [][]interface{}{}, Arguments: []interface{}{}, IsSelect: true}, probability, false, child}}
+	for i, paramOp := range prediction.ParamOps {
+		values := []ValueCount{ValueCount{paramOp.GetValue(trx), 1}}
+		total := 1
+		switch paramOp.(type) {
+		case DistributionOperation:
+			values = prediction.TopCandidates(i, k)
+			if len(values) > 0 {
+				total = values[0].Count
+			}
+		case RandomOperation:
+			values = prediction.TopCandidates(i, k)
+			if len(values) > 0 {
+				total = prediction.Sketches[i].Total()
+			}
+		}
+		expanded := make([]*Candidate, 0, len(candidates)*len(values))
+		for _, candidate := range candidates {
+			for _, value := range values {
+				arguments := append(candidate.Query.Arguments[:i:i], value.Value)
+				query := &Query{QueryID: prediction.QueryID, ResultSet: [][]interface{}{}, Arguments: arguments, IsSelect: true}
+				expanded = append(expanded, &Candidate{query, candidate.Probability * float64(value.Count) / float64(total), false, child})
+			}
+		}
+		sortCandidates(expanded)
+		if len(expanded) > k {
+			expanded = expanded[:k]
+		}
+		candidates = expanded
+	}
+	return candidates
+}
+
+func sortCandidates(candidates []*Candidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		candidate1 := candidates[i]
+		candidate2 := candidates[j]
+		return candidate1.Probability > candidate2.Probability ||
+			(candidate1.Probability == candidate2.Probability && candidate1.Query.QueryID < candidate2.Query.QueryID)
+	})
+}
+
+// PredictTopK returns at most k distinct next queries whose arguments
+// can be calculated or guessed, across all the predictions for all the
+// possible next queries, most likely first. Writes are left out unless
+// write prediction is enabled.
+func (pt *Predictor) PredictTopK(k int) []*Candidate {
+	pt.lastCandidates = pt.flagWrites(pt.predictTopK(k))
+	return pt.lastCandidates
+}
+
+func (pt *Predictor) predictTopK(k int) []*Candidate {
+	pt.lastCandidates = []*Candidate{}
+	if k <= 0 || pt.speculationDisabled() {
+		return pt.lastCandidates
+	}
+	if query := pt.predictNextIteration(); query != nil {
+		prediction := pt.currentNode.Payload.(*Prediction)
+		pt.lastCandidates = append(pt.lastCandidates, &Candidate{query, prediction.Confidence(), false, pt.currentNode})
+		return pt.lastCandidates
+	}
+	if pt.inGroup() {
+		pt.lastCandidates = pt.predictGroupMembers()
+		if len(pt.lastCandidates) > k {
+			pt.lastCandidates = pt.lastCandidates[:k]
+		}
+		return pt.lastCandidates
+	}
+	if pt.currentNode == nil || len(pt.currentNode.Children) == 0 {
+		return pt.lastCandidates
+	}
+	probabilities := nextQueryProbabilities(pt.currentNode, pt.currentTrx)
+	all := []*Candidate{}
 	for _, child := range pt.currentNode.Children {
-		if !child.Payload.(*Prediction).IsRandom &&
-			(maxHitChild == nil ||
-				maxHitChild.Payload.(*Prediction).QueryID != mostFrequentQuery ||
-				maxHitChild.Payload.(*Prediction).HitCount < child.Payload.(*Prediction).HitCount) {
-			maxHitChild = child
+		prediction := child.Payload.(*Prediction)
+		if prediction.IsGroup() {
+			all = append(all, groupCandidates(child, pt.currentTrx, nil, probabilities[prediction.QueryID])...)
+			continue
 		}
+		// The random arguments are guessed from the values seen for them.
+		probability := probabilities[prediction.QueryID] * prediction.Confidence()
+		all = append(all, pt.expandCandidates(child, probability, k)...)
 	}
-	if maxHitChild == nil {
-		maxHitChild = pt.currentNode.Children[0]
-		for _, child := range pt.currentNode.Children {
-			if maxHitChild.Payload.(*Prediction).QueryID != mostFrequentQuery ||
-				maxHitChild.Payload.(*Prediction).HitCount < child.Payload.(*Prediction).HitCount {
-				maxHitChild = child
+	sortCandidates(all)
+	for _, candidate := range all {
+		duplicate := false
+		for _, chosen := range pt.lastCandidates {
+			if chosen.Query.Same(candidate.Query) {
+				duplicate = true
+				break
 			}
 		}
+		if !duplicate && (pt.predictWrites || pt.isRead(candidate.Query.QueryID)) {
+			pt.lastCandidates = append(pt.lastCandidates, candidate)
+		}
+		if len(pt.lastCandidates) == k {
+			break
+		}
 	}
-	prediction := maxHitChild.Payload.(*Prediction)
-	if prediction.IsRandom {
+	return pt.lastCandidates
+}
+
+// EnableWritePrediction makes the predictions include the queries that
+// are not reads. Such a query is not IsSelect, and its candidate is
+// Unsafe: it must not be executed speculatively, but it can be prepared,
+// or its locks acquired ahead.
+func (pt *Predictor) EnableWritePrediction() {
+	pt.predictWrites = true
+}
+
+// lockingClauses turn a SELECT into a locking read, which is not
+// safe to issue ahead either.
+var lockingClauses = []string{"FOR UPDATE", "FOR SHARE", "LOCK IN SHARE MODE"}
+
+// isRead returns true if the query is a read that takes no locks.
+func (pt *Predictor) isRead(queryID int) bool {
+	return isReadTemplate(pt.manager.GetTemplate(queryID))
+}
+
+// isReadTemplate returns true if the template is a SELECT without
+// a locking clause, in any case.
+func isReadTemplate(template string) bool {
+	normalized := strings.ToUpper(strings.Join(strings.Fields(template), " "))
+	if !strings.HasPrefix(normalized, "SELECT") {
+		return false
+	}
+	for _, clause := range lockingClauses {
+		if strings.Contains(normalized, clause) {
+			return false
+		}
+	}
+	return true
+}
+
+// flagWrites flags the candidates whose queries are not reads as unsafe,
+// and leaves them out unless write prediction is enabled.
+func (pt *Predictor) flagWrites(candidates []*Candidate) []*Candidate {
+	flagged := make([]*Candidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		candidate.Query.IsSelect = pt.isRead(candidate.Query.QueryID)
+		candidate.Unsafe = !candidate.Query.IsSelect
+		if pt.predictWrites || !candidate.Unsafe {
+			flagged = append(flagged, candidate)
+		}
+	}
+	return flagged
+}
+
+// PredictNextQuery returns the most possible next query. It returns nil
+// if its arguments cannot be calculated, or if it is not a read unless
+// write prediction is enabled.
+func (pt *Predictor) PredictNextQuery() *Query {
+	if candidate := pt.predictNextCandidate(); candidate != nil {
+		return candidate.Query
+	}
+	return nil
+}
+
+// predictNextCandidate returns the candidate of the query
+// returned by PredictNextQuery, or nil.
+func (pt *Predictor) predictNextCandidate() *Candidate {
+	pt.predicted = pt.monitor != nil && len(pt.currentTrx) > 0 && !pt.speculationDisabled()
+	pt.predictedAt = pt.currentNode
+	pt.lastPrediction = nil
+	candidates := pt.PredictNext()
+	if (pt.inLoop() || pt.inGroup()) && len(candidates) > 0 {
+		pt.lastPrediction = candidates[0].Query
+		return candidates[0]
+	}
+	if pt.currentNode == nil || len(pt.currentNode.Children) == 0 {
 		return nil
 	}
-	arguments := make([]interface{}, len(prediction.ParamOps))
-	for i, paramOp := range prediction.ParamOps {
-		arguments[i] = paramOp.GetValue(pt.currentTrx)
+	mostLikelyQuery := mostLikelyQuery(pt.currentNode, pt.currentTrx)
+	if !pt.predictWrites && !pt.isRead(mostLikelyQuery) {
+		return nil
+	}
+	for _, candidate := range candidates {
+		// A group goes by its first member, which may be random, so
+		// its most likely member that can be predicted is taken instead.
+		prediction := candidate.node.Payload.(*Prediction)
+		if candidate.Query.QueryID == mostLikelyQuery || (prediction.IsGroup() && prediction.QueryID == mostLikelyQuery) {
+			pt.lastPrediction = candidate.Query
+			return candidate
+		}
+	}
+	return nil
+}
+
+// recordOutcome updates the hits and misses of the predictions
+// made for the query that turns out to be the given one.
+func (pt *Predictor) recordOutcome(query *Query) {
+	// A prediction expanded into several candidates has a single
+	// outcome, a hit if any of them is the query.
+	predictions := []*Prediction{}
+	hit := make(map[*Prediction]bool)
+	for _, candidate := range pt.lastCandidates {
+		if candidate.Query.QueryID != query.QueryID {
+			continue
+		}
+		prediction := candidate.node.Payload.(*Prediction)
+		if prediction.IsGroup() {
+			prediction = prediction.member(query.QueryID)
+		}
+		if _, ok := hit[prediction]; !ok {
+			predictions = append(predictions, prediction)
+		}
+		hit[prediction] = hit[prediction] || candidate.Query.Same(query)
+	}
+	for _, prediction := range predictions {
+		if pt.shared != nil {
+			// The trees are shared, so the outcome is left to the trainer.
+			outcome := pt.outcomes[prediction]
+			if hit[prediction] {
+				outcome.hits++
+			} else {
+				outcome.misses++
+			}
+			pt.outcomes[prediction] = outcome
+		} else if hit[prediction] {
+			prediction.SpeculationHits++
+		} else {
+			prediction.SpeculationMisses++
+		}
 	}
-	return &Query{prediction.QueryID, [][]interface{}{}, arguments, true}
+	pt.lastCandidates = nil
 }
 
-// MoveToNext query.
+// MoveToNext query. A query without a Time is kept with the current
+// time of the clock, the query given being left as is.
 func (pt *Predictor) MoveToNext(query *Query) {
+	if query.Time.IsZero() {
+		stamped := *query
+		stamped.Time = pt.clock.Now()
+		query = &stamped
+	}
+	pt.recordOutcome(query)
 	sql := query.GetSQL(pt.manager)
+	if pt.predicted && sql != "BEGIN" && sql != "COMMIT" {
+		pt.monitor.record(pt.currentTrx[0].QueryID, pt.predictedAt, pt.version, query.Same(pt.lastPrediction))
+	}
+	pt.predicted = false
 	if sql == "BEGIN" || sql == "COMMIT" {
+		// The boundaries are not part of the transactions the trees are built from.
+		pt.finishTransaction()
 		pt.currentTrx = []*Query{}
 		pt.currentNode = nil
 		pt.newTrx = true
+		return
 	}
+	pt.rawTrx = append(pt.rawTrx, query)
 	if pt.currentNode == nil && pt.newTrx {
 		pt.newTrx = false
 		pt.currentTrx = append(pt.currentTrx, query)
-		pt.currentNode = pt.pt.GetTreeWithRoot(query.QueryID, len(query.Arguments))
+		if pt.shared != nil {
+			// The trees are read-only, so a transaction without one predicts nothing.
+			pt.pinSnapshot()
+			pt.currentNode = pt.pt.trees[query.QueryID]
+		} else {
+			pt.currentNode = pt.pt.GetTreeWithRoot(query.QueryID, len(query.Arguments))
+		}
+		pt.enterEmptyLoop()
 		return
 	}
 	if pt.currentNode == nil {
 		return
 	}
-	pt.currentTrx = append(pt.currentTrx, query)
+	if pt.inLoop() && pt.currentNode.Payload.(*Prediction).QueryID == query.QueryID {
+		loop := pt.currentTrx[len(pt.currentTrx)-1]
+		loop.Iterations = append(loop.Iterations, query)
+		return
+	}
+	if pt.inGroup() {
+		index := len(pt.currentTrx) - 1
+		pt.currentTrx[index] = newGroupStep(append(pt.currentTrx[index].Members, query))
+		if !pt.currentNode.Payload.(*Prediction).FollowsStep(pt.currentTrx, index, pt.tolerance()) {
+			// The query is not one of the reads left, so the transaction leaves the tree.
+			pt.currentNode = nil
+		}
+		return
+	}
 	children := pt.currentNode.Children
 	pt.currentNode = nil
+	currentStep := query
 	for _, child := range children {
 		prediction := child.Payload.(*Prediction)
-		if !prediction.MatchesQuery(pt.currentTrx, query) {
+		step := query
+		if prediction.IsLoop {
+			step = newLoopStep([]*Query{query})
+		} else if prediction.IsGroup() {
+			step = newGroupStep([]*Query{query})
+		}
+		trx := append(pt.currentTrx[:len(pt.currentTrx):len(pt.currentTrx)], step)
+		if !prediction.FollowsStep(trx, len(trx)-1, pt.tolerance()) {
 			continue
 		}
 		if pt.currentNode == nil ||
 			prediction.HitCount > pt.currentNode.Payload.(*Prediction).HitCount {
 			pt.currentNode = child
+			currentStep = step
+		}
+	}
+	pt.currentTrx = append(pt.currentTrx, currentStep)
+	pt.enterEmptyLoop()
+}
+
+// enterEmptyLoop moves into the loop following the current node if the
+// rows driving it have run out before its first iteration, so that the
+// query after the loop is the one predicted next.
+func (pt *Predictor) enterEmptyLoop() {
+	for pt.currentNode != nil {
+		var next *Node
+		for _, child := range pt.currentNode.Children {
+			prediction := child.Payload.(*Prediction)
+			if prediction.IsLoop && !prediction.IsRandom && !prediction.hasIterationsLeft(stepView(pt.currentTrx, prediction)) &&
+				(next == nil || prediction.HitCount > next.Payload.(*Prediction).HitCount) {
+				next = child
+			}
+		}
+		if next == nil {
+			return
 		}
+		pt.currentTrx = stepView(pt.currentTrx, next.Payload.(*Prediction))
+		pt.currentNode = next
 	}
 }
 
@@ -213,14 +1297,151 @@ func (pt *Predictor) PrintCurrntTrx() {
 
 // EndTransaction ends the current transaction
 func (pt *Predictor) EndTransaction() {
+	pt.finishTransaction()
+	pt.lastCandidates = nil
+	pt.predicted = false
 	pt.currentNode = nil
 	pt.newTrx = true
 	pt.currentTrx = []*Query{}
 }
 
+// finishTransaction learns from the queries of the transaction, or reports
+// them to the shared model, and forgets them.
+func (pt *Predictor) finishTransaction() {
+	if pt.shared != nil {
+		pt.reportShared(pt.rawTrx)
+	} else if pt.learner != nil {
+		pt.learn(pt.rawTrx)
+	}
+	pt.rawTrx = []*Query{}
+}
+
+// EnableOnlineLearning makes the predictor learn from every transaction
+// ended with EndTransaction: unseen paths are added to the trees right
+// away, and the operands for the arguments of a new node are searched
+// using the builder once minExamples transactions have gone through it.
+// Predictors of a SharedModel learn through SharedModel.EnableOnlineLearning.
+func (pt *Predictor) EnableOnlineLearning(builder *ModelBuilder, minExamples int) {
+	pt.learner = builder
+	pt.minExamples = minExamples
+	pt.examples = make(map[*Node][][]*Query)
+}
+
+// learn updates the prediction trees with a finished transaction.
+func (pt *Predictor) learn(raw []*Query) {
+	if len(raw) == 0 {
+		return
+	}
+	trx := pt.learner.foldSteps(raw)
+	root := pt.pt.GetTreeWithRoot(trx[0].QueryID, len(trx[0].Arguments))
+	pt.learnSteps(trx, 1, []*Node{root})
+}
+
+// learnSteps trains the children of the nodes reached by the steps before
+// the queryIndex-th one, like updatePrefix does: every child matching the
+// step is hit and followed, and a random child is added to the nodes
+// without one.
+func (pt *Predictor) learnSteps(trx []*Query, queryIndex int, level []*Node) {
+	tolerance := pt.learner.Options.FloatTolerance
+	for i := queryIndex; i < len(trx) && len(level) > 0; i++ {
+		step := trx[i]
+		nextLevel := []*Node{}
+		for _, node := range level {
+			node.Payload.(*Prediction).AddTransitions(step.QueryID, 1)
+			pt.touch(node)
+			matched := []*Node{}
+			for _, child := range node.Children {
+				prediction := child.Payload.(*Prediction)
+				if prediction.QueryID == step.QueryID && prediction.IsLoop == step.IsLoop() && prediction.IsGroup() == step.IsGroup() {
+					prediction.Trial()
+					pt.touch(child)
+				}
+				if prediction.FollowsStep(trx, i, tolerance) {
+					matched = append(matched, child)
+				}
+			}
+			if len(matched) == 0 {
+				child := NewNode(newRandomStepPrediction(step), node)
+				child.Payload.(*Prediction).Trial()
+				node.AddChildren([]*Node{child})
+				pt.examples[child] = [][]*Query{}
+				matched = append(matched, child)
+			}
+			for _, child := range matched {
+				pt.touch(child)
+				prediction := child.Payload.(*Prediction)
+				if prediction.MatchesStep(trx, i, tolerance) {
+					prediction.Hit()
+				}
+				prediction.Observe(trx, i)
+				if examples, ok := pt.examples[child]; ok {
+					pt.examples[child] = append(examples, trx)
+					if len(pt.examples[child]) >= pt.minExamples {
+						pt.searchOperands(child, i)
+					}
+				}
+			}
+			nextLevel = append(nextLevel, matched...)
+			if len(nextLevel) > pt.learner.Options.MaxLevelNodes {
+				break
+			}
+		}
+		level = nextLevel
+	}
+}
+
+// touch records that learning changed the prediction of the node.
+func (pt *Predictor) touch(node *Node) {
+	if pt.touched != nil {
+		pt.touched[node] = true
+	}
+}
+
+// searchOperands searches for the operands of the node created online,
+// using the transactions that went through it, and adds the predictions
+// found next to it, trained with the same transactions.
+func (pt *Predictor) searchOperands(node *Node, queryIndex int) {
+	examples := pt.examples[node]
+	delete(pt.examples, node)
+	numOps, strOps, numListOps, strListOps := pt.learner.operandWindows(examples[0], queryIndex)
+	sample := examples[:min(pt.learner.Options.SampleSize, len(examples))]
+	candidates := pt.learner.enumerateStepPredictions(node.Parent, sample, queryIndex, numOps, strOps, numListOps, strListOps)
+	for _, candidate := range candidates {
+		prediction := candidate.Payload.(*Prediction)
+		if prediction.IsRandom {
+			continue
+		}
+		matched := [][]*Query{}
+		for _, trx := range examples {
+			prediction.Trial()
+			if prediction.MatchesStep(trx, queryIndex, pt.learner.Options.FloatTolerance) {
+				prediction.Hit()
+				prediction.Observe(trx, queryIndex)
+				matched = append(matched, trx)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		node.Parent.AddChildren([]*Node{candidate})
+		for _, trx := range matched {
+			pt.learnSteps(trx, queryIndex+1, []*Node{candidate})
+		}
+	}
+}
+
 // NewPredictor creates predictor using the this prediction tree
 func (pt *PredictionTrees) NewPredictor(manager QueryManager) *Predictor {
-	return &Predictor{pt, true, nil, []*Query{}, NewQueryParser(manager), manager}
+	return &Predictor{pt: pt, newTrx: true, currentTrx: []*Query{}, queryParser: NewQueryParser(manager), manager: manager,
+		clock: systemClock{}, rawTrx: []*Query{}}
+}
+
+// tolerance returns the float tolerance the trees were trained with.
+func (pt *Predictor) tolerance() float64 {
+	if pt.pt.Options == nil {
+		return defaultFloatTolerance
+	}
+	return pt.pt.Options.FloatTolerance
 }
 
 // GetTreeWithRoot returns the tree with the given query as root
@@ -233,6 +1454,49 @@ func (pt *PredictionTrees) GetTreeWithRoot(queryID int, numOps int) *Node {
 	return tree
 }
 
+// ModelBuilderOptions are the knobs of the training. Start from
+// DefaultModelBuilderOptions, as the zero value trains nothing useful.
+type ModelBuilderOptions struct {
+	// LookBack is the number of the last queries, counting the query
+	// itself, whose operands are searched for its arguments. Defaults to 7.
+	LookBack int `json:"lookBack"`
+	// SampleSize is the number of transactions the predictions of a
+	// step are enumerated from, the others only verify them. Defaults to 10.
+	SampleSize int `json:"sampleSize"`
+	// MaxLevelNodes caps the nodes of a tree level reached while
+	// training, the rest of the level is left untrained. Defaults to 10000.
+	MaxLevelNodes int `json:"maxLevelNodes"`
+	// FloatTolerance is how far apart two numbers can be and still be
+	// equal when an operand is matched against an argument, a key against
+	// a result, or a line fitted by an affine operand. Defaults to 0.00001.
+	FloatTolerance float64 `json:"floatTolerance"`
+	// ClusterSingle views all consecutive single query transactions
+	// as one single transaction. Defaults to true.
+	ClusterSingle bool `json:"clusterSingle"`
+	// Pruning is applied to the trees while they are updated.
+	// Defaults to no pruning.
+	Pruning PruneOptions `json:"pruning"`
+	// DecisionLookBack is the number of the last queries whose results
+	// LearnDecisions searches for predicates. Defaults to 7.
+	DecisionLookBack int `json:"decisionLookBack"`
+	// MaxGaps is the number of optional queries by which the transaction
+	// types merged by FuzzyClusterTransactions may differ. Defaults to 1.
+	MaxGaps int `json:"maxGaps"`
+}
+
+// DefaultModelBuilderOptions returns the default options.
+func DefaultModelBuilderOptions() ModelBuilderOptions {
+	return ModelBuilderOptions{LookBack: 7, SampleSize: 10, MaxLevelNodes: 10000, FloatTolerance: defaultFloatTolerance, ClusterSingle: true,
+		DecisionLookBack: 7, MaxGaps: 1}
+}
+
+// ToString returns a string representation of these options.
+func (options *ModelBuilderOptions) ToString() string {
+	return fmt.Sprintf("look back %d, sample %d, %d nodes per level, tolerance %v, cluster single %v, pruning %+v, decision look back %d, max gaps %d",
+		options.LookBack, options.SampleSize, options.MaxLevelNodes, options.FloatTolerance, options.ClusterSingle, options.Pruning,
+		options.DecisionLookBack, options.MaxGaps)
+}
+
 // ModelBuilder takes in a workload trace and generates a prediciton
 // model from it.
 type ModelBuilder struct {
@@ -240,22 +1504,40 @@ type ModelBuilder struct {
 	Queries      []*Query
 	Transactions [][]*Query
 	Clusters     [][][]*Query
+	// Groups are the sets of query IDs of the reads that are issued
+	// in different orders, which are folded into unordered group steps.
+	Groups []*UnorderedSet
+	// loops holds, by the query they follow, the loops issued once per
+	// row of an earlier result, so that the runs of fewer than two
+	// iterations can be folded like the longer ones.
+	loops map[int][]loopDefinition
+	// Options are used by UpdateModel, and can be changed between
+	// updates, except ClusterSingle which only applies when the trace
+	// is split. PruneReport tells what has been pruned so far.
+	Options     ModelBuilderOptions
+	PruneReport PruneReport
 }
 
 // NewModelBuilder creates a new ModelBuilder
-func NewModelBuilder(path string) *ModelBuilder {
-	builder := &ModelBuilder{NewQuerySet(), []*Query{}, [][]*Query{}, [][][]*Query{}}
+func NewModelBuilder(path string, options ModelBuilderOptions) *ModelBuilder {
+	builder := &ModelBuilder{QuerySet: NewQuerySet(), Queries: []*Query{}, Transactions: [][]*Query{}, Clusters: [][][]*Query{},
+		Groups: []*UnorderedSet{}, loops: make(map[int][]loopDefinition), Options: options}
 	builder.parseQueriesFromFile(path)
-	builder.splitTransactions(true)
+	builder.splitTransactions(options.ClusterSingle)
+	builder.detectLoops()
+	builder.detectUnorderedGroups()
 	builder.clusterTransactions()
 	return builder
 }
 
 // NewModelBuilderFromContent creates a new ModelBuilder using the given queries
-func NewModelBuilderFromContent(queries string) *ModelBuilder {
-	builder := &ModelBuilder{NewQuerySet(), []*Query{}, [][]*Query{}, [][][]*Query{}}
+func NewModelBuilderFromContent(queries string, options ModelBuilderOptions) *ModelBuilder {
+	builder := &ModelBuilder{QuerySet: NewQuerySet(), Queries: []*Query{}, Transactions: [][]*Query{}, Clusters: [][][]*Query{},
+		Groups: []*UnorderedSet{}, loops: make(map[int][]loopDefinition), Options: options}
 	builder.parseQueries(queries)
-	builder.splitTransactions(true)
+	builder.splitTransactions(options.ClusterSingle)
+	builder.detectLoops()
+	builder.detectUnorderedGroups()
 	builder.clusterTransactions()
 	return builder
 }
@@ -320,60 +1602,394 @@ func (builder *ModelBuilder) moveToNextQuery(queryIndex *int, startsWithBegin *b
 		if *startsWithBegin {
 			(*queryIndex)++
 		}
-	} else {
-		*startsWithBegin = true
-		(*queryIndex)++
+	} else {
+		*startsWithBegin = true
+		(*queryIndex)++
+	}
+	return true
+}
+
+// If clusterSingle is ture, all consecutive single query transactions will be viewed as one single transaction.
+func (builder *ModelBuilder) splitTransactions(clusterSingle bool) {
+	currentTrx := []*Query{}
+	startsWithBegin := builder.queryIs(builder.Queries[0], "BEGIN")
+	queryIndex := 0
+	if startsWithBegin {
+		queryIndex++
+	}
+	for queryIndex < len(builder.Queries) {
+		query := builder.Queries[queryIndex]
+		if builder.trxEnds(query, startsWithBegin) {
+			if len(currentTrx) > 0 && (startsWithBegin || clusterSingle) {
+				builder.Transactions = append(builder.Transactions, currentTrx)
+			}
+			currentTrx = make([]*Query, 0)
+			if !builder.moveToNextQuery(&queryIndex, &startsWithBegin) {
+				break
+			}
+		} else {
+			currentTrx = append(currentTrx, query)
+			queryIndex++
+		}
+	}
+	if len(currentTrx) > 0 {
+		builder.Transactions = append(builder.Transactions, currentTrx)
+	}
+}
+
+// loopDefinition is a loop by the query whose rows drive it
+// and the query issued once per row.
+type loopDefinition struct {
+	driver int
+	loop   int
+}
+
+// foldLoops folds every run of the same query that is issued once
+// per row of an earlier result into a single loop step, so that
+// transactions only differing in the number of iterations look the same.
+// A run of one iteration, or none, is only a loop if longer runs of the
+// same query after the same query have been seen in the trace.
+func (builder *ModelBuilder) foldLoops(trx []*Query) []*Query {
+	folded := make([]*Query, 0, len(trx))
+	for i := 0; i < len(trx); {
+		j := i + 1
+		for j < len(trx) && trx[j].QueryID == trx[i].QueryID {
+			j++
+		}
+		if driver := builder.loopDriver(folded, trx[i:j]); driver != nil &&
+			(j-i > 1 || builder.isLoop(folded, loopDefinition{driver.QueryID, trx[i].QueryID})) {
+			folded = append(folded, newLoopStep(trx[i:j]))
+		} else {
+			folded = append(folded, trx[i:j]...)
+		}
+		i = j
+		if i < len(trx) {
+			folded = builder.appendEmptyLoops(folded, trx[i].QueryID)
+		} else {
+			folded = builder.appendEmptyLoops(folded, -1)
+		}
+	}
+	return folded
+}
+
+// loopDriver returns the latest query of the folded transaction whose
+// rows are, one per iteration, the values of an argument of the iterations.
+func (builder *ModelBuilder) loopDriver(folded []*Query, iterations []*Query) *Query {
+	for i := len(folded) - 1; i >= 0; i-- {
+		if query := folded[i]; !query.IsLoop() && !query.IsGroup() && builder.drivesIterations(query, iterations) {
+			return query
+		}
+	}
+	return nil
+}
+
+func (builder *ModelBuilder) drivesIterations(query *Query, iterations []*Query) bool {
+	if len(query.ResultSet) != len(iterations) || len(iterations) == 0 {
+		return false
+	}
+	for column := range query.ResultSet[0] {
+		for argIndex := range iterations[0].Arguments {
+			matches := true
+			for row, iteration := range iterations {
+				if column >= len(query.ResultSet[row]) || argIndex >= len(iteration.Arguments) ||
+					!valueNear(query.ResultSet[row][column], iteration.Arguments[argIndex], builder.Options.FloatTolerance) {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isLoop returns true if the loop has been seen following the last
+// step of the folded transaction.
+func (builder *ModelBuilder) isLoop(folded []*Query, loop loopDefinition) bool {
+	if len(folded) == 0 {
+		return false
+	}
+	for _, definition := range builder.loops[folded[len(folded)-1].QueryID] {
+		if definition == loop {
+			return true
+		}
+	}
+	return false
+}
+
+// appendEmptyLoops appends a loop step without iterations for each
+// loop that follows the last step of the folded transaction if its
+// driving query returned no rows, unless the next query is that loop.
+func (builder *ModelBuilder) appendEmptyLoops(folded []*Query, nextQueryID int) []*Query {
+	for len(folded) > 0 {
+		last := folded[len(folded)-1]
+		var empty *Query
+		for _, definition := range builder.loops[last.QueryID] {
+			if definition.loop == nextQueryID {
+				continue
+			}
+			for i := len(folded) - 1; i >= 0; i-- {
+				if folded[i].QueryID == definition.driver && !folded[i].IsLoop() && !folded[i].IsGroup() {
+					if len(folded[i].ResultSet) == 0 {
+						empty = newEmptyLoopStep(definition.loop, last.Time)
+					}
+					break
+				}
+			}
+			if empty != nil {
+				break
+			}
+		}
+		if empty == nil {
+			break
+		}
+		folded = append(folded, empty)
+	}
+	return folded
+}
+
+// detectLoops finds the loops of two iterations or more in the
+// transactions, and the queries they follow.
+func (builder *ModelBuilder) detectLoops() {
+	for _, trx := range builder.Transactions {
+		folded := builder.foldLoops(trx)
+		for i := 1; i < len(folded); i++ {
+			step := folded[i]
+			if !step.IsLoop() || len(step.Iterations) < 2 {
+				continue
+			}
+			loop := loopDefinition{builder.loopDriver(folded[:i], step.Iterations).QueryID, step.QueryID}
+			if !builder.isLoop(folded[:i], loop) {
+				previous := folded[i-1].QueryID
+				builder.loops[previous] = append(builder.loops[previous], loop)
+			}
+		}
+	}
+}
+
+// detectUnorderedGroups finds the reads that transactions otherwise
+// the same issue in different orders.
+func (builder *ModelBuilder) detectUnorderedGroups() {
+	sequences := [][]*Query{}
+	seen := make(map[string]bool)
+	for _, trx := range builder.Transactions {
+		folded := builder.foldLoops(trx)
+		key := builder.trxToString(folded)
+		if !seen[key] {
+			seen[key] = true
+			sequences = append(sequences, folded)
+		}
+	}
+	for i, first := range sequences {
+		for _, second := range sequences[i+1:] {
+			if group := unorderedWindow(first, second); group != nil {
+				builder.addGroup(group)
+			}
+		}
+	}
+}
+
+// unorderedWindow returns the query IDs of the steps where the two
+// transactions differ, if those steps are distinct reads issued in
+// different orders. It returns nil otherwise.
+func unorderedWindow(first []*Query, second []*Query) *UnorderedSet {
+	if len(first) != len(second) {
+		return nil
+	}
+	start, end := -1, -1
+	for i := range first {
+		if first[i].QueryID != second[i].QueryID || first[i].IsLoop() != second[i].IsLoop() {
+			if start == -1 {
+				start = i
+			}
+			end = i
+		}
+	}
+	if start <= 0 {
+		// The transactions are the same, or start differently and
+		// thus belong to different trees.
+		return nil
+	}
+	sets := make([]*UnorderedSet, 2)
+	for i, window := range [][]*Query{first[start : end+1], second[start : end+1]} {
+		sets[i] = NewEmptyUnorderedSet()
+		for _, query := range window {
+			if query.IsLoop() || !query.IsSelect || sets[i].Contains(query.QueryID) {
+				return nil
+			}
+			sets[i].Insert(query.QueryID)
+		}
+	}
+	if !sets[0].Equal(sets[1]) {
+		return nil
+	}
+	return sets[0]
+}
+
+// addGroup adds a group of reads, merging it with the groups it overlaps.
+func (builder *ModelBuilder) addGroup(group *UnorderedSet) {
+	groups := make([]*UnorderedSet, 0, len(builder.Groups)+1)
+	for _, existing := range builder.Groups {
+		overlaps := false
+		for _, queryID := range existing.Elements() {
+			if group.Contains(queryID) {
+				overlaps = true
+				break
+			}
+		}
+		if overlaps {
+			group = NewUnorderedSet(append(group.Elements(), existing.Elements()...))
+		} else {
+			groups = append(groups, existing)
+		}
 	}
-	return true
+	builder.Groups = append(groups, group)
 }
 
-// If clusterSingle is ture, all consecutive single query transactions will be viewed as one single transaction.
-func (builder *ModelBuilder) splitTransactions(clusterSingle bool) {
-	currentTrx := []*Query{}
-	startsWithBegin := builder.queryIs(builder.Queries[0], "BEGIN")
-	queryIndex := 0
-	if startsWithBegin {
-		queryIndex++
+// foldGroups folds every run of reads that forms one of the groups into
+// a single unordered group step. The first query is never folded, as it
+// picks the tree.
+func (builder *ModelBuilder) foldGroups(trx []*Query) []*Query {
+	if len(builder.Groups) == 0 || len(trx) == 0 {
+		return trx
 	}
-	for queryIndex < len(builder.Queries) {
-		query := builder.Queries[queryIndex]
-		if builder.trxEnds(query, startsWithBegin) {
-			if len(currentTrx) > 0 && (startsWithBegin || clusterSingle) {
-				builder.Transactions = append(builder.Transactions, currentTrx)
-			}
-			currentTrx = make([]*Query, 0)
-			if !builder.moveToNextQuery(&queryIndex, &startsWithBegin) {
+	folded := []*Query{trx[0]}
+	for i := 1; i < len(trx); {
+		size := 0
+		for _, group := range builder.Groups {
+			if i+group.Size() <= len(trx) && isGroupRun(trx[i:i+group.Size()], group) {
+				size = group.Size()
 				break
 			}
+		}
+		if size > 0 {
+			folded = append(folded, newGroupStep(trx[i:i+size]))
+			i += size
 		} else {
-			currentTrx = append(currentTrx, query)
-			queryIndex++
+			folded = append(folded, trx[i])
+			i++
 		}
 	}
-	if len(currentTrx) > 0 {
-		builder.Transactions = append(builder.Transactions, currentTrx)
+	return folded
+}
+
+// isGroupRun returns true if the steps are exactly the reads of the group.
+func isGroupRun(steps []*Query, group *UnorderedSet) bool {
+	queryIDs := NewEmptyUnorderedSet()
+	for _, step := range steps {
+		if step.IsLoop() || step.IsGroup() {
+			return false
+		}
+		queryIDs.Insert(step.QueryID)
 	}
+	return queryIDs.Equal(group)
 }
 
-func (builder *ModelBuilder) trxToString(trx []*Query) string {
-	idStrings := make([]string, len(trx))
+// foldSteps folds the loops and then the unordered groups of the transaction.
+func (builder *ModelBuilder) foldSteps(trx []*Query) []*Query {
+	return builder.foldGroups(builder.foldLoops(trx))
+}
+
+func (builder *ModelBuilder) foldTransactions(transactions [][]*Query) [][]*Query {
+	folded := make([][]*Query, len(transactions))
+	for i, trx := range transactions {
+		folded[i] = builder.foldSteps(trx)
+	}
+	return folded
+}
+
+// stepKey identifies a step of a folded transaction by its query ID and
+// whether it is a loop, or by its members if it is a group.
+func (builder *ModelBuilder) stepKey(query *Query) string {
+	if query.IsGroup() {
+		return "{" + strings.Join(builder.stepKeys(query.Members), "|") + "}"
+	}
+	key := strconv.Itoa(query.QueryID)
+	if query.IsLoop() {
+		key += "*"
+	}
+	return key
+}
+
+func (builder *ModelBuilder) stepKeys(trx []*Query) []string {
+	keys := make([]string, len(trx))
 	for i, query := range trx {
-		idStrings[i] = string(query.QueryID)
+		keys[i] = builder.stepKey(query)
 	}
-	return strings.Join(idStrings, ",")
+	return keys
+}
+
+func (builder *ModelBuilder) trxToString(trx []*Query) string {
+	return strings.Join(builder.stepKeys(trx), ",")
 }
 
 func (builder *ModelBuilder) clusterTransactions() {
-	clusters := make(map[string][][]*Query)
+	clusters := make(map[string]int)
+	builder.Clusters = [][][]*Query{}
 	for _, trx := range builder.Transactions {
-		trxID := builder.trxToString(trx)
-		clusters[trxID] = append(clusters[trxID], trx)
+		trxID := builder.trxToString(builder.foldSteps(trx))
+		index, ok := clusters[trxID]
+		if !ok {
+			index = len(builder.Clusters)
+			clusters[trxID] = index
+			builder.Clusters = append(builder.Clusters, [][]*Query{})
+		}
+		builder.Clusters[index] = append(builder.Clusters[index], trx)
 	}
-	builder.Clusters = make([][][]*Query, len(clusters))
-	index := 0
-	for _, cluster := range clusters {
-		builder.Clusters[index] = cluster
-		index++
+}
+
+// alignmentGaps returns the number of steps that have to be inserted into
+// or removed from one sequence to turn it into the other.
+func alignmentGaps(first []string, second []string) int {
+	// common[i][j] is the length of the longest common subsequence of first[i:] and second[j:].
+	common := make([][]int, len(first)+1)
+	for i := range common {
+		common[i] = make([]int, len(second)+1)
+	}
+	for i := len(first) - 1; i >= 0; i-- {
+		for j := len(second) - 1; j >= 0; j-- {
+			if first[i] == second[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+	return len(first) + len(second) - 2*common[0][0]
+}
+
+// FuzzyClusterTransactions regroups the transactions so that transaction
+// types whose query sequences start with the same query and differ by at
+// most Options.MaxGaps optional queries end up in the same cluster. Each
+// merged cluster is represented by its largest transaction type.
+func (builder *ModelBuilder) FuzzyClusterTransactions() {
+	maxGaps := builder.Options.MaxGaps
+	builder.clusterTransactions()
+	exact := make([][][]*Query, len(builder.Clusters))
+	copy(exact, builder.Clusters)
+	sort.SliceStable(exact, func(i, j int) bool {
+		return len(exact[i]) > len(exact[j])
+	})
+	representatives := [][]string{}
+	builder.Clusters = [][][]*Query{}
+	for _, cluster := range exact {
+		keys := builder.stepKeys(builder.foldSteps(cluster[0]))
+		merged := false
+		for i, representative := range representatives {
+			if representative[0] == keys[0] && alignmentGaps(representative, keys) <= maxGaps {
+				builder.Clusters[i] = append(builder.Clusters[i], cluster...)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			representatives = append(representatives, keys)
+			builder.Clusters = append(builder.Clusters, cluster)
+		}
 	}
 }
 
@@ -393,35 +2009,245 @@ func (builder *ModelBuilder) enumerateConstOperand(query *Query, numOpsAllQuerie
 	*strOpsAllQueries = append(*strOpsAllQueries, strOps)
 }
 
+// maxRowOperands caps the number of rows of a multi-row result
+// that get fixed-row operands.
+const maxRowOperands = 3
+
+// maxKeyedLookupOperands caps the number of keyed lookup operands
+// enumerated for all the arguments of a single query.
+const maxKeyedLookupOperands = 32
+
+func (builder *ModelBuilder) appendOperandByType(value interface{}, op Operand, numOps *[]Operand, strOps *[]Operand) {
+	switch value.(type) {
+	case string:
+		*strOps = append(*strOps, op)
+	case float64:
+		*numOps = append(*numOps, op)
+	}
+}
+
 func (builder *ModelBuilder) enumerateResultOperand(queryIndex int, query *Query, numOps *[]Operand, strOps *[]Operand) {
-	if len(query.ResultSet) != 1 {
+	numRows := min(maxRowOperands, len(query.ResultSet))
+	for i := 0; i < numRows; i++ {
+		for j, cell := range query.ResultSet[i] {
+			op := QueryResultOperand{query.QueryID, queryIndex, i, j}
+			builder.appendOperandByType(cell, op, numOps, strOps)
+		}
+	}
+	if len(query.ResultSet) < 2 {
 		return
 	}
-	for j, cell := range query.ResultSet[0] {
-		op := QueryResultOperand{query.QueryID, queryIndex, 0, j}
-		switch cell.(type) {
-		case string:
-			*strOps = append(*strOps, op)
-		case float64:
-			*numOps = append(*numOps, op)
+	for j, cell := range query.ResultSet[len(query.ResultSet)-1] {
+		op := LastRowOperand{query.QueryID, queryIndex, j}
+		builder.appendOperandByType(cell, op, numOps, strOps)
+	}
+}
+
+// columnIsKey returns true if the values of the column are
+// all present and distinct, so that it can be used for lookups.
+func (builder *ModelBuilder) columnIsKey(query *Query, columnIndex int) bool {
+	seen := make(map[interface{}]bool)
+	for _, row := range query.ResultSet {
+		if len(row) <= columnIndex || row[columnIndex] == nil || seen[row[columnIndex]] {
+			return false
+		}
+		seen[row[columnIndex]] = true
+	}
+	return true
+}
+
+// enumerateKeyedLookupOperand creates operands that look up a row of
+// a multi-row result among the windowSize queries before queryIndex,
+// using one of the keys as the key. Only keys whose value actually
+// appears in the key column of the example transaction are used.
+func (builder *ModelBuilder) enumerateKeyedLookupOperand(trx []*Query, queryIndex int, windowSize int, keys [][]Operand, numOps *[]Operand, strOps *[]Operand) {
+	budget := maxKeyedLookupOperands
+	for resultIndex := nonNegative(queryIndex - windowSize); resultIndex < queryIndex; resultIndex++ {
+		query := trx[resultIndex]
+		if len(query.ResultSet) < 2 {
+			continue
+		}
+		for keyColumn := range query.ResultSet[0] {
+			if !builder.columnIsKey(query, keyColumn) {
+				continue
+			}
+			for _, ops := range keys {
+				for _, key := range ops {
+					switch key.(type) {
+					case KeyedLookupOperand, AggregationOperand:
+						continue
+					}
+					keyValue := key.GetValue(trx)
+					for _, row := range query.ResultSet {
+						if !valueNear(row[keyColumn], keyValue, builder.Options.FloatTolerance) {
+							continue
+						}
+						for valueColumn, cell := range row {
+							if valueColumn == keyColumn {
+								continue
+							}
+							if budget == 0 {
+								return
+							}
+							op := KeyedLookupOperand{query.QueryID, resultIndex, keyColumn, valueColumn, key}
+							builder.appendOperandByType(cell, op, numOps, strOps)
+							budget--
+						}
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+// maxFormatOperands caps the number of format operands
+// enumerated for the string arguments of a single query.
+const maxFormatOperands = 32
+
+type byTextLength struct {
+	operands []Operand
+	texts    []string
+}
+
+func (b byTextLength) Len() int           { return len(b.texts) }
+func (b byTextLength) Less(i, j int) bool { return len(b.texts[i]) > len(b.texts[j]) }
+func (b byTextLength) Swap(i, j int) {
+	b.operands[i], b.operands[j] = b.operands[j], b.operands[i]
+	b.texts[i], b.texts[j] = b.texts[j], b.texts[i]
+}
+
+// formatsWith returns the formats made by replacing an occurrence of
+// an operand in format with a hole, as text or as a zero padded number.
+// A format that is nothing but the hole is left out.
+func formatsWith(format formatParts, text string, value interface{}) []formatParts {
+	formats := []formatParts{}
+	if withText, found := format.withText(text); found && withText.String() != "%s" {
+		formats = append(formats, withText)
+	}
+	if num, ok := value.(float64); ok {
+		if padded, found := format.withPadded(num); found {
+			formats = append(formats, padded)
 		}
 	}
+	return formats
 }
 
+// enumerateFormatOperand creates operands that build the string
+// arguments of query out of the values of one or two of the
+// operands, and whatever text surrounds them in the example.
+func (builder *ModelBuilder) enumerateFormatOperand(trx []*Query, query *Query, operands [][]Operand, formatOps *[]Operand) {
+	holes := []Operand{}
+	texts := []string{}
+	for _, ops := range operands {
+		for _, op := range ops {
+			value := op.GetValue(trx)
+			if value == nil {
+				continue
+			}
+			text := formatValue(value)
+			if len(text) == 0 || strings.Contains(text, "%") {
+				continue
+			}
+			holes = append(holes, op)
+			texts = append(texts, text)
+		}
+	}
+	// Longer values are less likely to appear in the argument by
+	// coincidence, so they get the budget first.
+	sort.Stable(byTextLength{holes, texts})
+	values := make([]interface{}, len(holes))
+	for i, hole := range holes {
+		values[i] = hole.GetValue(trx)
+	}
+	budget := maxFormatOperands
+	for _, arg := range query.Arguments {
+		str, ok := arg.(string)
+		if !ok {
+			continue
+		}
+		// A literal % in the argument, as in LIKE patterns, must survive Sprintf.
+		escaped := parseFormat(strings.Replace(str, "%", "%%", -1))
+		// Filling a hole only takes text away from the format, so the
+		// holes missing from the argument are left out once and for all.
+		found := []int{}
+		firsts := [][]formatParts{}
+		for i := range holes {
+			if formats := formatsWith(escaped, texts[i], values[i]); len(formats) > 0 {
+				found = append(found, i)
+				firsts = append(firsts, formats)
+			}
+		}
+		for k, i := range found {
+			first := holes[i]
+			for _, format := range firsts[k] {
+				if budget == 0 {
+					return
+				}
+				*formatOps = append(*formatOps, NewFormatOperand(format.String(), first, nil))
+				budget--
+				for _, j := range found {
+					if j == i {
+						continue
+					}
+					second := holes[j]
+					for _, twoHoles := range formatsWith(format, texts[j], values[j]) {
+						if budget == 0 {
+							return
+						}
+						// The holes are filled in order, and the new one may come first.
+						op := NewFormatOperand(twoHoles.String(), first, second)
+						if op.GetValue(trx) != str {
+							op = NewFormatOperand(op.Format, second, first)
+						}
+						*formatOps = append(*formatOps, op)
+						budget--
+					}
+				}
+			}
+		}
+	}
+}
+
+// maxAggregationOperands caps the number of aggregation operands
+// enumerated for a single query, so that wide result sets do not make
+// the operand search explode.
+const maxAggregationOperands = 24
+
 func (builder *ModelBuilder) enumerateAggregationOperand(queryIndex int, query *Query, numOps *[]Operand, aggregators []Aggregator) {
-	if len(query.ResultSet) == 0 {
+	// Aggregating a single row gives nothing that QueryResultOperand does not.
+	if len(query.ResultSet) < 2 {
 		return
 	}
-	for i, cell := range query.ResultSet[0] {
-		switch cell.(type) {
-		case float64:
-			break
-		default:
+	budget := maxAggregationOperands
+	for i := range query.ResultSet[0] {
+		if builder.getColumnType(query, i) != reflect.Float64 {
 			continue
 		}
 		for _, aggregator := range aggregators {
-			aggregation := AggregationOperand{queryIndex, aggregator, i}
+			if budget == 0 {
+				return
+			}
+			aggregation := AggregationOperand{query.QueryID, queryIndex, aggregator, i}
 			*numOps = append(*numOps, aggregation)
+			budget--
+		}
+	}
+}
+
+// enumerateIterationOperand creates operands for the loop at queryIndex,
+// taking values from the rows of the results of the windowSize queries
+// before it that have at least as many rows as the loop has iterations.
+func (builder *ModelBuilder) enumerateIterationOperand(trx []*Query, queryIndex int, windowSize int, numOps *[]Operand, strOps *[]Operand) {
+	numIterations := len(trx[queryIndex].Iterations)
+	for resultIndex := nonNegative(queryIndex - windowSize); resultIndex < queryIndex; resultIndex++ {
+		query := trx[resultIndex]
+		if len(query.ResultSet) < numIterations || numIterations == 0 {
+			continue
+		}
+		for j, cell := range query.ResultSet[0] {
+			op := IterationOperand{query.QueryID, resultIndex, j}
+			builder.appendOperandByType(cell, op, numOps, strOps)
 		}
 	}
 }
@@ -458,7 +2284,7 @@ func (builder *ModelBuilder) enumerateArgumentListOperand(queryIndex int, query
 func (builder *ModelBuilder) getColumnType(query *Query, columnIndex int) reflect.Kind {
 	var kind reflect.Kind
 	for _, row := range query.ResultSet {
-		if row[columnIndex] != nil {
+		if columnIndex < len(row) && row[columnIndex] != nil {
 			kind = reflect.TypeOf(row[columnIndex]).Kind()
 			break
 		}
@@ -491,7 +2317,7 @@ func (builder *ModelBuilder) enumerateAllOperands(queryIndex int, query *Query,
 
 	builder.enumerateResultOperand(queryIndex, query, &numOps, &strOps)
 	builder.enumerateArgumentOperand(queryIndex, query, &numOps, &strOps)
-	// builder.enumerateAggregationOperand(queryIndex, query, Aggregators, &numOps)
+	builder.enumerateAggregationOperand(queryIndex, query, &numOps, Aggregators)
 	builder.enumerateArgumentListOperand(queryIndex, query, &numListOps, &strListOps)
 	builder.enumerateColumnListOperand(queryIndex, query, &numListOps, &strListOps)
 
@@ -502,6 +2328,22 @@ func (builder *ModelBuilder) enumerateAllOperands(queryIndex int, query *Query,
 	*strListOpsAllQueries = append(*strListOpsAllQueries, strListOps)
 }
 
+// operandMatchesArgument returns true if the operand gives the argIndex-th
+// argument of the queryIndex-th step of the transaction, in every
+// iteration if the step is a loop.
+func (builder *ModelBuilder) operandMatchesArgument(operand Operand, trx []*Query, queryIndex int, argIndex int) bool {
+	step := trx[queryIndex]
+	if !step.IsLoop() {
+		return valueNear(operand.GetValue(trx), step.Arguments[argIndex], builder.Options.FloatTolerance)
+	}
+	for i, iteration := range step.Iterations {
+		if !valueNear(operand.GetValue(iterationView(trx, queryIndex, i)), iteration.Arguments[argIndex], builder.Options.FloatTolerance) {
+			return false
+		}
+	}
+	return true
+}
+
 // Search for unary operations that matches the columnIndex-th parameter of the queryIndex-th query.
 func (builder *ModelBuilder) searchForUnaryOps(transactions [][]*Query, operands [][]Operand, queryIndex int, columnIndex int) []Operation {
 	unaryOperations := make([]Operation, 0, len(operands))
@@ -510,8 +2352,7 @@ func (builder *ModelBuilder) searchForUnaryOps(transactions [][]*Query, operands
 			operand := operands[i][j]
 			matches := true
 			for trxIndex := 0; trxIndex < len(transactions); trxIndex++ {
-				targetQuery := transactions[trxIndex][queryIndex]
-				if !valueEqual(operand.GetValue(transactions[trxIndex]), targetQuery.Arguments[columnIndex]) {
+				if !builder.operandMatchesArgument(operand, transactions[trxIndex], queryIndex, columnIndex) {
 					matches = false
 					break
 				}
@@ -527,6 +2368,138 @@ func (builder *ModelBuilder) searchForUnaryOps(transactions [][]*Query, operands
 	return unaryOperations
 }
 
+// argumentSamples returns the pairs of values of the operand and the
+// argIndex-th argument of the queryIndex-th step of the transaction,
+// one pair per iteration if the step is a loop.
+func (builder *ModelBuilder) argumentSamples(operand Operand, trx []*Query, queryIndex int, argIndex int) ([]interface{}, []interface{}) {
+	step := trx[queryIndex]
+	if !step.IsLoop() {
+		return []interface{}{operand.GetValue(trx)}, []interface{}{step.Arguments[argIndex]}
+	}
+	xs := make([]interface{}, len(step.Iterations))
+	ys := make([]interface{}, len(step.Iterations))
+	for i, iteration := range step.Iterations {
+		xs[i] = operand.GetValue(iterationView(trx, queryIndex, i))
+		ys[i] = iteration.Arguments[argIndex]
+	}
+	return xs, ys
+}
+
+// fitAffineOperand fits y = a * x + b, with x being the value of the
+// operand and y the columnIndex-th argument of the queryIndex-th query,
+// across all the transactions. It returns false if no such line exists.
+func (builder *ModelBuilder) fitAffineOperand(transactions [][]*Query, operand Operand, queryIndex int, columnIndex int) (AffineOperand, bool) {
+	xs := []float64{}
+	ys := []float64{}
+	for _, trx := range transactions {
+		operandValues, argValues := builder.argumentSamples(operand, trx, queryIndex, columnIndex)
+		for i, value := range operandValues {
+			x, xOk := value.(float64)
+			y, yOk := argValues[i].(float64)
+			if !xOk || !yOk {
+				return AffineOperand{}, false
+			}
+			xs = append(xs, x)
+			ys = append(ys, y)
+		}
+	}
+	// Two distinct points determine the line, the rest verify it.
+	second := -1
+	for i := 1; i < len(xs); i++ {
+		if !floatNear(xs[i], xs[0], builder.Options.FloatTolerance) {
+			second = i
+			break
+		}
+	}
+	if second < 0 {
+		return AffineOperand{}, false
+	}
+	scale := (ys[second] - ys[0]) / (xs[second] - xs[0])
+	offset := ys[0] - scale*xs[0]
+	tolerance := builder.Options.FloatTolerance
+	if floatNear(scale, 0, tolerance) || (floatNear(scale, 1, tolerance) && floatNear(offset, 0, tolerance)) {
+		// Constants and plain copies are found without fitting.
+		return AffineOperand{}, false
+	}
+	for i, x := range xs {
+		if !floatNear(scale*x+offset, ys[i], tolerance) {
+			return AffineOperand{}, false
+		}
+	}
+	return AffineOperand{operand, scale, offset}, true
+}
+
+// Search for affine operations that matches the columnIndex-th parameter of the queryIndex-th query.
+func (builder *ModelBuilder) searchForAffineOps(transactions [][]*Query, operands [][]Operand, queryIndex int, columnIndex int) []Operation {
+	affineOperations := []Operation{}
+	for i := len(operands) - 1; i >= 0; i-- {
+		for _, operand := range operands[i] {
+			switch operand.(type) {
+			case ConstOperand, AffineOperand:
+				continue
+			}
+			if affine, ok := builder.fitAffineOperand(transactions, operand, queryIndex, columnIndex); ok {
+				affineOperations = append(affineOperations, UnaryOperation{affine})
+			}
+		}
+	}
+	return affineOperations
+}
+
+// timestampUnits are the units a timestamp can be truncated to.
+var timestampUnits = []time.Duration{0, time.Hour, 24 * time.Hour}
+
+// fitTimestampOperand looks for a unit and an offset, such that the
+// base timestamp truncated to the unit plus the offset gives the
+// columnIndex-th argument of the queryIndex-th query in all the
+// transactions. A nil base stands for the transaction start time.
+func (builder *ModelBuilder) fitTimestampOperand(transactions [][]*Query, base Operand, layout string, queryIndex int, columnIndex int) (TimestampOperand, bool) {
+	for _, unit := range timestampUnits {
+		candidate := TimestampOperand{base, unit, 0, layout}
+		baseValues, argValues := builder.argumentSamples(candidate, transactions[0], queryIndex, columnIndex)
+		baseTime, _, baseOk := parseTimestamp(baseValues[0])
+		argTime, _, argOk := parseTimestamp(argValues[0])
+		if !baseOk || !argOk {
+			return TimestampOperand{}, false
+		}
+		candidate.Offset = argTime.Sub(baseTime)
+		matches := true
+		for _, trx := range transactions {
+			if !builder.operandMatchesArgument(candidate, trx, queryIndex, columnIndex) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return candidate, true
+		}
+	}
+	return TimestampOperand{}, false
+}
+
+// Search for timestamp operations that matches the columnIndex-th parameter of the queryIndex-th query.
+func (builder *ModelBuilder) searchForTimestampOps(transactions [][]*Query, operands [][]Operand, queryIndex int, columnIndex int) []Operation {
+	_, layout, ok := parseTimestamp(transactions[0][queryIndex].Arguments[columnIndex])
+	if !ok {
+		return []Operation{}
+	}
+	bases := []Operand{nil}
+	for i := len(operands) - 1; i >= 0; i-- {
+		for _, operand := range operands[i] {
+			if _, _, ok := parseTimestamp(operand.GetValue(transactions[0])); ok {
+				bases = append(bases, operand)
+			}
+		}
+	}
+	timestampOperations := []Operation{}
+	for _, base := range bases {
+		if timestamp, ok := builder.fitTimestampOperand(transactions, base, layout, queryIndex, columnIndex); ok {
+			timestampOperations = append(timestampOperations, UnaryOperation{timestamp})
+		}
+	}
+	return timestampOperations
+}
+
 func (builder *ModelBuilder) enumeratePredictionsFromParaOps(paraOps [][]Operation, queryID int) []*Prediction {
 	var numCombis int64
 	numCombis = 1
@@ -546,7 +2519,8 @@ func (builder *ModelBuilder) enumeratePredictionsFromParaOps(paraOps [][]Operati
 
 func (builder *ModelBuilder) operationCombinations(paraOps [][]Operation, queryID int, paraIndex int, currentCombi []Operation, allPredictions *[]*Prediction) {
 	if paraIndex >= len(paraOps) {
-		*allPredictions = append(*allPredictions, NewPrediction(queryID, currentCombi))
+		// currentCombi shares its backing array with the other combinations.
+		*allPredictions = append(*allPredictions, NewPrediction(queryID, append([]Operation{}, currentCombi...)))
 		return
 	}
 	for i := 0; i < len(paraOps[paraIndex]); i++ {
@@ -583,7 +2557,16 @@ func (builder *ModelBuilder) collapseArgOperand(parent *Node, parentLevel int, o
 		// Prediction for the target arg is random, not need to collapse.
 		return op
 	}
-	argOperand := argOperation.(UnaryOperation).Operand
+	unaryOperation, ok := argOperation.(UnaryOperation)
+	if !ok {
+		// The target arg is guessed from its distribution.
+		return op
+	}
+	argOperand := unaryOperation.Operand
+	if _, ok := argOperand.(IterationOperand); ok {
+		// Only meaningful inside the loop.
+		return op
+	}
 	if _, ok := argOperand.(QueryArgumentOperand); ok {
 		return builder.collapseArgOperand(parent, parentLevel, argOperand)
 	}
@@ -627,11 +2610,39 @@ func (builder *ModelBuilder) collapseOperands(parent *Node, parentLevel int, ope
 }
 
 func (builder *ModelBuilder) enumeratePredictionsForQuery(parent *Node, transactions [][]*Query, queryIndex int, numOps [][]Operand, strOps [][]Operand, numListOps [][]Operand, strListOps [][]Operand) []*Node {
+	if transactions[0][queryIndex].IsLoop() {
+		// The operands are enumerated from the first transaction,
+		// so it must not be one where the loop has no iterations.
+		transactions = append([][]*Query{}, transactions...)
+		sort.SliceStable(transactions, func(i, j int) bool {
+			return len(transactions[i][queryIndex].Iterations) > 0 && len(transactions[j][queryIndex].Iterations) == 0
+		})
+	}
 	query := transactions[0][queryIndex]
 	numOps = builder.collapseOperands(parent, queryIndex-1, numOps)
 	strOps = builder.collapseOperands(parent, queryIndex-1, strOps)
 	numListOps = builder.collapseOperands(parent, queryIndex-1, numListOps)
 	strListOps = builder.collapseOperands(parent, queryIndex-1, strListOps)
+	// The last operands are the constants of the query itself.
+	windowSize := len(numOps) - 1
+	numLookups := []Operand{}
+	strLookups := []Operand{}
+	keys := make([][]Operand, 0, len(numOps)+len(strOps))
+	keys = append(append(keys, numOps...), strOps...)
+	builder.enumerateKeyedLookupOperand(transactions[0], queryIndex, windowSize, keys, &numLookups, &strLookups)
+	// Lookups come first so that they are the last to be searched.
+	numOps = append([][]Operand{numLookups}, numOps...)
+	strOps = append([][]Operand{strLookups}, strOps...)
+	formatOps := []Operand{}
+	builder.enumerateFormatOperand(transactions[0], query, keys, &formatOps)
+	strOps = append([][]Operand{formatOps}, strOps...)
+	if query.IsLoop() {
+		numIterationOps := []Operand{}
+		strIterationOps := []Operand{}
+		builder.enumerateIterationOperand(transactions[0], queryIndex, windowSize, &numIterationOps, &strIterationOps)
+		numOps = append(numOps, numIterationOps)
+		strOps = append(strOps, strIterationOps)
+	}
 	opsForArgs := make([][]Operation, len(query.Arguments))
 	for i, arg := range query.Arguments {
 		var candidateOps [][]Operand
@@ -652,6 +2663,18 @@ func (builder *ModelBuilder) enumeratePredictionsForQuery(parent *Node, transact
 			}
 		}
 		ops := builder.searchForUnaryOps(transactions, candidateOps, queryIndex, i)
+		if _, ok := ops[0].(RandomOperation); ok && len(ops) == 1 {
+			if _, ok := arg.(float64); ok {
+				if affineOps := builder.searchForAffineOps(transactions, candidateOps, queryIndex, i); len(affineOps) > 0 {
+					ops = affineOps
+				}
+			}
+			if _, ok := arg.(string); ok {
+				if timestampOps := builder.searchForTimestampOps(transactions, candidateOps, queryIndex, i); len(timestampOps) > 0 {
+					ops = timestampOps
+				}
+			}
+		}
 		opsForArgs[i] = append(opsForArgs[i], ops...)
 	}
 	predictions := builder.enumeratePredictionsFromParaOps(opsForArgs, query.QueryID)
@@ -660,74 +2683,326 @@ func (builder *ModelBuilder) enumeratePredictionsForQuery(parent *Node, transact
 	}
 	nodes := make([]*Node, len(predictions))
 	for i, prediction := range predictions {
+		prediction.IsLoop = query.IsLoop()
 		nodes[i] = NewNode(prediction, parent)
 	}
 	return nodes
 }
 
-// UpdateModel updates the model using the supplied transactions.
-func (builder *ModelBuilder) UpdateModel(transactions [][]*Query, pt *PredictionTrees) {
-	exampleTrx := transactions[0]
-	numTrx := min(10, len(transactions))
-	firstTen := transactions[:numTrx]
+// enumerateStepPredictions enumerates the predictions for the
+// queryIndex-th step of the transactions, which may be a group.
+func (builder *ModelBuilder) enumerateStepPredictions(parent *Node, transactions [][]*Query, queryIndex int, numOps [][]Operand, strOps [][]Operand, numListOps [][]Operand, strListOps [][]Operand) []*Node {
+	if transactions[0][queryIndex].IsGroup() {
+		return builder.enumerateGroupPredictions(parent, transactions, queryIndex, numOps, strOps, numListOps, strListOps)
+	}
+	return builder.enumeratePredictionsForQuery(parent, transactions, queryIndex, numOps, strOps, numListOps, strListOps)
+}
+
+// enumerateGroupPredictions returns the prediction for the group at
+// queryIndex, made of the prediction that matches the most transactions
+// for each of its reads. The reads can only use the operands of the
+// queries before the group, the last of numOps and strOps being the
+// constants of the group.
+func (builder *ModelBuilder) enumerateGroupPredictions(parent *Node, transactions [][]*Query, queryIndex int, numOps [][]Operand, strOps [][]Operand, numListOps [][]Operand, strListOps [][]Operand) []*Node {
+	group := transactions[0][queryIndex]
+	members := make([]*Prediction, len(group.Members))
+	for m, member := range group.Members {
+		// views contain the transactions with the read in place of the group.
+		views := make([][]*Query, 0, len(transactions))
+		for _, trx := range transactions {
+			for _, query := range trx[queryIndex].Members {
+				if query.QueryID == member.QueryID {
+					views = append(views, append(trx[:queryIndex:queryIndex], query))
+				}
+			}
+		}
+		memberNumOps := numOps[: len(numOps)-1 : len(numOps)-1]
+		memberStrOps := strOps[: len(strOps)-1 : len(strOps)-1]
+		builder.enumerateConstOperand(member, &memberNumOps, &memberStrOps)
+		members[m] = NewRandomPrediction(member.QueryID, len(member.Arguments))
+		bestHits := 0
+		for _, node := range builder.enumeratePredictionsForQuery(parent, views, queryIndex, memberNumOps, memberStrOps, numListOps, strListOps) {
+			prediction := node.Payload.(*Prediction)
+			if prediction.IsRandom {
+				continue
+			}
+			hits := 0
+			for _, view := range views {
+				if prediction.MatchesStep(view, queryIndex, builder.Options.FloatTolerance) {
+					hits++
+				}
+			}
+			if hits > bestHits {
+				bestHits = hits
+				members[m] = prediction
+			}
+		}
+	}
+	return []*Node{NewNode(NewGroupPrediction(members), parent)}
+}
+
+// lastNOperands returns the operands of the last few queries,
+// which are the only ones searched.
+func (builder *ModelBuilder) lastNOperands(operands [][]Operand) [][]Operand {
+	return operands[nonNegative(len(operands)-builder.Options.LookBack):]
+}
+
+// operandWindows enumerates the operands that may be used for the
+// arguments of the queryIndex-th query of the transaction, in the same
+// way as UpdateModel does.
+func (builder *ModelBuilder) operandWindows(trx []*Query, queryIndex int) ([][]Operand, [][]Operand, [][]Operand, [][]Operand) {
 	numOpsAllQueries := [][]Operand{}
 	strOpsAllQueries := [][]Operand{}
 	numListOpsAllQueries := [][]Operand{}
 	strListOpsAllQueries := [][]Operand{}
-	root := pt.GetTreeWithRoot(exampleTrx[0].QueryID, len(exampleTrx[0].Arguments))
-	currentLevel := []*Node{root}
-	nextLevel := []*Node{}
-	builder.enumerateConstOperand(exampleTrx[0], &numOpsAllQueries, &strOpsAllQueries)
-	builder.enumerateAllOperands(0, exampleTrx[0], &numOpsAllQueries, &strOpsAllQueries, &numListOpsAllQueries, &strListOpsAllQueries)
-	for index, query := range exampleTrx[1:] {
-		i := index + 1
-		builder.enumerateConstOperand(query, &numOpsAllQueries, &strOpsAllQueries)
+	for i := 0; i < queryIndex; i++ {
+		builder.enumerateConstOperand(trx[i], &numOpsAllQueries, &strOpsAllQueries)
+		builder.enumerateAllOperands(i, trx[i], &numOpsAllQueries, &strOpsAllQueries, &numListOpsAllQueries, &strListOpsAllQueries)
+	}
+	builder.enumerateConstOperand(trx[queryIndex], &numOpsAllQueries, &strOpsAllQueries)
+	return builder.lastNOperands(numOpsAllQueries), builder.lastNOperands(strOpsAllQueries),
+		builder.lastNOperands(numListOpsAllQueries), builder.lastNOperands(strListOpsAllQueries)
+}
+
+// UpdateModel updates the model using the supplied transactions.
+// Transactions are not required to share the same sequence of queries:
+// they are merged into a prefix tree, and every step is trained on all
+// the transactions that share the prefix leading to it.
+// The trees are pruned on the way following builder.Options.Pruning.
+func (builder *ModelBuilder) UpdateModel(transactions [][]*Query, pt *PredictionTrees) {
+	builder.PruneReport.NodesBefore = pt.Size()
+	transactions = builder.foldTransactions(transactions)
+	for _, group := range builder.partitionByStep(transactions, 0) {
+		exampleTrx := group[0]
+		numOpsAllQueries := [][]Operand{}
+		strOpsAllQueries := [][]Operand{}
+		numListOpsAllQueries := [][]Operand{}
+		strListOpsAllQueries := [][]Operand{}
+		root := pt.GetTreeWithRoot(exampleTrx[0].QueryID, len(exampleTrx[0].Arguments))
+		builder.enumerateConstOperand(exampleTrx[0], &numOpsAllQueries, &strOpsAllQueries)
+		builder.enumerateAllOperands(0, exampleTrx[0], &numOpsAllQueries, &strOpsAllQueries, &numListOpsAllQueries, &strListOpsAllQueries)
+		// reached holds the transactions that reach each node of the current level.
+		reached := map[*Node][][]*Query{root: group}
+		builder.updatePrefix(group, 1, []*Node{root}, reached, numOpsAllQueries, strOpsAllQueries, numListOpsAllQueries, strListOpsAllQueries)
+	}
+	if builder.Options.Pruning.MaxNodes > 0 {
+		pt.evict(builder.Options.Pruning.MaxNodes, &builder.PruneReport)
+	}
+	builder.PruneReport.NodesAfter = pt.Size()
+	options := builder.Options
+	pt.Options = &options
+}
+
+// BuildModel updates the model with all the clusters on the given number
+// of workers. Clusters are split by root query, and the parts sharing a
+// root are trained in order by the same worker, as they update the same
+// tree. Trees are then merged in order of their root query IDs, so the
+// result does not depend on the number of workers, and is the same as
+// calling UpdateModel with each cluster in order, except that the node
+// budget of builder.Options.Pruning is only enforced once all clusters are done.
+func (builder *ModelBuilder) BuildModel(clusters [][][]*Query, pt *PredictionTrees, workers int) {
+	builder.PruneReport.NodesBefore = pt.Size()
+	rootIDs := []int{}
+	jobs := make(map[int][][][]*Query)
+	for _, cluster := range clusters {
+		for _, part := range builder.partitionByStep(cluster, 0) {
+			rootID := part[0][0].QueryID
+			if _, ok := jobs[rootID]; !ok {
+				rootIDs = append(rootIDs, rootID)
+			}
+			jobs[rootID] = append(jobs[rootID], part)
+		}
+	}
+	sort.Ints(rootIDs)
+	trees := make([]*PredictionTrees, len(rootIDs))
+	reports := make([]PruneReport, len(rootIDs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < max(1, workers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each worker has its own report, and leaves the node budget to the end.
+			worker := *builder
+			worker.Options.Pruning.MaxNodes = 0
+			for job := range next {
+				worker.PruneReport = PruneReport{}
+				trees[job] = NewPredictionTrees()
+				if tree, ok := pt.trees[rootIDs[job]]; ok {
+					trees[job].trees[rootIDs[job]] = tree
+				}
+				for _, part := range jobs[rootIDs[job]] {
+					worker.UpdateModel(part, trees[job])
+				}
+				reports[job] = worker.PruneReport
+			}
+		}()
+	}
+	for job := range rootIDs {
+		next <- job
+	}
+	close(next)
+	wg.Wait()
+	for job, rootID := range rootIDs {
+		pt.trees[rootID] = trees[job].trees[rootID]
+		builder.PruneReport.add(reports[job])
+	}
+	if builder.Options.Pruning.MaxNodes > 0 {
+		pt.evict(builder.Options.Pruning.MaxNodes, &builder.PruneReport)
+	}
+	builder.PruneReport.NodesAfter = pt.Size()
+	options := builder.Options
+	pt.Options = &options
+}
+
+// partitionByStep groups the transactions that have a queryIndex-th step
+// by the query ID and loopness of that step. Larger groups come first.
+func (builder *ModelBuilder) partitionByStep(transactions [][]*Query, queryIndex int) [][][]*Query {
+	groups := [][][]*Query{}
+	indices := make(map[string]int)
+	for _, trx := range transactions {
+		if len(trx) <= queryIndex {
+			continue
+		}
+		key := builder.stepKey(trx[queryIndex])
+		index, ok := indices[key]
+		if !ok {
+			index = len(groups)
+			indices[key] = index
+			groups = append(groups, [][]*Query{})
+		}
+		groups[index] = append(groups[index], trx)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i]) > len(groups[j])
+	})
+	return groups
+}
+
+// updatePrefix trains the queryIndex-th step of the transactions, all of
+// which share the steps before it, and recurses into the steps after it.
+// The operand slices hold the operands enumerated from the shared prefix.
+func (builder *ModelBuilder) updatePrefix(transactions [][]*Query, queryIndex int, currentLevel []*Node, reached map[*Node][][]*Query,
+	numOpsAllQueries [][]Operand, strOpsAllQueries [][]Operand, numListOpsAllQueries [][]Operand, strListOpsAllQueries [][]Operand) {
+	i := queryIndex
+	for _, group := range builder.partitionByStep(transactions, i) {
+		query := group[0][i]
+		sample := group[:min(builder.Options.SampleSize, len(group))]
+		// Limit the capacities so that sibling groups never share the appended operands.
+		numOps := numOpsAllQueries[:len(numOpsAllQueries):len(numOpsAllQueries)]
+		strOps := strOpsAllQueries[:len(strOpsAllQueries):len(strOpsAllQueries)]
+		numListOps := numListOpsAllQueries[:len(numListOpsAllQueries):len(numListOpsAllQueries)]
+		strListOps := strListOpsAllQueries[:len(strListOpsAllQueries):len(strListOpsAllQueries)]
+		key := builder.stepKey(query)
+		nextLevel := []*Node{}
+		nextReached := make(map[*Node][][]*Query)
+		builder.enumerateConstOperand(query, &numOps, &strOps)
 		for _, node := range currentLevel {
+			// arrived holds the transactions of the group that reach the node.
+			arrived := [][]*Query{}
+			for _, trx := range reached[node] {
+				if len(trx) > i && builder.stepKey(trx[i]) == key {
+					arrived = append(arrived, trx)
+				}
+			}
+			if len(arrived) == 0 {
+				continue
+			}
+			node.Payload.(*Prediction).AddTransitions(query.QueryID, len(arrived))
 			predictionsForThisQuery := node.FilterChildren(func(payload interface{}) bool {
 				if prediction, ok := payload.(*Prediction); ok {
-					return prediction.QueryID == query.QueryID
+					return prediction.QueryID == query.QueryID && prediction.IsLoop == query.IsLoop() &&
+						prediction.IsGroup() == query.IsGroup()
 				}
 				return false
 			})
 			if len(predictionsForThisQuery) == 0 {
-				numOpsLen := len(numOpsAllQueries)
-				strOpsLen := len(strOpsAllQueries)
-				numListOpsLen := len(numListOpsAllQueries)
-				strListOpsLen := len(strListOpsAllQueries)
-				lastN := 7
-				numOpsLastN := numOpsAllQueries[nonNegative(numOpsLen-lastN):numOpsLen]
-				strOpsLastN := strOpsAllQueries[nonNegative(strOpsLen-lastN):strOpsLen]
-				numListOpsLastN := numListOpsAllQueries[nonNegative(numListOpsLen-lastN):numListOpsLen]
-				strListOpsLastN := strListOpsAllQueries[nonNegative(strListOpsLen-lastN):strListOpsLen]
-				predictionsForThisQuery = builder.enumeratePredictionsForQuery(node, firstTen, i, numOpsLastN, strOpsLastN, numListOpsLastN, strListOpsLastN)
+				numOpsLastN := builder.lastNOperands(numOps)
+				strOpsLastN := builder.lastNOperands(strOps)
+				numListOpsLastN := builder.lastNOperands(numListOps)
+				strListOpsLastN := builder.lastNOperands(strListOps)
+				predictionsForThisQuery = builder.enumerateStepPredictions(node, sample, i, numOpsLastN, strOpsLastN, numListOpsLastN, strListOpsLastN)
 				node.AddChildren(predictionsForThisQuery)
 			}
 			matchedPredictions := make([]*Node, 0, len(predictionsForThisQuery))
+			followedBy := make(map[*Node][][]*Query)
 			for _, node := range predictionsForThisQuery {
-				hits := false
 				prediction := node.Payload.(*Prediction)
-				for _, trx := range transactions {
-					if prediction.MatchesQuery(trx, trx[i]) {
-						hits = true
+				for _, trx := range arrived {
+					prediction.Trial()
+					if !prediction.FollowsStep(trx, i, builder.Options.FloatTolerance) {
+						continue
+					}
+					// A wrong guess is a miss, but the transaction still goes on through the node.
+					followedBy[node] = append(followedBy[node], trx)
+					if prediction.MatchesStep(trx, i, builder.Options.FloatTolerance) {
 						prediction.Hit()
 					}
+					prediction.Observe(trx, i)
 				}
-				if hits {
+			}
+			pruned := pruneChildren(node, builder.Options.Pruning, &builder.PruneReport)
+			for _, node := range predictionsForThisQuery {
+				if followed := followedBy[node]; len(followed) > 0 && !pruned[node] {
 					matchedPredictions = append(matchedPredictions, node)
+					nextReached[node] = followed
 				}
 			}
 			if len(matchedPredictions) == 0 {
-				newChild := []*Node{NewNode(NewRandomPrediction(i, len(query.Arguments)), node)}
+				randomPrediction := newRandomStepPrediction(query)
+				newChild := []*Node{NewNode(randomPrediction, node)}
+				for _, trx := range arrived {
+					randomPrediction.Trial()
+					if randomPrediction.MatchesStep(trx, i, builder.Options.FloatTolerance) {
+						randomPrediction.Hit()
+						randomPrediction.Observe(trx, i)
+					}
+				}
 				node.AddChildren(newChild)
 				matchedPredictions = append(matchedPredictions, newChild[0])
+				nextReached[newChild[0]] = arrived
 			}
 			nextLevel = append(nextLevel, matchedPredictions...)
-			if len(nextLevel) > 10000 {
+			if len(nextLevel) > builder.Options.MaxLevelNodes {
+				builder.PruneReport.TruncatedLevels++
 				break
 			}
 		}
-		currentLevel = nextLevel
-		nextLevel = []*Node{}
-		builder.enumerateAllOperands(i, exampleTrx[i], &numOpsAllQueries, &strOpsAllQueries, &numListOpsAllQueries, &strListOpsAllQueries)
+		builder.enumerateAllOperands(i, query, &numOps, &strOps, &numListOps, &strListOps)
+		builder.updatePrefix(group, i+1, nextLevel, nextReached, numOps, strOps, numListOps, strListOps)
+	}
+}
+
+// LearnDecisions walks the transactions through the trees built from them,
+// and gives every node followed by different queries a decision on the
+// results of the earlier queries. It should be called after the model has
+// been updated with all the clusters, as each cluster only follows a node
+// with one query.
+func (builder *ModelBuilder) LearnDecisions(transactions [][]*Query, pt *PredictionTrees) {
+	samples := make(map[*Node][]decisionSample)
+	nodes := []*Node{}
+	for _, trx := range builder.foldTransactions(transactions) {
+		if len(trx) == 0 {
+			continue
+		}
+		node := pt.trees[trx[0].QueryID]
+		for i := 1; node != nil && i < len(trx); i++ {
+			if _, ok := samples[node]; !ok {
+				nodes = append(nodes, node)
+			}
+			samples[node] = append(samples[node], decisionSample{trx[:i], trx[i].QueryID})
+			var next *Node
+			for _, child := range node.Children {
+				prediction := child.Payload.(*Prediction)
+				if prediction.FollowsStep(trx, i, builder.Options.FloatTolerance) &&
+					(next == nil || prediction.HitCount > next.Payload.(*Prediction).HitCount) {
+					next = child
+				}
+			}
+			node = next
+		}
+	}
+	for _, node := range nodes {
+		node.Payload.(*Prediction).Decision = learnDecision(samples[node], maxDecisionDepth, builder.Options.DecisionLookBack)
 	}
 }
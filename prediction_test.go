@@ -4,9 +4,15 @@ import "testing"
 
 import "fmt"
 import "reflect"
+import "strings"
+import "time"
+import "bytes"
+import "os"
+import "path/filepath"
+import "math"
 
 func TestSplitTransactions(t *testing.T) {
-	modelBuilder := NewModelBuilder("test/small_workload_trace")
+	modelBuilder := NewModelBuilder("test/small_workload_trace", DefaultModelBuilderOptions())
 	for _, cluster := range modelBuilder.Clusters {
 		if modelBuilder.QuerySet.GetTemplate(cluster[0][0].QueryID) != "SELECT  `tags`.* FROM `tags`  WHERE `tags`.`tag` = '?s'  ORDER BY `tags`.`id` ASC LIMIT ?d" {
 			continue
@@ -35,7 +41,7 @@ func operandsEqual(ops1 []Operand, ops2 []Operand) bool {
 
 func TestEnumerateConstOperands(test *testing.T) {
 	sqlJSON := `{"sql":"SELECT tag_filters.* FROM tag_filters  WHERE tag_filters.user_id = 2 AND tag_filter.name = 'Google' AND tag_filters.tag_id IN (1, 2, 3, 4, 5) AND tag_filters.content IN ('a', 'b', 'c')","results":[[1,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,1],[2,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,2],[3,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,3]]}`
-	builder := NewModelBuilderFromContent(sqlJSON)
+	builder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
 	expectedNumOperands := [][]Operand{[]Operand{ConstOperand{2.0}}}
 	expectedStrOperands := [][]Operand{[]Operand{ConstOperand{"Google"}}}
 	actualNumOperands := [][]Operand{}
@@ -51,7 +57,7 @@ func TestEnumerateConstOperands(test *testing.T) {
 
 func TestEnumerateResultOperand(test *testing.T) {
 	sqlJSON := `{"sql":"SELECT tag_filters.* FROM tag_filters  WHERE tag_filters.user_id = 2 AND tag_filter.name = 'Google' AND tag_filters.tag_id IN (1, 2, 3, 4, 5) AND tag_filters.content IN ('a', 'b', 'c')","results":[[1,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,1]]}`
-	builder := NewModelBuilderFromContent(sqlJSON)
+	builder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
 	expectedNumOperands := []Operand{QueryResultOperand{0, 0, 0, 0}, QueryResultOperand{0, 0, 0, 3}, QueryResultOperand{0, 0, 0, 4}}
 	expectedStrOperands := []Operand{QueryResultOperand{0, 0, 0, 1}, QueryResultOperand{0, 0, 0, 2}}
 	actualNumOperands := []Operand{}
@@ -65,9 +71,124 @@ func TestEnumerateResultOperand(test *testing.T) {
 	}
 }
 
+func TestEnumerateMultiRowResultOperand(test *testing.T) {
+	sqlJSON := `{"sql":"SELECT id, name FROM users WHERE group_id = 2","results":[[1,"a"],[2,"b"],[3,"c"],[4,"d"]]}
+	{"sql":"SELECT * FROM tags WHERE user_id = 3","results":[]}`
+	builder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
+	expectedNumOperands := []Operand{QueryResultOperand{0, 0, 0, 0}, QueryResultOperand{0, 0, 1, 0}, QueryResultOperand{0, 0, 2, 0}, LastRowOperand{0, 0, 0}}
+	expectedStrOperands := []Operand{QueryResultOperand{0, 0, 0, 1}, QueryResultOperand{0, 0, 1, 1}, QueryResultOperand{0, 0, 2, 1}, LastRowOperand{0, 0, 1}}
+	actualNumOperands := []Operand{}
+	actualStrOperands := []Operand{}
+	builder.enumerateResultOperand(0, builder.Queries[0], &actualNumOperands, &actualStrOperands)
+	if !operandsEqual(expectedNumOperands, actualNumOperands) {
+		test.Fatalf("NumOperands wrong. Expected %v, got %v", expectedNumOperands, actualNumOperands)
+	}
+	if !operandsEqual(expectedStrOperands, actualStrOperands) {
+		test.Fatalf("StrOperands wrong. Expected %v, got %v", expectedStrOperands, actualStrOperands)
+	}
+
+	key := QueryArgumentOperand{1, 1, 0}
+	numLookups := []Operand{}
+	strLookups := []Operand{}
+	builder.enumerateKeyedLookupOperand(builder.Queries, 2, 2, [][]Operand{[]Operand{}, []Operand{key}}, &numLookups, &strLookups)
+	expectedLookup := KeyedLookupOperand{0, 0, 0, 1, key}
+	if len(numLookups) != 0 || len(strLookups) != 1 || !expectedLookup.Equal(strLookups[0]) {
+		test.Fatalf("Expecting lookup %v, got %v and %v", expectedLookup, numLookups, strLookups)
+	}
+	if value := strLookups[0].GetValue(builder.Queries); value != "c" {
+		test.Fatalf("Expecting lookup value c, got %v", value)
+	}
+}
+
+func TestEnumerateFormatOperand(test *testing.T) {
+	sqlJSON := `{"sql":"SELECT COUNT(*) FROM messages WHERE recipient_user_id = 313","results":[[119]]}
+	{"sql":"SELECT * FROM tags WHERE name LIKE 'lob%'","results":[]}
+	{"sql":"INSERT INTO keystores (key, value) VALUES ('user:313:unread_messages', 119)","results":{}}`
+	builder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
+	userID := QueryArgumentOperand{0, 0, 0}
+	count := QueryResultOperand{0, 0, 0, 0}
+	formatOps := []Operand{}
+	builder.enumerateFormatOperand(builder.Queries, builder.Queries[2], [][]Operand{[]Operand{userID, count}}, &formatOps)
+	expected := NewFormatOperand("user:%s:unread_messages", userID, nil)
+	if len(formatOps) != 1 || !expected.Equal(formatOps[0]) {
+		test.Fatalf("Expecting %v, got %v", expected, formatOps)
+	}
+	if value := formatOps[0].GetValue(builder.Queries); value != "user:313:unread_messages" {
+		test.Fatalf("Expecting user:313:unread_messages, got %v", value)
+	}
+
+	prefix := ConstOperand{"lob"}
+	formatOps = []Operand{}
+	builder.enumerateFormatOperand(builder.Queries, builder.Queries[1], [][]Operand{[]Operand{prefix}}, &formatOps)
+	if len(formatOps) != 1 || formatOps[0].GetValue(builder.Queries) != "lob%" {
+		test.Fatalf("Expecting a LIKE pattern, got %v", formatOps)
+	}
+}
+
+func TestEnumeratePaddedFormatOperand(test *testing.T) {
+	sqlJSON := `{"sql":"SELECT id FROM orders WHERE user_id = 7","results":[[42]]}
+	{"sql":"SELECT * FROM invoices WHERE number = 'INV-7-00042'","results":[]}`
+	builder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
+	userID := QueryArgumentOperand{0, 0, 0}
+	orderID := QueryResultOperand{0, 0, 0, 0}
+	formatOps := []Operand{}
+	builder.enumerateFormatOperand(builder.Queries, builder.Queries[1], [][]Operand{[]Operand{userID, orderID}}, &formatOps)
+	expected := NewFormatOperand("INV-%s-%05d", userID, orderID)
+	found := false
+	for _, op := range formatOps {
+		found = found || expected.Equal(op)
+	}
+	if !found {
+		test.Fatalf("Expecting %v, got %v", expected, formatOps)
+	}
+	builder.Queries[0].ResultSet[0][0] = float64(123456)
+	if value := expected.GetValue(builder.Queries); value != "INV-7-123456" {
+		test.Fatalf("Expecting INV-7-123456, got %v", value)
+	}
+	if value := NewFormatOperand("%05d", ConstOperand{1.5}, nil).GetValue(builder.Queries); value != nil {
+		test.Fatalf("Expecting no value for a fraction, got %v", value)
+	}
+}
+
+func TestEnumerateSwappedFormatOperand(test *testing.T) {
+	sqlJSON := `{"sql":"SELECT name FROM users WHERE id = 7","results":[["alice"]]}
+	{"sql":"SELECT * FROM posts WHERE slug = 'by-7-for-alice'","results":[]}`
+	builder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
+	userID := QueryArgumentOperand{0, 0, 0}
+	name := QueryResultOperand{0, 0, 0, 0}
+	formatOps := []Operand{}
+	builder.enumerateFormatOperand(builder.Queries, builder.Queries[1], [][]Operand{[]Operand{userID, name}}, &formatOps)
+	// The longer name is replaced first, yet it fills the second hole.
+	expected := NewFormatOperand("by-%s-for-%s", userID, name)
+	found := false
+	for _, op := range formatOps {
+		found = found || expected.Equal(op)
+	}
+	if !found {
+		test.Fatalf("Expecting %v, got %v", expected, formatOps)
+	}
+	if value := expected.GetValue(builder.Queries); value != "by-7-for-alice" {
+		test.Fatalf("Expecting by-7-for-alice, got %v", value)
+	}
+}
+
+func TestEnumeratePaddedZero(test *testing.T) {
+	sqlJSON := `{"sql":"SELECT COUNT(*) FROM orders WHERE user_id = 7","results":[[0]]}
+	{"sql":"SELECT * FROM invoices WHERE number = 'INV-000'","results":[]}`
+	builder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
+	count := QueryResultOperand{0, 0, 0, 0}
+	formatOps := []Operand{}
+	builder.enumerateFormatOperand(builder.Queries, builder.Queries[1], [][]Operand{[]Operand{count}}, &formatOps)
+	for _, op := range formatOps {
+		if strings.Contains(op.(FormatOperand).Format, "%03d") {
+			test.Fatalf("Expecting a zero not to match a run of zeros, got %v", op)
+		}
+	}
+}
+
 func TestEnumerateArgumentOperand(test *testing.T) {
 	sqlJSON := `{"sql":"SELECT tag_filters.* FROM tag_filters  WHERE tag_filters.user_id = 2 AND tag_filter.name = 'Google' AND tag_filters.tag_id IN (1, 2, 3, 4, 5) AND tag_filters.content IN ('a', 'b', 'c')","results":[[1,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,1],[2,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,2],[3,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,3]]}`
-	builder := NewModelBuilderFromContent(sqlJSON)
+	builder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
 	expectedNumOperands := []Operand{QueryArgumentOperand{0, 0, 0}}
 	expectedStrOperands := []Operand{QueryArgumentOperand{0, 0, 1}}
 	actualNumOperands := []Operand{}
@@ -83,7 +204,7 @@ func TestEnumerateArgumentOperand(test *testing.T) {
 
 func TestEnumerateArgumentListOperand(test *testing.T) {
 	sqlJSON := `{"sql":"SELECT tag_filters.* FROM tag_filters  WHERE tag_filters.user_id = 2 AND tag_filter.name = 'Google' AND tag_filters.tag_id IN (1, 2, 3, 4, 5) AND tag_filters.content IN ('a', 'b', 'c')","results":[[1,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,1],[2,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,2],[3,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,3]]}`
-	builder := NewModelBuilderFromContent(sqlJSON)
+	builder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
 	expectedNumOperands := []Operand{ArgumentListOperand{0, 0, 2}}
 	expectedStrOperands := []Operand{ArgumentListOperand{0, 0, 3}}
 	actualNumOperands := []Operand{}
@@ -99,7 +220,7 @@ func TestEnumerateArgumentListOperand(test *testing.T) {
 
 func TestEnumerateColumnListOperand(test *testing.T) {
 	sqlJSON := `{"sql":"SELECT tag_filters.* FROM tag_filters  WHERE tag_filters.user_id = 2 AND tag_filter.name = 'Google' AND tag_filters.tag_id IN (1, 2, 3, 4, 5) AND tag_filters.content IN ('a', 'b', 'c')","results":[[1,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,1],[2,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,2],[3,"2017-01-23T19:36:58.000Z","2017-01-23T19:36:58.000Z",2,3]]}`
-	builder := NewModelBuilderFromContent(sqlJSON)
+	builder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
 	expectedNumOperands := []Operand{ColumnListOperand{0, 0, 0}, ColumnListOperand{0, 0, 3}, ColumnListOperand{0, 0, 4}}
 	expectedStrOperands := []Operand{ColumnListOperand{0, 0, 1}, ColumnListOperand{0, 0, 2}}
 	actualNumOperands := []Operand{}
@@ -113,8 +234,29 @@ func TestEnumerateColumnListOperand(test *testing.T) {
 	}
 }
 
+func TestEnumerateAggregationOperand(test *testing.T) {
+	sqlJSON := `{"sql":"SELECT tag_filters.* FROM tag_filters  WHERE tag_filters.user_id = 2","results":[[1,"a",4],[2,"b",4],[3,"c",null]]}`
+	builder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
+	actualNumOperands := []Operand{}
+	builder.enumerateAggregationOperand(0, builder.Queries[0], &actualNumOperands, []Aggregator{SumAggregator, MaxAggregator})
+	expectedNumOperands := []Operand{AggregationOperand{0, 0, SumAggregator, 0}, AggregationOperand{0, 0, MaxAggregator, 0},
+		AggregationOperand{0, 0, SumAggregator, 2}, AggregationOperand{0, 0, MaxAggregator, 2}}
+	if !operandsEqual(expectedNumOperands, actualNumOperands) {
+		test.Fatalf("NumOperands wrong. Expected %v, got %v", expectedNumOperands, actualNumOperands)
+	}
+	if actualNumOperands[0].Equal(actualNumOperands[1]) {
+		test.Fatalf("Sum and max on the same column should differ")
+	}
+	expectedValues := []float64{6, 3, 8, 4}
+	for i, op := range actualNumOperands {
+		if !valueEqual(expectedValues[i], op.GetValue(builder.Queries)) {
+			test.Fatalf("Expecting %v for %s, got %v", expectedValues[i], op.ToString(), op.GetValue(builder.Queries))
+		}
+	}
+}
+
 func TestSearchForUnary(test *testing.T) {
-	modelBuilder := NewModelBuilder("test/small_workload_trace")
+	modelBuilder := NewModelBuilder("test/small_workload_trace", DefaultModelBuilderOptions())
 	targetCluster := [][]*Query{}
 	for _, cluster := range modelBuilder.Clusters {
 		if modelBuilder.QuerySet.GetTemplate(cluster[0][0].QueryID) == "SELECT  `tags`.* FROM `tags`  WHERE `tags`.`tag` = '?s'  ORDER BY `tags`.`id` ASC LIMIT 1" && len(cluster) > 10 {
@@ -137,11 +279,92 @@ func TestSearchForUnary(test *testing.T) {
 	}
 }
 
+func TestSearchForAffineOps(test *testing.T) {
+	trace := testTrace(3, func(i int) []traceQuery {
+		hits := []int{10000, 12, 345}[i]
+		return []traceQuery{{"SELECT * FROM keystores WHERE key = 'traffic:hits'", fmt.Sprintf(`[["traffic:hits",%d]]`, hits)},
+			{fmt.Sprintf("UPDATE keystores SET value = %d WHERE key = 'traffic:hits'", hits*2+1), "{}"}}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	transactions := modelBuilder.Clusters[0]
+	hits := QueryResultOperand{transactions[0][0].QueryID, 0, 0, 1}
+	affineOps := modelBuilder.searchForAffineOps(transactions, [][]Operand{[]Operand{ConstOperand{10000.0}, hits}}, 1, 0)
+	expectedOps := []Operation{UnaryOperation{AffineOperand{hits, 2, 1}}}
+	if !reflect.DeepEqual(expectedOps, affineOps) {
+		test.Fatalf("Expecting %+v, got %+v\n", expectedOps, affineOps)
+	}
+	nodes := modelBuilder.enumeratePredictionsForQuery(nil, transactions, 1, [][]Operand{[]Operand{hits}}, [][]Operand{[]Operand{ConstOperand{"traffic:hits"}}}, [][]Operand{[]Operand{}}, [][]Operand{[]Operand{}})
+	if len(nodes) != 1 || nodes[0].Payload.(*Prediction).IsRandom {
+		test.Fatalf("Expecting a single non-random prediction, got %d", len(nodes))
+	}
+	for _, trx := range transactions {
+		if !nodes[0].Payload.(*Prediction).MatchesQuery(trx, trx[1], modelBuilder.Options.FloatTolerance) {
+			test.Fatalf("Expecting %s to match %+v", nodes[0].Payload.(*Prediction).ParamOps[0].ToString(), trx[1])
+		}
+	}
+}
+
+func TestUpdateModelReusesChildren(test *testing.T) {
+	trace := testTrace(5, func(i int) []traceQuery {
+		return []traceQuery{userQuery(i, i+10), storiesQuery(i + 10)}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	size := pt.Size()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	root := pt.trees[modelBuilder.Clusters[0][0][0].QueryID]
+	// The existing predictions for the query are updated, not enumerated again.
+	if pt.Size() != size || root.Children[0].Payload.(*Prediction).HitCount != 10 {
+		test.Fatalf("Expecting the %d nodes to be reused, got %d", size, pt.Size())
+	}
+}
+
+func TestLookBackOption(test *testing.T) {
+	trace := testTrace(5, func(i int) []traceQuery {
+		return []traceQuery{userQuery(i, i+10), {fmt.Sprintf("SELECT * FROM tags WHERE id = %d", i+20), "[]"}, storiesQuery(i + 10)}
+	})
+	for lookBack, random := range map[int]bool{2: true, 3: false} {
+		options := DefaultModelBuilderOptions()
+		options.LookBack = lookBack
+		modelBuilder := NewModelBuilderFromContent(trace, options)
+		pt := NewPredictionTrees()
+		modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+		stories := pt.trees[modelBuilder.Clusters[0][0][0].QueryID].Children[0].Children[0].Payload.(*Prediction)
+		if stories.IsRandom != random {
+			test.Fatalf("Expecting the stories to be random with a look back of %d: %v", lookBack, random)
+		}
+		if *pt.Options != options {
+			test.Fatalf("Expecting the trees to record their options")
+		}
+	}
+}
+
+func TestFloatToleranceOption(test *testing.T) {
+	trace := testTrace(6, func(i int) []traceQuery {
+		// The stories are looked up by the user's karma, rounded either way.
+		karma := float64(i+10) + 0.001*float64(1-2*(i%2))
+		return []traceQuery{{fmt.Sprintf("SELECT karma FROM users WHERE id = %d", i), fmt.Sprintf("[[%d]]", i+10)},
+			{fmt.Sprintf("SELECT * FROM stories WHERE karma = %.3f", karma), "[]"}}
+	})
+	for tolerance, random := range map[float64]bool{defaultFloatTolerance: true, 0.01: false} {
+		options := DefaultModelBuilderOptions()
+		options.FloatTolerance = tolerance
+		modelBuilder := NewModelBuilderFromContent(trace, options)
+		pt := NewPredictionTrees()
+		modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+		stories := pt.trees[modelBuilder.Clusters[0][0][0].QueryID].Children[0].Payload.(*Prediction)
+		if stories.IsRandom != random || (!random && stories.ParamOps[0].ToString() != "Query0[0,0]") {
+			test.Fatalf("Expecting the stories to be random with a tolerance of %v: %v, got %s", tolerance, random, stories.ParamOps[0].ToString())
+		}
+	}
+}
+
 func TestCollapseOperands(test *testing.T) {
 	sqlJSON := `{"sql":"SELECT * FROM users WHERE id = 0","results":[[1], [2], [3]]}
 	{"sql":"SELECT * FROM tags WHERE id IN (1, 2, 3)","results":[[1]]}
 	{"sql":"SELECT * FROM tag_filters WHERE id IN (1, 2, 3)","results":[[1]]}`
-	modelBuilder := NewModelBuilderFromContent(sqlJSON)
+	modelBuilder := NewModelBuilderFromContent(sqlJSON, DefaultModelBuilderOptions())
 	const0 := ConstOperand{0}
 	constsList := []Operand{const0, const0}
 	columnListOp := ColumnListOperand{0, 0, 0}
@@ -186,7 +409,7 @@ func nodesEqual(nodes1 []*Node, nodes2 []*Node) bool {
 }
 
 func TestEnumeratePredictionsForQuery(test *testing.T) {
-	modelBuilder := NewModelBuilder("test/small_workload_trace")
+	modelBuilder := NewModelBuilder("test/small_workload_trace", DefaultModelBuilderOptions())
 	targetCluster := [][]*Query{}
 	for _, cluster := range modelBuilder.Clusters {
 		if modelBuilder.QuerySet.GetTemplate(cluster[0][0].QueryID) == "SELECT  `tags`.* FROM `tags`  WHERE `tags`.`tag` = '?s'  ORDER BY `tags`.`id` ASC LIMIT 1" && len(cluster) > 10 {
@@ -207,7 +430,7 @@ func TestEnumeratePredictionsForQuery(test *testing.T) {
 	expectedNodes := []*Node{NewNode(NewPrediction(targetCluster[0][4].QueryID, unaries), nil)}
 	for _, node := range nodes {
 		for _, trx := range targetCluster {
-			if !node.Payload.(*Prediction).MatchesQuery(trx, trx[4]) {
+			if !node.Payload.(*Prediction).MatchesQuery(trx, trx[4], modelBuilder.Options.FloatTolerance) {
 				test.Fail()
 			}
 		}
@@ -233,7 +456,7 @@ func PredictionTreeEqual(tree1 *Node, tree2 *Node) bool {
 }
 
 func TestBuildOrUpdateTrees(t *testing.T) {
-	modelBuilder := NewModelBuilder("test/bug.log")
+	modelBuilder := NewModelBuilder("test/bug.log", DefaultModelBuilderOptions())
 	targetCluster := [][]*Query{}
 	pt := NewPredictionTrees()
 	fmt.Println(modelBuilder.QuerySet.GetTemplate(modelBuilder.Clusters[0][0][3].QueryID))
@@ -267,21 +490,630 @@ func TestBuildOrUpdateTrees(t *testing.T) {
 }
 
 func TestBuildOrUpdateSingleTree(t *testing.T) {
-	modelBuilder := NewModelBuilder("test/single_tree")
+	modelBuilder := NewModelBuilder("test/single_tree", DefaultModelBuilderOptions())
+	if len(modelBuilder.Clusters) != 1 {
+		t.Fatalf("Expecting the reads in different orders to be in one cluster, got %d clusters", len(modelBuilder.Clusters))
+	}
 	pt := NewPredictionTrees()
-	for i, cluster := range modelBuilder.Clusters {
-		fmt.Printf("Cluster %d\n", i)
-		modelBuilder.UpdateModel(cluster, pt)
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	targetCluster := modelBuilder.Clusters[0]
+	root := pt.GetTreeWithRoot(targetCluster[0][0].QueryID, 0)
+	fmt.Println(root.ToString())
+	if len(root.Children) != 1 || len(root.Children[0].Payload.(*Prediction).Members) != 4 {
+		t.Fatalf("Expecting a single group of 4 reads")
+	}
+	if hits := root.Children[0].Payload.(*Prediction).HitCount; hits != 3 {
+		t.Fatalf("Expecting the group to hit all 3 transactions, got %d", hits)
 	}
-	targetCluster := modelBuilder.Clusters[1]
-	fmt.Println(pt.GetTreeWithRoot(targetCluster[0][0].QueryID, 0).ToString())
 
 	predictor := pt.NewPredictor(modelBuilder.QuerySet)
-	trx := targetCluster[0]
+	trx := targetCluster[len(targetCluster)-1]
 	predictor.MoveToNext(trx[0])
-	for _, query := range trx[1:] {
-		prediction := predictor.PredictNextQuery()
-		fmt.Printf("%+v\n", prediction)
+	for i, query := range trx[1:] {
+		candidates := predictor.PredictNext()
+		if len(candidates) != 4-i {
+			t.Fatalf("Expecting the %d reads left to be predicted, got %d", 4-i, len(candidates))
+		}
+		found := false
+		for _, candidate := range candidates {
+			found = found || candidate.Query.Same(query)
+		}
+		if !found {
+			t.Fatalf("Expecting %d to be among the candidates", query.QueryID)
+		}
 		predictor.MoveToNext(query)
+		if predictor.currentNode == nil {
+			t.Fatalf("Expecting the reads to be accepted in any order")
+		}
+	}
+}
+
+func TestGroupWithRandomFirstMember(t *testing.T) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		name := []string{"ruby", "go", "sql", "web", "ai", "db", "ux", "os", "ml", "js"}[i]
+		tags := traceQuery{fmt.Sprintf("SELECT * FROM tags WHERE name = '%s'", name), "[]"}
+		if i%2 == 0 {
+			return []traceQuery{userQuery(i, i), tags, storiesQuery(i)}
+		}
+		return []traceQuery{userQuery(i, i), storiesQuery(i), tags}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	if len(modelBuilder.Clusters) != 1 {
+		t.Fatalf("Expecting the reads in different orders to be in one cluster, got %d clusters", len(modelBuilder.Clusters))
+	}
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	users := NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM users WHERE id = 42","results":[[42]]}`)
+	stories := NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM stories WHERE user_id = 42","results":[]}`)
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	predictor.MoveToNext(users)
+	if group := pt.trees[users.QueryID].Children[0].Payload.(*Prediction); !group.IsGroup() || !group.Members[0].IsRandom {
+		t.Fatalf("Expecting a group whose first member is random")
+	}
+	if prediction := predictor.PredictNextQuery(); !stories.Same(prediction) {
+		t.Fatalf("Expecting the stories to be predicted, got %+v", prediction)
+	}
+}
+
+// followersTrace returns a trace whose i-th transaction looks up the
+// followers of a user, then every one of them, then the user's settings.
+func followersTrace(followers [][]int) string {
+	return testTrace(len(followers), func(i int) []traceQuery {
+		userID := i + 5
+		rows := make([]string, len(followers[i]))
+		users := []traceQuery{}
+		for j, id := range followers[i] {
+			rows[j] = fmt.Sprintf("[%d]", id)
+			users = append(users, traceQuery{fmt.Sprintf("SELECT * FROM users WHERE id = %d", id), fmt.Sprintf(`[[%d,"name"]]`, id)})
+		}
+		queries := []traceQuery{{fmt.Sprintf("SELECT id FROM followers WHERE user_id = %d", userID), "[" + strings.Join(rows, ",") + "]"}}
+		queries = append(queries, users...)
+		return append(queries, traceQuery{fmt.Sprintf("SELECT * FROM settings WHERE user_id = %d", userID), "[]"})
+	})
+}
+
+func TestLoopPrediction(t *testing.T) {
+	trace := followersTrace([][]int{[]int{11, 12, 13}, []int{21, 22}, []int{31, 32, 33, 34}})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	if len(modelBuilder.Clusters) != 1 {
+		t.Fatalf("Expecting transactions with different loop lengths in one cluster, got %d clusters", len(modelBuilder.Clusters))
+	}
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	for _, trx := range modelBuilder.Clusters[0] {
+		predictor.MoveToNext(trx[0])
+		for _, query := range trx[1:] {
+			prediction := predictor.PredictNextQuery()
+			if !query.Same(prediction) {
+				t.Fatalf("Expecting %s, got %+v", query.GetSQL(modelBuilder.QuerySet), prediction)
+			}
+			predictor.MoveToNext(query)
+		}
+		predictor.EndTransaction()
+	}
+}
+
+func TestShortLoopPrediction(t *testing.T) {
+	trace := followersTrace([][]int{[]int{11, 12, 13}, []int{21}, []int{31, 32, 33, 34}, []int{}, []int{51}, []int{}})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	if len(modelBuilder.Clusters) != 1 {
+		t.Fatalf("Expecting loops of 0 and 1 iterations to be folded too, got %d clusters", len(modelBuilder.Clusters))
+	}
+	for _, trx := range modelBuilder.Transactions {
+		if folded := modelBuilder.foldSteps(trx); len(folded) != 3 || !folded[1].IsLoop() {
+			t.Fatalf("Expecting the users to be folded into a loop, got %d steps", len(folded))
+		}
+	}
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	for _, trx := range modelBuilder.Clusters[0] {
+		predictor.MoveToNext(trx[0])
+		for _, query := range trx[1:] {
+			prediction := predictor.PredictNextQuery()
+			if !query.Same(prediction) {
+				t.Fatalf("Expecting %s, got %+v", query.GetSQL(modelBuilder.QuerySet), prediction)
+			}
+			predictor.MoveToNext(query)
+		}
+		predictor.EndTransaction()
+	}
+
+	// A single lookup of a single row is not a loop without longer runs.
+	trace = testTrace(3, func(i int) []traceQuery {
+		return []traceQuery{{fmt.Sprintf("SELECT id FROM followers WHERE user_id = %d", i), fmt.Sprintf("[[%d]]", i+10)},
+			{fmt.Sprintf("SELECT * FROM users WHERE id = %d", i+10), fmt.Sprintf(`[[%d,"name"]]`, i+10)}}
+	})
+	modelBuilder = NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	if folded := modelBuilder.foldSteps(modelBuilder.Transactions[0]); folded[1].IsLoop() {
+		t.Fatalf("Not expecting a loop of one iteration without longer ones")
+	}
+}
+
+type fixedClock struct {
+	now time.Time
+}
+
+func (clock fixedClock) Now() time.Time {
+	return clock.now
+}
+
+func TestTimestampPrediction(t *testing.T) {
+	trace := ""
+	starts := []string{"2017-01-24T18:20:31Z", "2017-01-25T09:02:11Z", "2017-02-01T23:59:59Z"}
+	for i, start := range starts {
+		trace += fmt.Sprintf(`{"sql":"BEGIN","results":{},"time":"%s"}`, start) + "\n"
+		trace += fmt.Sprintf(`{"sql":"SELECT * FROM stories WHERE id = %d","results":[[%d,"2017-01-2%dT19:36:58.000Z"]],"time":"%s"}`, i, i, i, start) + "\n"
+		startTime, _ := time.Parse(time.RFC3339, start)
+		createdAt := startTime.Truncate(time.Hour).Format("2006-01-02 15:04:05")
+		expiresAt := fmt.Sprintf("2017-01-2%d", i+1)
+		trace += fmt.Sprintf(`{"sql":"INSERT INTO votes (story_id, created_at, expires_at) VALUES (%d, '%s', '%s')","results":{}}`, i, createdAt, expiresAt) + "\n"
+		trace += `{"sql":"COMMIT","results":{}}` + "\n"
+	}
+	modelBuilder := NewModelBuilderFromContent(strings.TrimSpace(trace), DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	predictor.SetClock(fixedClock{time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)})
+	stories := NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM stories WHERE id = 7","results":[[7,"2018-03-01T10:00:00.000Z"]]}`)
+	predictor.MoveToNext(stories)
+	prediction := pt.trees[stories.QueryID].Children[0].Payload.(*Prediction).predictQuery(predictor.currentTrx)
+	expected := []interface{}{7.0, "2018-03-04 05:00:00", "2018-03-02"}
+	if !sliceEqual(expected, prediction.Arguments) {
+		t.Fatalf("Expecting %v, got %v", expected, prediction.Arguments)
+	}
+	if !stories.Time.IsZero() {
+		t.Fatalf("Expecting the query given to be left without a time, got %v", stories.Time)
+	}
+}
+
+func TestDistributionPrediction(t *testing.T) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		key := "traffic:hits"
+		if i == 3 {
+			key = "traffic:date"
+		}
+		return []traceQuery{userQuery(i, i), keystoresQuery(key)}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	predictor.MoveToNext(modelBuilder.Clusters[0][0][0])
+	prediction := predictor.PredictNextQuery()
+	if prediction == nil || !sliceEqual(prediction.Arguments, []interface{}{"traffic:hits"}) {
+		t.Fatalf("Expecting the dominant key, got %+v", prediction)
+	}
+	candidates := predictor.currentNode.Children[0].Payload.(*Prediction).TopCandidates(0, 5)
+	if len(candidates) != 2 || candidates[0].Count != 9 || candidates[1].Value != "traffic:date" {
+		t.Fatalf("Unexpected candidates %+v", candidates)
+	}
+}
+
+func TestDistributionMisses(t *testing.T) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		key := "traffic:hits"
+		if i == 7 {
+			key = "traffic:date"
+		}
+		return []traceQuery{userQuery(i, i), keystoresQuery(key)}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	root := pt.trees[modelBuilder.Clusters[0][0][0].QueryID]
+	if len(root.Children) != 1 {
+		t.Fatalf("Expecting the wrong guess to go on through the same node, got %d children", len(root.Children))
+	}
+	keystores := root.Children[0].Payload.(*Prediction)
+	distribution, ok := keystores.ParamOps[0].(DistributionOperation)
+	if !ok || keystores.HitCount != 9 {
+		t.Fatalf("Expecting the other key to be a miss of the distribution, got %d hits", keystores.HitCount)
+	}
+	if distribution.MatchesValue(nil, "traffic:date", 0) || !distribution.MatchesValue(nil, "traffic:hits", 0) {
+		t.Fatalf("Expecting only the dominant key to match")
+	}
+	if distribution.Sketch == keystores.Sketches[0] {
+		t.Fatalf("Expecting the distribution to keep a copy of the sketch")
+	}
+	keystores.Observe(modelBuilder.Clusters[0][7], 1)
+	if distribution.Sketch.Total() != 10 {
+		t.Fatalf("Expecting the copy not to be updated by later observations, got %d values", distribution.Sketch.Total())
+	}
+}
+
+func TestPredictNext(t *testing.T) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		if i%10 < 7 {
+			return []traceQuery{userQuery(i, i), storiesQuery(i)}
+		}
+		// The user ID is both an argument and a result, so comments get two children.
+		return []traceQuery{userQuery(i, i), {fmt.Sprintf("SELECT * FROM comments WHERE user_id = %d", i), "[]"}}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	for _, cluster := range modelBuilder.Clusters {
+		modelBuilder.UpdateModel(cluster, pt)
+	}
+	users := NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM users WHERE id = 42","results":[[42]]}`)
+	stories := NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM stories WHERE user_id = 42","results":[]}`)
+	comments := NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM comments WHERE user_id = 42","results":[]}`)
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	predictor.MoveToNext(users)
+	candidates := predictor.PredictNext()
+	if len(candidates) != 2 || !candidates[0].Query.Same(stories) || !candidates[1].Query.Same(comments) {
+		t.Fatalf("Unexpected candidates %+v", candidates)
+	}
+	if !floatEqual(candidates[0].Probability, 0.7) || !floatEqual(candidates[1].Probability, 0.3) {
+		t.Fatalf("Expecting probabilities 0.7 and 0.3, got %v and %v", candidates[0].Probability, candidates[1].Probability)
+	}
+	if !predictor.PredictNextQuery().Same(stories) {
+		t.Fatalf("Expecting the most frequent transition to be predicted")
+	}
+	predictor.MoveToNext(stories)
+	if hits := predictor.currentNode.Payload.(*Prediction).SpeculationHits; hits != 1 {
+		t.Fatalf("Expecting one speculation hit, got %d", hits)
+	}
+}
+
+func TestConfidenceCalibration(t *testing.T) {
+	trace := testTrace(200, func(i int) []traceQuery {
+		if i%10 < 6 {
+			return []traceQuery{userQuery(i, i), storiesQuery(i)}
+		}
+		key := "traffic:hits"
+		if i%20 == 9 {
+			key = "traffic:date"
+		}
+		return []traceQuery{userQuery(i, i), keystoresQuery(key)}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Transactions[:100], pt)
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	predicted := make(map[int]float64)
+	hits := make(map[int]int)
+	held := modelBuilder.Transactions[100:]
+	for _, trx := range held {
+		predictor.MoveToNext(trx[0])
+		for _, candidate := range predictor.PredictNext() {
+			predicted[candidate.Query.QueryID] += candidate.Probability
+			if candidate.Query.Same(trx[1]) {
+				hits[candidate.Query.QueryID]++
+			}
+		}
+		predictor.EndTransaction()
+	}
+	if len(predicted) != 2 {
+		t.Fatalf("Expecting the stories and the keystores to be predicted, got %v", predicted)
+	}
+	for queryID, sum := range predicted {
+		probability := sum / float64(len(held))
+		frequency := float64(hits[queryID]) / float64(len(held))
+		if math.Abs(probability-frequency) > 0.03 {
+			t.Fatalf("Expecting the probability %.3f of query %d to be close to its frequency %.3f", probability, queryID, frequency)
+		}
+	}
+}
+
+func TestPredictTopK(t *testing.T) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		if i < 5 {
+			return []traceQuery{userQuery(i, i), storiesQuery(i)}
+		}
+		return []traceQuery{userQuery(i, i), keystoresQuery([]string{"b", "b", "c", "b", "b"}[i-5])}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	for _, cluster := range modelBuilder.Clusters {
+		modelBuilder.UpdateModel(cluster, pt)
+	}
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	predictor.MoveToNext(NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM users WHERE id = 42","results":[[42]]}`))
+	candidates := predictor.PredictTopK(3)
+	expectedArguments := [][]interface{}{[]interface{}{42.0}, []interface{}{"b"}, []interface{}{"c"}}
+	// The keys were all hits of the keystores, as none dominated before the last one,
+	// and c is guessed relative to b.
+	expectedProbabilities := []float64{0.5, 0.5, 0.5 * 0.25}
+	if len(candidates) != 3 {
+		t.Fatalf("Expecting 3 candidates, got %+v", candidates)
+	}
+	for i, candidate := range candidates {
+		if !sliceEqual(expectedArguments[i], candidate.Query.Arguments) || !floatEqual(expectedProbabilities[i], candidate.Probability) {
+			t.Fatalf("Expecting %v with %v, got %v with %v", expectedArguments[i], expectedProbabilities[i], candidate.Query.Arguments, candidate.Probability)
+		}
+	}
+}
+
+func TestPredictTopKRandomArguments(t *testing.T) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		return []traceQuery{userQuery(i, i), keystoresQuery([]string{"a", "b", "c", "a", "d"}[i%5])}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	users := NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM users WHERE id = 42","results":[[42]]}`)
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	predictor.MoveToNext(users)
+	if predictor.PredictNextQuery() != nil {
+		t.Fatalf("Not expecting a random key to be the prediction")
+	}
+	candidates := predictor.PredictTopK(3)
+	if len(candidates) != 3 || !sliceEqual(candidates[0].Query.Arguments, []interface{}{"a"}) || !floatEqual(candidates[0].Probability, 0.4) ||
+		!floatEqual(candidates[1].Probability, 0.2) {
+		t.Fatalf("Expecting the most frequent keys to be guessed, got %+v", candidates)
+	}
+	// The guesses are a single outcome of the keystores prediction.
+	predictor.MoveToNext(modelBuilder.Clusters[0][1][1])
+	keystores := pt.trees[users.QueryID].Children[0].Payload.(*Prediction)
+	if keystores.SpeculationHits != 1 || keystores.SpeculationMisses != 0 {
+		t.Fatalf("Expecting one hit and no miss, got %d and %d", keystores.SpeculationHits, keystores.SpeculationMisses)
+	}
+}
+
+func TestPredictAhead(t *testing.T) {
+	trace := testTrace(5, func(i int) []traceQuery {
+		return []traceQuery{userQuery(i, i),
+			{fmt.Sprintf("SELECT story_id FROM votes WHERE user_id = %d", i), fmt.Sprintf("[[%d]]", i+100)},
+			{fmt.Sprintf("SELECT * FROM hats WHERE user_id = %d", i), "[]"},
+			{fmt.Sprintf("SELECT * FROM stories WHERE id = %d", i+100), "[]"}}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	predictor.MoveToNext(NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM users WHERE id = 42","results":[[42]]}`))
+	chain := predictor.PredictAhead(5)
+	if len(chain) != 2 || !sliceEqual(chain[0].Query.Arguments, []interface{}{42.0}) || !sliceEqual(chain[1].Query.Arguments, []interface{}{42.0}) {
+		t.Fatalf("Expecting to stop before the query using the result of votes, got %d queries", len(chain))
+	}
+	chain = predictor.PredictAhead(5, [][]interface{}{[]interface{}{142.0}})
+	if len(chain) != 3 || !sliceEqual(chain[2].Query.Arguments, []interface{}{142.0}) {
+		t.Fatalf("Expecting the result of votes to extend the chain, got %d queries", len(chain))
+	}
+}
+
+func TestPredictWrites(t *testing.T) {
+	trace := testTrace(5, func(i int) []traceQuery {
+		return []traceQuery{userQuery(i, i), {fmt.Sprintf("UPDATE users SET last_seen = 'now' WHERE id = %d", i), "[]"}}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	predictor := pt.NewPredictor(modelBuilder.QuerySet)
+	predictor.MoveToNext(NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM users WHERE id = 42","results":[[42]]}`))
+	if query := predictor.PredictNextQuery(); query != nil {
+		t.Fatalf("Not expecting a write to be predicted by default, got %+v", query)
+	}
+	if len(predictor.PredictNext()) != 0 || len(predictor.PredictTopK(3)) != 0 || len(predictor.PredictAhead(3)) != 0 {
+		t.Fatalf("Not expecting write candidates by default")
+	}
+	predictor.EnableWritePrediction()
+	if candidates := predictor.PredictNext(); len(candidates) != 1 || !candidates[0].Unsafe || candidates[0].Query.IsSelect {
+		t.Fatalf("Expecting the write candidate to be flagged as unsafe")
+	}
+	if candidates := predictor.PredictTopK(3); len(candidates) != 1 || !candidates[0].Unsafe {
+		t.Fatalf("Expecting the top candidates to include the write")
+	}
+	if chain := predictor.PredictAhead(3); len(chain) != 1 || !chain[0].Unsafe {
+		t.Fatalf("Expecting the chain to include the write")
+	}
+	query, explanation := predictor.PredictNextExplained()
+	if query == nil || query.IsSelect || !sliceEqual(query.Arguments, []interface{}{"now", 42.0}) {
+		t.Fatalf("Expecting the write to be predicted, got %+v", query)
+	}
+	if !explanation.Unsafe || !strings.Contains(explanation.ToString(), "unsafe write") {
+		t.Fatalf("Expecting the explanation to flag the write, got %s", explanation.ToString())
+	}
+}
+
+func TestLockingReadsAreUnsafe(t *testing.T) {
+	modelBuilder := NewModelBuilder("test/small_workload_trace", DefaultModelBuilderOptions())
+	predictor := NewPredictionTrees().NewPredictor(modelBuilder.QuerySet)
+	locking := 0
+	for _, query := range modelBuilder.Queries {
+		if !strings.Contains(strings.ToUpper(query.GetSQL(modelBuilder.QuerySet)), "FOR UPDATE") {
+			continue
+		}
+		locking++
+		if predictor.isRead(query.QueryID) {
+			t.Fatalf("Expecting %s not to be a safe read", query.GetSQL(modelBuilder.QuerySet))
+		}
+	}
+	if locking != 80 {
+		t.Fatalf("Expecting 80 locking reads in the trace, got %d", locking)
+	}
+	for _, template := range []string{"select * from t where id = ? for share", "SELECT * FROM t WHERE id = ?\nLOCK IN SHARE MODE", "select * from t for update"} {
+		if isReadTemplate(template) {
+			t.Fatalf("Expecting %q not to be a safe read", template)
+		}
+	}
+	if !isReadTemplate("select * from t where id = ?") {
+		t.Fatalf("Expecting a lowercase SELECT to be a read")
+	}
+}
+
+func TestOnlineLearning(t *testing.T) {
+	trace := testTrace(5, func(i int) []traceQuery {
+		return []traceQuery{userQuery(i, i), storiesQuery(i)}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	predictor := NewPredictionTrees().NewPredictor(modelBuilder.QuerySet)
+	predictor.EnableOnlineLearning(modelBuilder, 3)
+	for i, trx := range modelBuilder.Clusters[0] {
+		predictor.MoveToNext(trx[0])
+		prediction := predictor.PredictNextQuery()
+		if i < 3 && prediction != nil {
+			t.Fatalf("Not expecting a prediction before learning from enough transactions, got %+v", prediction)
+		}
+		if i >= 3 && !trx[1].Same(prediction) {
+			t.Fatalf("Expecting %+v after learning, got %+v", trx[1], prediction)
+		}
+		predictor.MoveToNext(trx[1])
+		predictor.EndTransaction()
+	}
+}
+
+func TestOnlineLearningFromCommit(t *testing.T) {
+	trace := testTrace(5, func(i int) []traceQuery {
+		return []traceQuery{userQuery(i, i), storiesQuery(i)}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	predictor := NewPredictionTrees().NewPredictor(modelBuilder.QuerySet)
+	predictor.EnableOnlineLearning(modelBuilder, 3)
+	// The transactions end with their COMMIT only, without EndTransaction.
+	for i := 0; i < 4; i++ {
+		for _, query := range modelBuilder.Queries[4*i : 4*i+2] {
+			predictor.MoveToNext(query)
+		}
+		prediction := predictor.PredictNextQuery()
+		if i == 3 && !modelBuilder.Queries[4*i+2].Same(prediction) {
+			t.Fatalf("Expecting %+v after learning, got %+v", modelBuilder.Queries[4*i+2], prediction)
+		}
+		for _, query := range modelBuilder.Queries[4*i+2 : 4*i+4] {
+			predictor.MoveToNext(query)
+		}
+	}
+}
+
+func TestFuzzyClusterTransactions(t *testing.T) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		if i%3 == 0 {
+			// An optional query at the end of the transaction.
+			return []traceQuery{userQuery(i, i), storiesQuery(i), {fmt.Sprintf("SELECT * FROM audits WHERE user_id = %d", i), "[]"}}
+		}
+		return []traceQuery{userQuery(i, i), storiesQuery(i)}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	if len(modelBuilder.Clusters) != 2 {
+		t.Fatalf("Expecting 2 exact clusters, got %d", len(modelBuilder.Clusters))
+	}
+	modelBuilder.FuzzyClusterTransactions()
+	if len(modelBuilder.Clusters) != 1 || len(modelBuilder.Clusters[0]) != 10 {
+		t.Fatalf("Expecting one cluster of 10 transactions, got %d clusters", len(modelBuilder.Clusters))
+	}
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Clusters[0], pt)
+	users := modelBuilder.Clusters[0][0][0]
+	root := pt.GetTreeWithRoot(users.QueryID, len(users.Arguments))
+	stories := modelBuilder.Clusters[0][0][1]
+	if transitions := root.Payload.(*Prediction).Transitions[stories.QueryID]; transitions != 10 {
+		t.Fatalf("Expecting the shared prefix to be trained on 10 transactions, got %d", transitions)
+	}
+	for _, child := range root.Children {
+		prediction := child.Payload.(*Prediction)
+		if prediction.HitCount != 10 {
+			t.Fatalf("Expecting %+v to hit all 10 transactions, got %d", prediction, prediction.HitCount)
+		}
+		if len(child.Children) == 0 {
+			t.Fatalf("Expecting the optional query to be trained")
+		}
+		for _, grandChild := range child.Children {
+			if hits := grandChild.Payload.(*Prediction).HitCount; hits != 4 {
+				t.Fatalf("Expecting the optional query to hit 4 transactions, got %d", hits)
+			}
+		}
+	}
+}
+
+func TestLearnDecisions(t *testing.T) {
+	trace := testTrace(12, func(i int) []traceQuery {
+		users := fmt.Sprintf("SELECT * FROM users WHERE id = %d", i)
+		switch {
+		case i < 6:
+			return []traceQuery{{users, fmt.Sprintf(`[[%d, "active"]]`, i)}, storiesQuery(i)}
+		case i < 10:
+			return []traceQuery{{users, fmt.Sprintf(`[[%d, "banned"]]`, i)}, {fmt.Sprintf("SELECT * FROM bans WHERE user_id = %d", i), "[]"}}
+		default:
+			return []traceQuery{{users, "[]"}, {fmt.Sprintf("SELECT * FROM invites WHERE id = %d", i), "[]"}}
+		}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	for _, cluster := range modelBuilder.Clusters {
+		modelBuilder.UpdateModel(cluster, pt)
+	}
+	modelBuilder.LearnDecisions(modelBuilder.Transactions, pt)
+	parser := NewQueryParser(modelBuilder.QuerySet)
+	cases := []struct {
+		users    string
+		expected string
+	}{
+		{`{"sql":"SELECT * FROM users WHERE id = 42","results":[[42, "active"]]}`, `{"sql":"SELECT * FROM stories WHERE user_id = 42","results":[]}`},
+		{`{"sql":"SELECT * FROM users WHERE id = 42","results":[[42, "banned"]]}`, `{"sql":"SELECT * FROM bans WHERE user_id = 42","results":[]}`},
+		{`{"sql":"SELECT * FROM users WHERE id = 42","results":[]}`, `{"sql":"SELECT * FROM invites WHERE id = 42","results":[]}`},
+	}
+	for _, c := range cases {
+		predictor := pt.NewPredictor(modelBuilder.QuerySet)
+		predictor.MoveToNext(parser.ParseQuery(c.users))
+		prediction := predictor.PredictNextQuery()
+		if !parser.ParseQuery(c.expected).Same(prediction) {
+			t.Fatalf("Expecting %s after %s, got %+v", c.expected, c.users, prediction)
+		}
+	}
+	modelBuilder.Options.DecisionLookBack = 0
+	modelBuilder.LearnDecisions(modelBuilder.Transactions, pt)
+	if decision := pt.trees[modelBuilder.Transactions[0][0].QueryID].Payload.(*Prediction).Decision; decision != nil {
+		t.Fatalf("Expecting no decision without looking back, got %+v", decision)
+	}
+}
+
+func TestDecisionsIgnoreIDs(t *testing.T) {
+	trace := testTrace(10, func(i int) []traceQuery {
+		next := "comments"
+		if i == 0 || i == 3 || i == 4 || i == 7 || i == 9 {
+			next = "stories"
+		}
+		return []traceQuery{userQuery(i, i), {fmt.Sprintf("SELECT * FROM %s WHERE user_id = %d", next, i), "[]"}}
+	})
+	modelBuilder := NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+	pt := NewPredictionTrees()
+	for _, cluster := range modelBuilder.Clusters {
+		modelBuilder.UpdateModel(cluster, pt)
+	}
+	modelBuilder.LearnDecisions(modelBuilder.Transactions, pt)
+	users := NewQueryParser(modelBuilder.QuerySet).ParseQuery(`{"sql":"SELECT * FROM users WHERE id = 0","results":[]}`).QueryID
+	if decision := pt.trees[users].Payload.(*Prediction).Decision; decision != nil {
+		t.Fatalf("Expecting no decision on the IDs of the users, got %+v", decision)
+	}
+}
+
+func savedBytes(t testing.TB, pt *PredictionTrees, querySet *QuerySet) []byte {
+	path := filepath.Join(t.TempDir(), "model")
+	if err := SaveModel(path, pt, querySet); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestBuildModel(t *testing.T) {
+	modelBuilder := NewModelBuilder("test/bug.log", DefaultModelBuilderOptions())
+	sequential := NewPredictionTrees()
+	for _, cluster := range modelBuilder.Clusters {
+		modelBuilder.UpdateModel(cluster, sequential)
+	}
+	expected := savedBytes(t, sequential, modelBuilder.QuerySet)
+	for _, workers := range []int{1, 4} {
+		pt := NewPredictionTrees()
+		modelBuilder.BuildModel(modelBuilder.Clusters, pt, workers)
+		if !bytes.Equal(savedBytes(t, pt, modelBuilder.QuerySet), expected) {
+			t.Fatalf("Expecting the model built by %d workers to be the same as the sequential one", workers)
+		}
+	}
+}
+
+func BenchmarkBuildModel(b *testing.B) {
+	modelBuilder := NewModelBuilder("test/bug.log", DefaultModelBuilderOptions())
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				modelBuilder.BuildModel(modelBuilder.Clusters, NewPredictionTrees(), workers)
+			}
+		})
 	}
 }
@@ -0,0 +1,176 @@
+package speculative
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PruneOptions tells which nodes of the prediction trees to prune.
+// A zero value disables the corresponding rule.
+type PruneOptions struct {
+	// MinHitRatio is the fraction of the transactions that issued its
+	// query right after its parent that a node must match to be kept.
+	// The most hit node for each query is always kept.
+	MinHitRatio float64 `json:"minHitRatio"`
+	// MaxChildren caps the number of children of a node,
+	// keeping the most hit ones.
+	MaxChildren int `json:"maxChildren"`
+	// MaxNodes caps the number of nodes across all trees, which bounds
+	// their memory. The least hit nodes are evicted first.
+	MaxNodes int `json:"maxNodes"`
+}
+
+// PruneReport tells how many nodes were pruned by each rule,
+// counting the subtrees of the pruned nodes.
+type PruneReport struct {
+	LowHitRatio     int
+	OverMaxChildren int
+	Evicted         int
+	// TruncatedLevels counts the levels of the trees whose training
+	// stopped early because too many nodes were reached.
+	TruncatedLevels int
+	// NodesBefore and NodesAfter are the number of nodes before and
+	// after the last Prune, UpdateModel or BuildModel.
+	NodesBefore int
+	NodesAfter  int
+}
+
+// ToString returns a string representation of this report.
+func (report *PruneReport) ToString() string {
+	return fmt.Sprintf("%d -> %d nodes: %d pruned for a low hit ratio, %d over the children cap, %d evicted, %d truncated levels",
+		report.NodesBefore, report.NodesAfter, report.LowHitRatio, report.OverMaxChildren, report.Evicted, report.TruncatedLevels)
+}
+
+// add adds the counts of another report to this one.
+func (report *PruneReport) add(other PruneReport) {
+	report.LowHitRatio += other.LowHitRatio
+	report.OverMaxChildren += other.OverMaxChildren
+	report.Evicted += other.Evicted
+	report.TruncatedLevels += other.TruncatedLevels
+}
+
+// Size returns the number of nodes across all trees.
+func (pt *PredictionTrees) Size() int {
+	size := 0
+	for _, tree := range pt.trees {
+		size += tree.Size()
+	}
+	return size
+}
+
+// roots returns the roots of the trees, sorted by query ID.
+func (pt *PredictionTrees) roots() []*Node {
+	roots := make([]*Node, 0, len(pt.trees))
+	for _, tree := range pt.trees {
+		roots = append(roots, tree)
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		return roots[i].Payload.(*Prediction).QueryID < roots[j].Payload.(*Prediction).QueryID
+	})
+	return roots
+}
+
+// Prune prunes the trees following the options,
+// and reports what was pruned.
+func (pt *PredictionTrees) Prune(options PruneOptions) *PruneReport {
+	report := &PruneReport{NodesBefore: pt.Size()}
+	for _, root := range pt.roots() {
+		nodes := []*Node{root}
+		for len(nodes) > 0 {
+			node := nodes[0]
+			nodes = nodes[1:]
+			pruneChildren(node, options, report)
+			nodes = append(nodes, node.Children...)
+		}
+	}
+	if options.MaxNodes > 0 {
+		pt.evict(options.MaxNodes, report)
+	}
+	report.NodesAfter = pt.Size()
+	return report
+}
+
+// pruneChildren removes the children of the node with a low hit
+// ratio, and then the least hit ones over the cap. It returns the
+// children removed.
+func pruneChildren(node *Node, options PruneOptions, report *PruneReport) map[*Node]bool {
+	removed := make(map[*Node]bool)
+	if options.MinHitRatio > 0 {
+		best := make(map[int]*Node)
+		for _, child := range node.Children {
+			queryID := child.Payload.(*Prediction).QueryID
+			if best[queryID] == nil || child.Payload.(*Prediction).HitCount > best[queryID].Payload.(*Prediction).HitCount {
+				best[queryID] = child
+			}
+		}
+		for _, child := range node.RemoveChildren(func(child *Node) bool {
+			prediction := child.Payload.(*Prediction)
+			return best[prediction.QueryID] != child && prediction.Trials > 0 &&
+				float64(prediction.HitCount) < options.MinHitRatio*float64(prediction.Trials)
+		}) {
+			removed[child] = true
+			report.LowHitRatio += child.Size()
+		}
+	}
+	if options.MaxChildren > 0 && len(node.Children) > options.MaxChildren {
+		ranked := append([]*Node{}, node.Children...)
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return ranked[i].Payload.(*Prediction).HitCount > ranked[j].Payload.(*Prediction).HitCount
+		})
+		dropped := make(map[*Node]bool)
+		for _, child := range ranked[options.MaxChildren:] {
+			dropped[child] = true
+		}
+		for _, child := range node.RemoveChildren(func(child *Node) bool { return dropped[child] }) {
+			removed[child] = true
+			report.OverMaxChildren += child.Size()
+		}
+	}
+	return removed
+}
+
+// evict removes the least hit nodes, deepest first, together with their
+// subtrees, until the trees have at most maxNodes nodes. Roots are kept.
+func (pt *PredictionTrees) evict(maxNodes int, report *PruneReport) {
+	total := pt.Size()
+	if total <= maxNodes {
+		return
+	}
+	candidates := []*Node{}
+	depths := make(map[*Node]int)
+	for _, root := range pt.roots() {
+		nodes := []*Node{root}
+		for len(nodes) > 0 {
+			node := nodes[0]
+			nodes = nodes[1:]
+			for _, child := range node.Children {
+				depths[child] = depths[node] + 1
+				candidates = append(candidates, child)
+			}
+			nodes = append(nodes, node.Children...)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		hits1 := candidates[i].Payload.(*Prediction).HitCount
+		hits2 := candidates[j].Payload.(*Prediction).HitCount
+		return hits1 < hits2 || (hits1 == hits2 && depths[candidates[i]] > depths[candidates[j]])
+	})
+	removed := make(map[*Node]bool)
+	for _, node := range candidates {
+		if total <= maxNodes {
+			break
+		}
+		detached := false
+		for ancestor := node.Parent; ancestor != nil; ancestor = ancestor.Parent {
+			detached = detached || removed[ancestor]
+		}
+		if detached {
+			continue
+		}
+		size := node.Size()
+		node.Parent.RemoveChildren(func(child *Node) bool { return child == node })
+		removed[node] = true
+		total -= size
+		report.Evicted += size
+	}
+}
@@ -0,0 +1,73 @@
+package speculative
+
+import (
+	"testing"
+)
+
+func buildBugTrees(builder *ModelBuilder) *PredictionTrees {
+	pt := NewPredictionTrees()
+	for _, cluster := range builder.Clusters {
+		builder.UpdateModel(cluster, pt)
+	}
+	return pt
+}
+
+func maxChildren(node *Node) int {
+	result := len(node.Children)
+	for _, child := range node.Children {
+		result = max(result, maxChildren(child))
+	}
+	return result
+}
+
+func TestPrune(t *testing.T) {
+	modelBuilder := NewModelBuilder("test/bug.log", DefaultModelBuilderOptions())
+	pt := buildBugTrees(modelBuilder)
+	size := pt.Size()
+
+	report := pt.Prune(PruneOptions{MaxChildren: 1})
+	if report.NodesBefore != size || report.NodesAfter != size-report.OverMaxChildren {
+		t.Fatalf("Unexpected report %s", report.ToString())
+	}
+	for _, root := range pt.roots() {
+		if maxChildren(root) > 1 {
+			t.Fatalf("Expecting at most one child per node")
+		}
+	}
+
+	budget := report.NodesAfter / 2
+	report = pt.Prune(PruneOptions{MaxNodes: budget})
+	if report.NodesAfter > budget || report.Evicted != report.NodesBefore-report.NodesAfter {
+		t.Fatalf("Unexpected report %s", report.ToString())
+	}
+	if len(pt.roots()) == 0 {
+		t.Fatalf("Expecting the roots to be kept")
+	}
+}
+
+func TestPruneWhileBuilding(t *testing.T) {
+	modelBuilder := NewModelBuilder("test/bug.log", DefaultModelBuilderOptions())
+	unpruned := buildBugTrees(modelBuilder)
+	modelBuilder = NewModelBuilder("test/bug.log", DefaultModelBuilderOptions())
+	modelBuilder.Options.Pruning = PruneOptions{MinHitRatio: 0.5, MaxChildren: 4}
+	pruned := buildBugTrees(modelBuilder)
+	if pruned.Size() >= unpruned.Size() {
+		t.Fatalf("Expecting pruning to shrink the trees, got %d and %d nodes", pruned.Size(), unpruned.Size())
+	}
+	if modelBuilder.PruneReport.LowHitRatio+modelBuilder.PruneReport.OverMaxChildren == 0 {
+		t.Fatalf("Expecting the report to count the pruned nodes")
+	}
+	if modelBuilder.PruneReport.NodesAfter != pruned.Size() {
+		t.Fatalf("Expecting the report to count the nodes after the update, got %s", modelBuilder.PruneReport.ToString())
+	}
+	built := NewPredictionTrees()
+	modelBuilder.BuildModel(modelBuilder.Clusters, built, 2)
+	if modelBuilder.PruneReport.NodesBefore != 0 || modelBuilder.PruneReport.NodesAfter != built.Size() {
+		t.Fatalf("Expecting the report to count the nodes built, got %s", modelBuilder.PruneReport.ToString())
+	}
+	for _, root := range pruned.roots() {
+		if maxChildren(root) > 4 {
+			t.Fatalf("Expecting at most 4 children per node")
+		}
+	}
+}
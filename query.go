@@ -6,6 +6,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Query represents a SQL query.
@@ -14,6 +15,27 @@ type Query struct {
 	ResultSet [][]interface{}
 	Arguments []interface{}
 	IsSelect  bool
+	// Iterations is only set for a loop step, i.e., a query that
+	// is issued once per row of an earlier result. It contains all
+	// the executions of the query, while the other fields are taken
+	// from the first one.
+	Iterations []*Query
+	// Time is when the query was issued. It is zero if unknown.
+	Time time.Time
+	// Members is only set for an unordered group step, i.e., reads that
+	// may be issued in any order. It contains the reads sorted by query
+	// ID, while QueryID is that of the first one.
+	Members []*Query
+}
+
+// IsLoop returns true if this query is a folded loop step.
+func (query *Query) IsLoop() bool {
+	return query.Iterations != nil
+}
+
+// IsGroup returns true if this query is a folded unordered group step.
+func (query *Query) IsGroup() bool {
+	return query.Members != nil
 }
 
 func listToString(list []interface{}) string {
@@ -168,6 +190,9 @@ func (queryParser *QueryParser) toTemplate(sql string) string {
 }
 
 // ParseQuery parses a SQL query in text and returns a Query object for it.
+// The text is a JSON object with the "sql" of the query, its "results" as
+// an array of rows, and optionally the "time" it was issued at, in RFC 3339
+// format with optional fractional seconds, e.g. "2017-01-24T18:20:31.123Z".
 func (queryParser *QueryParser) ParseQuery(text string) *Query {
 	var queryJSON map[string]interface{}
 	if err := json.Unmarshal([]byte(text), &queryJSON); err != nil {
@@ -195,5 +220,9 @@ func (queryParser *QueryParser) ParseQuery(text string) *Query {
 	args := queryParser.argumentPattern.FindAllString(sql, -1)
 	arguments := queryParser.convertArguments(args)
 	isSelect := strings.HasPrefix(strings.ToLower(strings.TrimSpace(sql)), "select")
-	return &Query{queryID, resultSet, arguments, isSelect}
+	var issuedAt time.Time
+	if timeString, ok := queryJSON["time"].(string); ok {
+		issuedAt, _ = time.Parse(time.RFC3339Nano, timeString)
+	}
+	return &Query{QueryID: queryID, ResultSet: resultSet, Arguments: arguments, IsSelect: isSelect, Time: issuedAt}
 }
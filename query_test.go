@@ -60,7 +60,7 @@ func TestQueryParserParseString(test *testing.T) {
 		NewUnorderedSet([]interface{}{42.42, 43.42, 44.42}), NewUnorderedSet([]interface{}{"42", "43", "44"})}
 	manager := FakeQueryManager{0, expectedTemplate}
 	queryParser := NewQueryParser(&manager)
-	expectedQuery := &Query{0, [][]interface{}{[]interface{}{42.0, "Is42"}, []interface{}{42.0}}, arguments, true}
+	expectedQuery := &Query{QueryID: 0, ResultSet: [][]interface{}{[]interface{}{42.0, "Is42"}, []interface{}{42.0}}, Arguments: arguments, IsSelect: true}
 	actualQuery := queryParser.ParseQuery(sqlJSON)
 	actualTemplate := manager.GetTemplate(actualQuery.QueryID)
 	if actualTemplate != expectedTemplate {
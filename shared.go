@@ -0,0 +1,278 @@
+package speculative
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ModelSnapshot is a published version of a shared model.
+// Its trees are never modified.
+type ModelSnapshot struct {
+	Trees   *PredictionTrees
+	Version uint64
+}
+
+// speculationOutcome counts the hits and misses of the
+// speculations made with a prediction.
+type speculationOutcome struct {
+	hits   int
+	misses int
+}
+
+// SharedModel shares prediction trees between the predictors of many
+// connections, which can predict concurrently without locking, while
+// a trainer updates the trees and publishes new versions atomically.
+//
+// The trainer works on a private copy of the trees, the master, and
+// publishes a snapshot of it on every update. A predictor reads the
+// latest snapshot at the start of every transaction and keeps it until
+// the transaction ends. The speculation outcomes and, if online learning
+// is enabled, the transactions of the predictors are reported when their
+// transactions end, and folded into the master at the next update.
+//
+// A snapshot shares the trees left unchanged since the previous one,
+// and the copies of the predictions left unchanged in the others.
+type SharedModel struct {
+	current atomic.Pointer[ModelSnapshot]
+	// mutex guards the fields below.
+	mutex  sync.Mutex
+	master *PredictionTrees
+	// origins maps the predictions of the current snapshot, and their
+	// members, to the ones of the master they were copied from, and
+	// copies maps the nodes of the master to the copies of their
+	// predictions.
+	origins map[*Prediction]origin
+	copies  map[*Node]*Prediction
+	// changed holds the nodes of the master whose predictions changed
+	// since the last publish. Every prediction is copied again if
+	// copyAll is set.
+	changed  map[*Node]bool
+	copyAll  bool
+	outcomes map[*Prediction]speculationOutcome
+	// learner learns the pending transactions into the master,
+	// if online learning is enabled.
+	learner *Predictor
+	pending [][]*Query
+}
+
+// origin is the prediction of the master a prediction was copied
+// from, and the node of the master holding it.
+type origin struct {
+	prediction *Prediction
+	node       *Node
+}
+
+// maxPendingTransactions caps the number of transactions reported
+// between two updates. Once reached, they are learned into the master
+// right away, and published at the next update.
+const maxPendingTransactions = 10000
+
+// NewSharedModel creates a shared model whose master is pt,
+// which must no longer be used elsewhere, and publishes version 1.
+func NewSharedModel(pt *PredictionTrees) *SharedModel {
+	model := &SharedModel{}
+	model.master = pt
+	model.copyAll = true
+	model.publish()
+	return model
+}
+
+// copyNode copies the node and its subtree for the next snapshot. The
+// copies of the predictions left unchanged since the last one are kept.
+func (model *SharedModel) copyNode(node *Node, parent *Node) *Node {
+	prediction := node.Payload.(*Prediction)
+	copied := model.copies[node]
+	if copied == nil || model.changed[node] || model.origins[copied].prediction != prediction {
+		if copied != nil {
+			model.forget(copied)
+		}
+		copied = remapPrediction(prediction, nil)
+		model.copies[node] = copied
+		model.origins[copied] = origin{prediction, node}
+		for i, member := range copied.Members {
+			model.origins[member] = origin{prediction.Members[i], node}
+		}
+	}
+	clone := NewNode(copied, parent)
+	for _, child := range node.Children {
+		clone.Children = append(clone.Children, model.copyNode(child, clone))
+	}
+	return clone
+}
+
+// forget forgets the origins of a copy that is replaced.
+func (model *SharedModel) forget(copied *Prediction) {
+	delete(model.origins, copied)
+	for _, member := range copied.Members {
+		delete(model.origins, member)
+	}
+}
+
+// publish publishes a copy of the master as the next version. Only the
+// trees with changed nodes are copied, and only the changed predictions
+// in them, unless copyAll is set. The caller holds the mutex, unless the
+// model is being created.
+func (model *SharedModel) publish() uint64 {
+	current := model.current.Load()
+	if model.copyAll || current == nil {
+		model.origins = make(map[*Prediction]origin)
+		model.copies = make(map[*Node]*Prediction)
+	}
+	changedRoots := make(map[*Node]bool)
+	for node := range model.changed {
+		for node.Parent != nil {
+			node = node.Parent
+		}
+		changedRoots[node] = true
+	}
+	trees := &PredictionTrees{make(map[int]*Node, len(model.master.trees)), model.master.Options, model.master.Split}
+	for queryID, root := range model.master.trees {
+		if previous := model.copies[root]; previous != nil && current != nil && !changedRoots[root] {
+			if tree := current.Trees.trees[queryID]; tree != nil && tree.Payload == previous {
+				trees.trees[queryID] = tree
+				continue
+			}
+		}
+		trees.trees[queryID] = model.copyNode(root, nil)
+	}
+	version := uint64(1)
+	if current != nil {
+		version = current.Version + 1
+	}
+	model.changed = make(map[*Node]bool)
+	model.copyAll = false
+	model.outcomes = make(map[*Prediction]speculationOutcome)
+	model.current.Store(&ModelSnapshot{trees, version})
+	return version
+}
+
+// Snapshot returns the latest published version.
+func (model *SharedModel) Snapshot() *ModelSnapshot {
+	return model.current.Load()
+}
+
+// Update applies the pending speculation outcomes and transactions to the
+// master, then update if not nil, and publishes the result as a new
+// version, which it returns. update may modify the trees it is given,
+// e.g., with ModelBuilder.UpdateModel, but must not keep them. As the
+// changes it makes are unknown, the whole master is copied after it.
+func (model *SharedModel) Update(update func(pt *PredictionTrees)) uint64 {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	for prediction, outcome := range model.outcomes {
+		origin := model.origins[prediction]
+		origin.prediction.SpeculationHits += outcome.hits
+		origin.prediction.SpeculationMisses += outcome.misses
+		model.changed[origin.node] = true
+	}
+	model.learnPending()
+	if update != nil {
+		update(model.master)
+		model.copyAll = true
+	}
+	return model.publish()
+}
+
+// learnPending learns the pending transactions into the master,
+// and records the nodes learning changed.
+func (model *SharedModel) learnPending() {
+	if model.learner != nil {
+		for _, trx := range model.pending {
+			model.learner.learn(trx)
+		}
+		for node := range model.learner.touched {
+			model.changed[node] = true
+		}
+		model.learner.touched = make(map[*Node]bool)
+	}
+	model.pending = nil
+}
+
+// Replace replaces the master with pt, e.g., a model trained from
+// scratch, which must no longer be used elsewhere, and publishes it as
+// a new version, which it returns. The pending speculation outcomes,
+// which are about the previous model, are dropped, while the pending
+// transactions are kept for the next update.
+func (model *SharedModel) Replace(pt *PredictionTrees) uint64 {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	model.master = pt
+	if model.learner != nil {
+		model.learner.pt = pt
+		model.learner.examples = make(map[*Node][][]*Query)
+		model.learner.touched = make(map[*Node]bool)
+	}
+	model.changed = make(map[*Node]bool)
+	model.copyAll = true
+	return model.publish()
+}
+
+// EnableOnlineLearning makes the predictors of the model report their
+// transactions, which are learned into the master at the next update as
+// Predictor.EnableOnlineLearning does.
+func (model *SharedModel) EnableOnlineLearning(builder *ModelBuilder, minExamples int) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	model.learner = model.master.NewPredictor(builder.QuerySet)
+	model.learner.EnableOnlineLearning(builder, minExamples)
+	model.learner.touched = make(map[*Node]bool)
+}
+
+// report records the speculation outcomes and the transaction of a
+// predictor. The outcomes are dropped if they are about another version.
+// The transactions are learned once maxPendingTransactions are pending.
+func (model *SharedModel) report(version uint64, outcomes map[*Prediction]speculationOutcome, trx []*Query) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if version == model.current.Load().Version {
+		for prediction, outcome := range outcomes {
+			total := model.outcomes[prediction]
+			total.hits += outcome.hits
+			total.misses += outcome.misses
+			model.outcomes[prediction] = total
+		}
+	}
+	if model.learner != nil && len(trx) > 0 {
+		model.pending = append(model.pending, trx)
+		if len(model.pending) >= maxPendingTransactions {
+			model.learnPending()
+		}
+	}
+}
+
+// NewPredictor creates a predictor using the latest version of the model
+// at the start of every transaction. Predictors can be used concurrently,
+// but each of them by one goroutine at a time.
+func (model *SharedModel) NewPredictor(manager QueryManager) *Predictor {
+	snapshot := model.Snapshot()
+	predictor := snapshot.Trees.NewPredictor(manager)
+	predictor.shared = model
+	predictor.version = snapshot.Version
+	predictor.outcomes = make(map[*Prediction]speculationOutcome)
+	return predictor
+}
+
+// Version returns the version of the shared model used in the
+// current transaction, or 0 if the predictor is not shared.
+func (pt *Predictor) Version() uint64 {
+	return pt.version
+}
+
+// pinSnapshot reports the outcomes recorded so far,
+// and switches to the latest version of the shared model.
+func (pt *Predictor) pinSnapshot() {
+	pt.reportShared(nil)
+	snapshot := pt.shared.Snapshot()
+	pt.pt = snapshot.Trees
+	pt.version = snapshot.Version
+}
+
+// reportShared reports the outcomes recorded so far and
+// the transaction, if not nil, to the shared model.
+func (pt *Predictor) reportShared(trx []*Query) {
+	if len(pt.outcomes) == 0 && len(trx) == 0 {
+		return
+	}
+	pt.shared.report(pt.version, pt.outcomes, trx)
+	pt.outcomes = make(map[*Prediction]speculationOutcome)
+}
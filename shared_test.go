@@ -0,0 +1,140 @@
+package speculative
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func sharedTestBuilder() *ModelBuilder {
+	trace := testTrace(10, func(i int) []traceQuery {
+		return []traceQuery{userQuery(i, i+100), storiesQuery(i + 100)}
+	})
+	trace += "\n" + testTrace(10, func(i int) []traceQuery {
+		return []traceQuery{{fmt.Sprintf("SELECT * FROM tags WHERE id = %d", i), fmt.Sprintf("[[%d]]", i+100)},
+			{fmt.Sprintf("SELECT * FROM taggings WHERE tag_id = %d", i+100), "[]"}}
+	})
+	return NewModelBuilderFromContent(trace, DefaultModelBuilderOptions())
+}
+
+// runTransaction predicts and moves through the transaction, and returns the hits.
+func runTransaction(predictor *Predictor, trx []*Query) int {
+	hits := 0
+	for position, query := range trx {
+		if position > 0 && query.Same(predictor.PredictNextQuery()) {
+			hits++
+		}
+		predictor.MoveToNext(query)
+	}
+	predictor.EndTransaction()
+	return hits
+}
+
+func TestSharedModelVersions(t *testing.T) {
+	modelBuilder := sharedTestBuilder()
+	users := modelBuilder.Transactions[0]
+	tags := modelBuilder.Transactions[10]
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Transactions[:10], pt)
+	model := NewSharedModel(pt)
+	predictor := model.NewPredictor(modelBuilder.QuerySet)
+	if runTransaction(predictor, users) != 1 || predictor.Version() != 1 {
+		t.Fatalf("Expecting the stories to be predicted with version 1")
+	}
+	if runTransaction(predictor, tags) != 0 {
+		t.Fatalf("Expecting nothing to be predicted for the tags yet")
+	}
+	if len(model.Snapshot().Trees.trees) != 1 {
+		t.Fatalf("Expecting the predictor not to add trees to the snapshot")
+	}
+
+	// The predictor keeps the version it started the transaction with.
+	predictor.MoveToNext(users[0])
+	version := model.Update(func(pt *PredictionTrees) {
+		modelBuilder.UpdateModel(modelBuilder.Transactions[10:], pt)
+	})
+	if version != 2 || predictor.Version() != 1 || predictor.PredictNextQuery() == nil {
+		t.Fatalf("Expecting the transaction to go on with version 1")
+	}
+	predictor.EndTransaction()
+	if runTransaction(predictor, tags) != 1 || predictor.Version() != 2 {
+		t.Fatalf("Expecting the taggings to be predicted with version 2")
+	}
+
+	model.Update(nil)
+	root := model.Snapshot().Trees.trees[tags[0].QueryID]
+	if taggings := root.Children[0].Payload.(*Prediction); taggings.SpeculationHits != 1 || taggings.SpeculationMisses != 0 {
+		t.Fatalf("Expecting the speculation hit to be folded into the model, got %d/%d", taggings.SpeculationHits, taggings.SpeculationMisses)
+	}
+	if model.Replace(NewPredictionTrees()) != 4 || runTransaction(predictor, users) != 0 {
+		t.Fatalf("Expecting the empty model to be used after the replacement")
+	}
+}
+
+func TestSharedModelCopiesChanges(t *testing.T) {
+	modelBuilder := sharedTestBuilder()
+	users := modelBuilder.Transactions[0]
+	tags := modelBuilder.Transactions[10]
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Transactions, pt)
+	model := NewSharedModel(pt)
+	before := model.Snapshot().Trees
+	runTransaction(model.NewPredictor(modelBuilder.QuerySet), users)
+	model.Update(nil)
+	after := model.Snapshot().Trees
+	if after.trees[tags[0].QueryID] != before.trees[tags[0].QueryID] {
+		t.Fatalf("Expecting the tree of the tags to be shared")
+	}
+	root := after.trees[users[0].QueryID]
+	if root == before.trees[users[0].QueryID] || root.Payload != before.trees[users[0].QueryID].Payload {
+		t.Fatalf("Expecting the root of the users to be shared by a new tree")
+	}
+	if stories := root.Children[0].Payload.(*Prediction); stories.SpeculationHits != 1 || root.Children[0].Parent != root {
+		t.Fatalf("Expecting the stories to be copied with the speculation hit")
+	}
+}
+
+func TestSharedModelOnlineLearning(t *testing.T) {
+	modelBuilder := sharedTestBuilder()
+	model := NewSharedModel(NewPredictionTrees())
+	model.EnableOnlineLearning(modelBuilder, 3)
+	predictor := model.NewPredictor(modelBuilder.QuerySet)
+	for _, trx := range modelBuilder.Transactions[:5] {
+		runTransaction(predictor, trx)
+	}
+	if len(model.Snapshot().Trees.trees) != 0 {
+		t.Fatalf("Expecting the transactions to be learned at the next update only")
+	}
+	model.Update(nil)
+	if runTransaction(predictor, modelBuilder.Transactions[5]) != 1 {
+		t.Fatalf("Expecting the learned stories to be predicted")
+	}
+}
+
+func TestSharedModelConcurrency(t *testing.T) {
+	modelBuilder := sharedTestBuilder()
+	pt := NewPredictionTrees()
+	modelBuilder.UpdateModel(modelBuilder.Transactions[:10], pt)
+	model := NewSharedModel(pt)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			predictor := model.NewPredictor(modelBuilder.QuerySet)
+			for i := 0; i < 50; i++ {
+				runTransaction(predictor, modelBuilder.Transactions[(w+i)%len(modelBuilder.Transactions)])
+				predictor.PredictTopK(2)
+			}
+		}(w)
+	}
+	for i := 0; i < 10; i++ {
+		model.Update(func(pt *PredictionTrees) {
+			modelBuilder.UpdateModel(modelBuilder.Transactions[10+i:11+i], pt)
+		})
+	}
+	wg.Wait()
+	if model.Snapshot().Version != 11 {
+		t.Fatalf("Expecting 10 updates to be published, got version %d", model.Snapshot().Version)
+	}
+}
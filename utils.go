@@ -2,6 +2,7 @@ package speculative
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -28,17 +29,33 @@ func (node *Node) AddChildren(children []*Node) {
 	node.Children = append(node.Children, children...)
 }
 
-// FilterChildren returns the number of children satisfying certain conditions.
+// FilterChildren returns the children whose payload satisfies certain conditions.
 func (node *Node) FilterChildren(filter func(interface{}) bool) []*Node {
 	filtered := make([]*Node, 0, len(node.Children))
 	for _, child := range node.Children {
-		if filter(child) {
+		if filter(child.Payload) {
 			filtered = append(filtered, child)
 		}
 	}
 	return filtered
 }
 
+// RemoveChildren removes the children for which remove returns
+// true, and returns them.
+func (node *Node) RemoveChildren(remove func(*Node) bool) []*Node {
+	kept := make([]*Node, 0, len(node.Children))
+	removed := []*Node{}
+	for _, child := range node.Children {
+		if remove(child) {
+			removed = append(removed, child)
+		} else {
+			kept = append(kept, child)
+		}
+	}
+	node.Children = kept
+	return removed
+}
+
 // HasNoChildren returns whether or not the node has any child.
 func (node *Node) HasNoChildren() bool {
 	return len(node.Children) == 0
@@ -172,6 +189,11 @@ func (set *UnorderedSet) Insert(element interface{}) {
 	set.elements[element] = true
 }
 
+// Contains returns true if the element is in the set.
+func (set *UnorderedSet) Contains(element interface{}) bool {
+	return set.elements[element]
+}
+
 // Equal returns true if these two sets contain the same elements.
 func (set *UnorderedSet) Equal(another *UnorderedSet) bool {
 	if len(set.elements) != len(another.elements) {
@@ -200,3 +222,131 @@ func (set *UnorderedSet) Elements() []interface{} {
 func (set *UnorderedSet) ToString() string {
 	return listToString(set.Elements())
 }
+
+// ValueCount is a value together with how many times it was seen.
+type ValueCount struct {
+	Value interface{}
+	Count int
+}
+
+// ValueSketch counts the frequencies of at most a fixed number of
+// distinct values, using the space-saving algorithm: when it is full,
+// a new value replaces the least frequent one and inherits its count,
+// so the counts of frequent values are overestimated by at most that.
+type ValueSketch struct {
+	capacity int
+	total    int
+	counts   map[string]*ValueCount
+}
+
+// NewValueSketch creates an empty sketch keeping track of at most
+// capacity distinct values.
+func NewValueSketch(capacity int) *ValueSketch {
+	return &ValueSketch{capacity, 0, make(map[string]*ValueCount)}
+}
+
+func sketchKey(value interface{}) string {
+	if set, ok := value.(*UnorderedSet); ok {
+		elements := set.Elements()
+		strs := make([]string, len(elements))
+		for i, ele := range elements {
+			strs[i] = fmt.Sprintf("%T:%v", ele, ele)
+		}
+		sort.Strings(strs)
+		return strings.Join(strs, ",")
+	}
+	return fmt.Sprintf("%T:%v", value, value)
+}
+
+// Observe records an occurrence of the value.
+func (sketch *ValueSketch) Observe(value interface{}) {
+	sketch.total++
+	key := sketchKey(value)
+	if count, ok := sketch.counts[key]; ok {
+		count.Count++
+		return
+	}
+	if len(sketch.counts) < sketch.capacity {
+		sketch.counts[key] = &ValueCount{value, 1}
+		return
+	}
+	minKey := ""
+	var minCount *ValueCount
+	for key, count := range sketch.counts {
+		if minCount == nil || count.Count < minCount.Count ||
+			(count.Count == minCount.Count && key < minKey) {
+			minKey = key
+			minCount = count
+		}
+	}
+	delete(sketch.counts, minKey)
+	sketch.counts[key] = &ValueCount{value, minCount.Count + 1}
+}
+
+// Total returns the number of values observed.
+func (sketch *ValueSketch) Total() int {
+	return sketch.total
+}
+
+// Top returns at most n of the most frequent values, most frequent first.
+func (sketch *ValueSketch) Top(n int) []ValueCount {
+	keys := make([]string, 0, len(sketch.counts))
+	for key := range sketch.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		count1 := sketch.counts[keys[i]].Count
+		count2 := sketch.counts[keys[j]].Count
+		return count1 > count2 || (count1 == count2 && keys[i] < keys[j])
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	top := make([]ValueCount, len(keys))
+	for i, key := range keys {
+		top[i] = *sketch.counts[key]
+	}
+	return top
+}
+
+// Copy returns a copy of the sketch that is not updated along with it.
+func (sketch *ValueSketch) Copy() *ValueSketch {
+	copied := NewValueSketch(sketch.capacity)
+	copied.Merge(sketch)
+	return copied
+}
+
+// Merge adds the values observed by another sketch to this one.
+// The least frequent values are dropped past the capacity.
+func (sketch *ValueSketch) Merge(other *ValueSketch) {
+	sketch.total += other.total
+	for key, count := range other.counts {
+		if own, ok := sketch.counts[key]; ok {
+			own.Count += count.Count
+		} else {
+			sketch.counts[key] = &ValueCount{count.Value, count.Count}
+		}
+	}
+	for len(sketch.counts) > sketch.capacity {
+		minKey := ""
+		var minCount *ValueCount
+		for key, count := range sketch.counts {
+			if minCount == nil || count.Count < minCount.Count ||
+				(count.Count == minCount.Count && key < minKey) {
+				minKey = key
+				minCount = count
+			}
+		}
+		delete(sketch.counts, minKey)
+	}
+}
+
+// Frequency returns the estimated fraction of the observations
+// that are of the most frequent value.
+func (sketch *ValueSketch) Frequency() float64 {
+	top := sketch.Top(1)
+	if len(top) == 0 {
+		return 0
+	}
+	return float64(top[0].Count) / float64(sketch.total)
+}
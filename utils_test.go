@@ -1,9 +1,48 @@
 package speculative
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 )
 
+// traceQuery is a query of a test trace: its SQL, and its results in JSON.
+type traceQuery struct {
+	sql     string
+	results string
+}
+
+// testTrace returns a trace of n transactions, the i-th of which issues
+// the queries returned by queries(i) between a BEGIN and a COMMIT.
+func testTrace(n int, queries func(i int) []traceQuery) string {
+	lines := []string{}
+	for i := 0; i < n; i++ {
+		lines = append(lines, `{"sql":"BEGIN","results":{}}`)
+		for _, query := range queries(i) {
+			sql, _ := json.Marshal(query.sql)
+			lines = append(lines, fmt.Sprintf(`{"sql":%s,"results":%s}`, sql, query.results))
+		}
+		lines = append(lines, `{"sql":"COMMIT","results":{}}`)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// userQuery selects the user with the given ID, whose only column is column.
+func userQuery(id int, column int) traceQuery {
+	return traceQuery{fmt.Sprintf("SELECT * FROM users WHERE id = %d", id), fmt.Sprintf("[[%d]]", column)}
+}
+
+// keystoresQuery selects the value of the key, which is missing.
+func keystoresQuery(key string) traceQuery {
+	return traceQuery{fmt.Sprintf("SELECT * FROM keystores WHERE key = '%s'", key), "[]"}
+}
+
+// storiesQuery selects the stories of the user with the given ID, of which there is none.
+func storiesQuery(userID int) traceQuery {
+	return traceQuery{fmt.Sprintf("SELECT * FROM stories WHERE user_id = %d", userID), "[]"}
+}
+
 func TestNodeToString(t *testing.T) {
 	root := NewNode(0, nil)
 	firstLevel := []*Node{NewNode(1, root), NewNode(2, root), NewNode(3, root)}
@@ -26,6 +65,17 @@ func TestNodeToString(t *testing.T) {
 	}
 }
 
+func TestFilterChildren(t *testing.T) {
+	root := NewNode(0, nil)
+	root.AddChildren([]*Node{NewNode(1, root), NewNode(2, root), NewNode(3, root)})
+	filtered := root.FilterChildren(func(payload interface{}) bool {
+		return payload.(int) != 2
+	})
+	if len(filtered) != 2 || filtered[0] != root.Children[0] || filtered[1] != root.Children[2] {
+		t.Fatalf("Expecting the filter to be given the payloads, got %d children", len(filtered))
+	}
+}
+
 func TestSetEqual(t *testing.T) {
 	set1 := NewUnorderedSet([]interface{}{1, 2, 3, 4, 5})
 	set2 := NewUnorderedSet([]interface{}{3, 5, 2, 1, 4})
@@ -33,3 +83,17 @@ func TestSetEqual(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestValueSketch(t *testing.T) {
+	sketch := NewValueSketch(2)
+	for _, value := range []interface{}{"a", "b", "a", "c", "a", 1.0, "a"} {
+		sketch.Observe(value)
+	}
+	top := sketch.Top(2)
+	if sketch.Total() != 7 || len(top) != 2 || top[0].Value != "a" || top[0].Count != 4 {
+		t.Fatalf("Unexpected top values %+v", top)
+	}
+	if sketch.Frequency() != 4.0/7.0 {
+		t.Fatalf("Unexpected frequency %v", sketch.Frequency())
+	}
+}